@@ -98,7 +98,11 @@ func TestAuthorizeBearMispell(t *testing.T) {
 	body, _ := io.ReadAll(resp.Body)
 
 	fmt.Println(string(body))
-	var result = `"No username in request body"` + "\n"
+	var result = `{
+  "code": "bad_request",
+  "message": "No username in request body",
+  "path": "/auth"
+}`
 
 	if string(body) != result {
 		t.Errorf("output incorrect: format correct then incorrect")
@@ -142,7 +146,11 @@ func TestAuthorizeEmpty(t *testing.T) {
 	body, _ := io.ReadAll(resp.Body)
 
 	fmt.Println(string(body))
-	var result = `"No username in request body"` + "\n"
+	var result = `{
+  "code": "bad_request",
+  "message": "No username in request body",
+  "path": "/auth"
+}`
 
 	if string(body) != result {
 		t.Errorf("output incorrect: format correct then incorrect")
@@ -0,0 +1,197 @@
+// tests serving over TLS: HTTP/2, reloading certificates and authenticating users with client certificates
+package Testing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/certs"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/handler"
+)
+
+// issued is a certificate with its key, signed by a CA or by itself
+type issued struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issues a certificate for name, a CA if parent is nil, otherwise signed by parent
+func issue(t *testing.T, name string, serial int64, parent *issued) issued {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return issued{cert, key}
+}
+
+// writes the certificate and key as PEM files into dir and returns their paths
+func writePEM(t *testing.T, dir string, name string, i issued) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(i.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.cert.Raw}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// tests that the server speaks HTTP/2, and serves a renewed certificate after Reload
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "owldb test CA", 1, nil)
+	caFile, _ := writePEM(t, dir, "ca", ca)
+	certFile, keyFile := writePEM(t, dir, "server", issue(t, "server", 2, &ca))
+
+	reloader, err := certs.New(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = reloader.Config()
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func() *http.Response {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("got %s, want HTTP/2", resp.Proto)
+	}
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("got certificate %d, want 2", serial)
+	}
+
+	// a broken certificate is refused and the current one kept
+	os.WriteFile(certFile, []byte("not a certificate"), 0o600)
+	if err := reloader.Reload(); err == nil {
+		t.Error("reloaded a broken certificate")
+	}
+	if serial := get().TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("got certificate %d after a failed reload, want 2", serial)
+	}
+
+	writePEM(t, dir, "server", issue(t, "server", 3, &ca))
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if serial := get().TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 3 {
+		t.Errorf("got certificate %d after reload, want 3", serial)
+	}
+
+	if _, err := certs.New(certFile, keyFile, caFile+".missing"); err == nil {
+		t.Error("loaded a missing client CA file")
+	}
+}
+
+// tests that a client with a certificate signed by the client CA is the user named by it, without a token
+func TestTLSClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "owldb test CA", 1, nil)
+	caFile, _ := writePEM(t, dir, "ca", ca)
+	certFile, keyFile := writePEM(t, dir, "server", issue(t, "server", 2, &ca))
+	reloader, err := certs.New(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, owlDB, tokenMap, _, schema := setupForGet(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.HndlRequest(w, r, owlDB, tokenMap, schema)
+	}))
+	server.TLS = reloader.Config()
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientFor := func(client *issued) *http.Client {
+		config := &tls.Config{RootCAs: roots}
+		if client != nil {
+			// sent even when its CA is not one the server asks for
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tls.Certificate{Certificate: [][]byte{client.cert.Raw}, PrivateKey: client.key}, nil
+			}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+
+	alice := issue(t, "alice", 10, &ca)
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/v1/db/cert", strings.NewReader(`{"a": 1}`))
+	resp, err := clientFor(&alice).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d with a client certificate, want 201", resp.StatusCode)
+	}
+	if doc := getDocument(t, owlDB, "/v1/db/cert"); doc.Metadata.CreatedBy != "alice" {
+		t.Errorf("document created by %q, want alice", doc.Metadata.CreatedBy)
+	}
+
+	// without a certificate or a token the client is still refused
+	resp, err = clientFor(nil).Get(server.URL + "/v1/db/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d without a client certificate, want 401", resp.StatusCode)
+	}
+
+	// a certificate from another CA fails the handshake
+	stranger := issue(t, "mallory", 11, nil)
+	if _, err := clientFor(&stranger).Get(server.URL + "/v1/db/cert"); err == nil {
+		t.Error("a certificate from an unknown CA was accepted")
+	}
+}
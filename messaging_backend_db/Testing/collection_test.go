@@ -3,6 +3,8 @@
 package Testing
 
 import (
+	"encoding/json"
+	"strings"
 	"sync"
 	"testing"
 
@@ -103,11 +105,14 @@ func TestColPost200(t *testing.T) {
 	doPutDocRequest(t, docURL, token, requestBody, &owlDB, tokenMap, subscribers, schema)
 
 	w := doPostRequest(t, colURL, token, requestBody, &owlDB, tokenMap, subscribers, schema)
-	CheckResponse(t, w, 200, "get_col_200.json")
+	var created map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != 201 || !strings.HasPrefix(created["uri"], "/v1/db/doc/col/") {
+		t.Errorf("post in a collection: got %d %s", w.Code, w.Body.String())
+	}
 
 }
 
-// test a collection post when there is already a document in the collection
+// test a post to a document of the collection, only collections can be posted to
 func TestColPost2002(t *testing.T) {
 	owlDB := database_host.Database_host{Name: "db_host", DBSkipList: skiplist.NewList[string, *database.Database]("", "zzz")}
 	tokenMap := new(sync.Map)
@@ -150,6 +155,6 @@ func TestColPost2002(t *testing.T) {
 	doPutDocRequest(t, docURL, token, requestBody, &owlDB, tokenMap, subscribers, schema)
 
 	w := doPostRequest(t, docURL, token, requestBody, &owlDB, tokenMap, subscribers, schema)
-	CheckResponse(t, w, 400, "get_col_200.json")
+	CheckResponse(t, w, 400, "post_doc_400.json")
 
 }
@@ -0,0 +1,128 @@
+// tests loading the configuration of the server from defaults, a config file, the environment and flags
+package Testing
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/config"
+)
+
+// writes a config file into a temporary directory and returns its path
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "owldb.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// returns a lookupEnv for config.Load that sees only env
+func envOf(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+// parses args with the flags of config.Flags and returns the flags given
+func flagsOf(t *testing.T, args ...string) map[string]string {
+	t.Helper()
+	fs := flag.NewFlagSet("owldb", flag.ContinueOnError)
+	given := config.Flags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return given
+}
+
+// tests that without a file, environment or flags the defaults are valid
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := config.Load("", envOf(nil), nil)
+	if err != nil {
+		t.Fatalf("defaults are invalid: %v", err)
+	}
+	if cfg.Listen != ":3318" || cfg.Schema != "" || time.Duration(cfg.Tokens.TTL) != time.Hour || cfg.MetricsListen != "127.0.0.1:9318" {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+}
+
+// tests that flags override the environment, which overrides the file, which overrides the defaults
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": ":4000",
+		"logLevel": "warn",
+		"tokens": {"ttl": "30m"},
+		"cors": {"origins": ["https://file.example"]},
+		"limits": {"history": 3, "trashRetention": "2h"}
+	}`)
+	env := envOf(map[string]string{
+		"OWLDB_LOG_LEVEL":    "error",
+		"OWLDB_HISTORY":      "5",
+		"OWLDB_CORS_ORIGINS": "https://env.example, https://other.example",
+	})
+	cfg, err := config.Load(path, env, flagsOf(t, "-p", "5000", "-history", "7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"listen from flag", cfg.Listen, ":5000"},
+		{"history from flag", cfg.Limits.History, 7},
+		{"log level from env", cfg.LogLevel, "error"},
+		{"origins from env", strings.Join(cfg.CORS.Origins, " "), "https://env.example https://other.example"},
+		{"ttl from file", time.Duration(cfg.Tokens.TTL), 30 * time.Minute},
+		{"trash retention from file", time.Duration(cfg.Limits.TrashRetention), 2 * time.Hour},
+		{"reap interval from defaults", time.Duration(cfg.Limits.ReapInterval), time.Second},
+		{"trash purge interval from defaults", time.Duration(cfg.Limits.TrashPurgeInterval), time.Minute},
+	}
+	for _, check := range checks {
+		if check.got != check.want {
+			t.Errorf("%s: got %v, want %v", check.name, check.got, check.want)
+		}
+	}
+}
+
+// tests that invalid configurations are refused with a message naming the setting
+func TestConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown field", `{"lisen": ":3318"}`, nil, nil, `unknown field "lisen"`},
+		{"bad duration", `{"tokens": {"ttl": 60}}`, nil, nil, "durations are strings"},
+		{"bad listen", `{"listen": "3318"}`, nil, nil, "listen"},
+		{"cert without key", `{"tls": {"cert": "cert.pem"}}`, nil, nil, "cert and key must be given together"},
+		{"missing schema", `{"schema": "no-such-schema.json"}`, nil, nil, "no-such-schema.json"},
+		{"bad log level", "", map[string]string{"OWLDB_LOG_LEVEL": "loud"}, nil, "logLevel"},
+		{"bad env number", "", map[string]string{"OWLDB_HISTORY": "many"}, nil, "OWLDB_HISTORY"},
+		{"negative limit", "", nil, []string{"-max-body", "-1"}, "maxBodyBytes"},
+		{"zero interval", "", nil, []string{"-reap-interval", "0s"}, "reapInterval"},
+		{"zero trash purge interval", `{"limits": {"trashPurgeInterval": "0s"}}`, nil, nil, "trashPurgeInterval"},
+		{"bad port", "", nil, []string{"-p", "99999"}, "-p"},
+		{"any origin with credentials", `{"cors": {"credentials": true}}`, nil, nil, "credentials need the origins listed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := ""
+			if test.file != "" {
+				path = writeConfig(t, test.file)
+			}
+			_, err := config.Load(path, envOf(test.env), flagsOf(t, test.args...))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want one mentioning %q", err, test.want)
+			}
+		})
+	}
+}
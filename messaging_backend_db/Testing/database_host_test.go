@@ -110,7 +110,7 @@ func TestDBPut201(t *testing.T) {
 }
 
 // testing putting a duplicate database and that an error is thrown
-func TestDBPut400dupDB(t *testing.T) {
+func TestDBPut409dupDB(t *testing.T) {
 	// initialzie the owlDB database and token map
 	// owlDB := database_host.Database_host{DatabaseMap: make(map[string]*database.Database)}
 	owlDB := database_host.Database_host{Name: "db_host", DBSkipList: skiplist.NewList[string, *database.Database]("", "zzz")}
@@ -126,7 +126,7 @@ func TestDBPut400dupDB(t *testing.T) {
 	doPutRequest(t, URL, &owlDB, tokenMap, subscribers, schema, token)
 	w := doPutRequest(t, URL, &owlDB, tokenMap, subscribers, schema, token)
 
-	CheckResponse(t, w, 400, "put_db_dup.json")
+	CheckResponse(t, w, 409, "put_db_dup.json")
 
 }
 
@@ -3,11 +3,18 @@
 package Testing
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/santhosh-tekuri/jsonschema"
 )
@@ -136,3 +143,196 @@ func TestDocPut401(t *testing.T) {
 
 	CheckResponse(t, w, 401, "missingToken.json")
 }
+
+// a listing as of an older sequence does not show documents written after it, and the
+// sequence is gone once nothing holds it any more
+func TestDbGetAsOf(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	// keep the current state readable while a second document is written
+	held := skiplist.NewSnapshot()
+	asOf := fmt.Sprint(held.Seq())
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc2", token, `{"a":"b"}`, owlDB, tokenMap, subscribers, schema)
+
+	w := doGetRequest(t, "http://localhost:3318/v1/db/?asOf="+asOf, token, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 200 || strings.Contains(w.Body.String(), "/doc2") || !strings.Contains(w.Body.String(), "/doc") {
+		t.Errorf("listing as of %s: got %d %s", asOf, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Owldb-Sequence"); got != asOf {
+		t.Errorf("X-Owldb-Sequence = %q, want %q", got, asOf)
+	}
+
+	w = doGetRequest(t, "http://localhost:3318/v1/db/", token, owlDB, tokenMap, subscribers, schema)
+	if !strings.Contains(w.Body.String(), "/doc2") {
+		t.Errorf("latest listing is missing /doc2: %s", w.Body.String())
+	}
+
+	held.Release()
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc3", token, `{"a":"b"}`, owlDB, tokenMap, subscribers, schema)
+	w = doGetRequest(t, "http://localhost:3318/v1/db/?asOf="+asOf, token, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 410 {
+		t.Errorf("listing as of a released sequence: got %d, want 410", w.Code)
+	}
+
+	w = doGetRequest(t, "http://localhost:3318/v1/db/?asOf=x", token, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 400 {
+		t.Errorf("listing with an invalid asOf: got %d, want 400", w.Code)
+	}
+}
+
+// decodes the trash listing of a GET ...?mode=trash response
+func trashPaths(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var entries []docAndColl.TrashEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("unable to decode trash %q: %v", w.Body.String(), err)
+	}
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		if entry.DeletedBy == "" || entry.DeletedAt == 0 {
+			t.Errorf("trash entry %s is missing who deleted it or when: %+v", entry.Path, entry)
+		}
+		paths[i] = entry.Path
+	}
+	return paths
+}
+
+// testing that a deleted document goes to the trash and can be restored from it
+func TestDocUndelete(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	docURL := "http://localhost:3318/v1/db/doc"
+
+	if w := doDeleteRequest(t, docURL, token, owlDB, tokenMap, subscribers, schema); w.Code != 204 {
+		t.Fatalf("delete: got status %d, want 204", w.Code)
+	}
+	if w := doGetRequest(t, docURL, token, owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("deleted document: got status %d, want 404", w.Code)
+	}
+	w := doGetRequest(t, "http://localhost:3318/v1/db/", token, owlDB, tokenMap, subscribers, schema)
+	if strings.Contains(w.Body.String(), `"/doc"`) {
+		t.Errorf("deleted document is still listed: %s", w.Body.String())
+	}
+	w = doGetRequest(t, "http://localhost:3318/v1/db/?mode=trash", token, owlDB, tokenMap, subscribers, schema)
+	if paths := trashPaths(t, w); !reflect.DeepEqual(paths, []string{"/doc"}) {
+		t.Errorf("trash: got %v, want [/doc]", paths)
+	}
+
+	w = doPostRequest(t, "http://localhost:3318/v1/db?mode=undelete&path=/doc", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 201 {
+		t.Fatalf("undelete: got status %d, want 201: %s", w.Code, w.Body.String())
+	}
+	w = doGetRequest(t, docURL, token, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "additionalProp1") {
+		t.Errorf("restored document: got %d %s", w.Code, w.Body.String())
+	}
+	// the collection of the document came back with it
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc/col/", token, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+		t.Errorf("collection of the restored document: got status %d, want 200", w.Code)
+	}
+	if w := doPostRequest(t, "http://localhost:3318/v1/db?mode=undelete&path=/doc", token, "", owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("second undelete: got status %d, want 404", w.Code)
+	}
+}
+
+// testing that an item is not restored over something that took its place
+func TestDocUndelete409(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	docURL := "http://localhost:3318/v1/db/doc"
+
+	doDeleteRequest(t, docURL, token, owlDB, tokenMap, subscribers, schema)
+	doPutDocRequest(t, docURL, token, `{"a": "b"}`, owlDB, tokenMap, subscribers, schema)
+	if w := doPostRequest(t, "http://localhost:3318/v1/db?mode=undelete&path=/doc", token, "", owlDB, tokenMap, subscribers, schema); w.Code != 409 {
+		t.Errorf("undelete over an existing document: got status %d, want 409", w.Code)
+	}
+	// the deleted document stays in the trash
+	w := doGetRequest(t, "http://localhost:3318/v1/db/?mode=trash", token, owlDB, tokenMap, subscribers, schema)
+	if paths := trashPaths(t, w); !reflect.DeepEqual(paths, []string{"/doc"}) {
+		t.Errorf("trash: got %v, want [/doc]", paths)
+	}
+}
+
+// testing that deleted collections and databases can be restored
+func TestColAndDbUndelete(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	doDeleteRequest(t, "http://localhost:4318/v1/db/doc%2Fcol/", token, owlDB, tokenMap, subscribers, schema)
+	w := doPostRequest(t, "http://localhost:3318/v1/db?mode=undelete&path=/doc/col/", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 201 {
+		t.Fatalf("undelete collection: got status %d, want 201: %s", w.Code, w.Body.String())
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc/col/", token, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+		t.Errorf("restored collection: got status %d, want 200", w.Code)
+	}
+
+	doDeleteRequest(t, "http://localhost:3318/v1/db", token, owlDB, tokenMap, subscribers, schema)
+	w = doGetRequest(t, "http://localhost:3318/v1/?mode=trash", token, owlDB, tokenMap, subscribers, schema)
+	if paths := trashPaths(t, w); !reflect.DeepEqual(paths, []string{"db"}) {
+		t.Errorf("database trash: got %v, want [db]", paths)
+	}
+	w = doPostRequest(t, "http://localhost:3318/v1/db?mode=undelete", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 201 {
+		t.Fatalf("undelete database: got status %d, want 201: %s", w.Code, w.Body.String())
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+		t.Errorf("document of the restored database: got status %d, want 200", w.Code)
+	}
+}
+
+// testing that the subscribers of the collection hear about a document restored into it
+func TestDocUndeleteIntoColNotifies(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/post", token, `{"text": "hi"}`, owlDB, tokenMap, subscribers, schema)
+	doDeleteRequest(t, "http://localhost:3318/v1/db/doc/col/post", token, owlDB, tokenMap, subscribers, schema)
+
+	col := resolve(t, owlDB, "/v1/db/doc/col/").Collection
+	stream, done := subscribe(t, "http://localhost:3318/v1/db/doc/col/", token, owlDB, tokenMap, schema, &col.Subscribers)
+	if w := doPostRequest(t, "http://localhost:3318/v1/db?mode=undelete&path=/doc/col/post", token, "", owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Fatalf("undelete: got status %d, want 201: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(stream.Body.String(), "event: update\ndata: {\n  \"path\": \"/doc/col/post\"") {
+		t.Errorf("collection subscriber did not get the update event: %q", stream.Body.String())
+	}
+	// deleting the database ends the stream
+	doDeleteRequest(t, "http://localhost:3318/v1/db", token, owlDB, tokenMap, subscribers, schema)
+	waitClosed(t, done, "the collection")
+}
+
+// testing that the subscribers of the document hear about a collection restored below it, but not about its documents
+func TestColUndeleteNotifies(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/post", token, `{"text": "hi"}`, owlDB, tokenMap, subscribers, schema)
+	doDeleteRequest(t, "http://localhost:3318/v1/db/doc/col/", token, owlDB, tokenMap, subscribers, schema)
+
+	doc := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc")
+	stream, done := subscribe(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, schema, doc.Subscribers)
+	if w := doPostRequest(t, "http://localhost:3318/v1/db?mode=undelete&path=/doc/col/", token, "", owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Fatalf("undelete collection: got status %d, want 201: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(stream.Body.String(), "event: update\ndata: {\n  \"path\": \"/doc\"") {
+		t.Errorf("document subscriber did not get the update event: %q", stream.Body.String())
+	}
+	if strings.Contains(stream.Body.String(), "/doc/col/post") {
+		t.Errorf("document subscriber heard about a document of the collection: %q", stream.Body.String())
+	}
+	// deleting the database ends the stream
+	doDeleteRequest(t, "http://localhost:3318/v1/db", token, owlDB, tokenMap, subscribers, schema)
+	waitClosed(t, done, "the document")
+}
+
+// testing that the trash is purged after its retention
+func TestTrashPurge(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	defer func(retention time.Duration) { docAndColl.TrashRetention = retention }(docAndColl.TrashRetention)
+
+	doDeleteRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, subscribers, schema)
+	if purged := owlDB.PurgeTrash(time.Now()); purged != 0 {
+		t.Errorf("purged %d items before the retention is over", purged)
+	}
+	docAndColl.TrashRetention = 0
+	if purged := owlDB.PurgeTrash(time.Now().Add(time.Millisecond)); purged != 1 {
+		t.Errorf("purged %d items after the retention, want 1", purged)
+	}
+	if w := doPostRequest(t, "http://localhost:3318/v1/db?mode=undelete&path=/doc", token, "", owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("undelete of a purged document: got status %d, want 404", w.Code)
+	}
+}
@@ -3,11 +3,19 @@
 package Testing
 
 import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/handler"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/santhosh-tekuri/jsonschema"
 )
@@ -184,3 +192,441 @@ func TestDocPut201Nested(t *testing.T) {
 
 	CheckResponse(t, w, 201, "put_doc_nested.json")
 }
+
+// sends a request with the given extra headers through the handler
+func doConditionalRequest(t *testing.T, method, url, token, requestBody string, headers map[string]string, owlDB *database_host.Database_host, tokenMap *sync.Map, schema *jsonschema.Schema) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, url, strings.NewReader(requestBody))
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	handler.HndlRequest(w, req, owlDB, tokenMap, schema)
+	return w
+}
+
+// documents carry an ETag that changes with every write and makes GETs and writes conditional
+func TestDocETag(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	url := "http://localhost:3318/v1/db/doc"
+	do := func(method, body string, headers map[string]string) *httptest.ResponseRecorder {
+		return doConditionalRequest(t, method, url, token, body, headers, owlDB, tokenMap, schema)
+	}
+
+	w := doGetRequest(t, url, token, owlDB, tokenMap, subscribers, schema)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("GET did not return an ETag")
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		headers map[string]string
+		want    int
+	}{
+		{"get unchanged", "GET", "", map[string]string{"If-None-Match": etag}, 304},
+		{"get changed", "GET", "", map[string]string{"If-None-Match": `"0"`}, 200},
+		{"get unchanged weak", "GET", "", map[string]string{"If-None-Match": "W/" + etag}, 304},
+		{"put weak", "PUT", `{"a": "b"}`, map[string]string{"If-Match": "W/" + etag}, 412},
+		{"put stale", "PUT", `{"a": "b"}`, map[string]string{"If-Match": `"0"`}, 412},
+		{"create only", "PUT", `{"a": "b"}`, map[string]string{"If-None-Match": "*"}, 412},
+		{"delete stale", "DELETE", "", map[string]string{"If-Match": `"0"`}, 412},
+		{"patch stale", "PATCH", `[]`, map[string]string{"If-Match": `"0"`}, 412},
+		{"put current", "PUT", `{"a": "b"}`, map[string]string{"If-Match": etag}, 200},
+		{"put replaced", "PUT", `{"a": "c"}`, map[string]string{"If-Match": etag}, 412},
+	}
+	for _, tt := range tests {
+		if w := do(tt.method, tt.body, tt.headers); w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body.String())
+		}
+	}
+
+	w = do("PATCH", `[{"op": "ObjectAdd", "path": "/c", "value": "d"}]`, map[string]string{"If-Match": "*"})
+	patched := w.Header().Get("ETag")
+	if w.Code != 200 || patched == "" || patched == etag {
+		t.Errorf("patch: got status %d and ETag %q after %q", w.Code, patched, etag)
+	}
+	if w := do("DELETE", "", map[string]string{"If-Match": patched}); w.Code != 204 {
+		t.Errorf("delete current: got status %d, want 204", w.Code)
+	}
+	if w := do("PUT", `{"a": "b"}`, map[string]string{"If-None-Match": "*"}); w.Code != 201 || w.Header().Get("ETag") == "" {
+		t.Errorf("create only: got status %d and ETag %q, want 201", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+// a timestamp precondition that doesn't match fails with 412
+func TestDocPut412Timestamp(t *testing.T) {
+	token, owlDB, tokenMap, _, schema := setupForGet(t)
+	w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/db/doc?timestamp=1", token, `{"a": "b"}`, nil, owlDB, tokenMap, schema)
+	if w.Code != 412 {
+		t.Errorf("got status %d, want 412", w.Code)
+	}
+}
+
+// a timestamp precondition that is not a number fails with 400, in a database and in a collection
+func TestDocPut400Timestamp(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/inner", token, `{"a": "b"}`, owlDB, tokenMap, subscribers, schema)
+	for _, url := range []string{"http://localhost:3318/v1/db/doc", "http://localhost:3318/v1/db/doc/col/inner"} {
+		w := doConditionalRequest(t, "PUT", url+"?timestamp=soon", token, `{"a": "c"}`, nil, owlDB, tokenMap, schema)
+		if w.Code != 400 {
+			t.Errorf("%s: got status %d, want 400", url, w.Code)
+		}
+	}
+}
+
+// replaced and patched versions of a document are kept up to the history limit and can be read and restored
+func TestDocHistory(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	defer func(limit int) { docAndColl.HistoryLimit = limit }(docAndColl.HistoryLimit)
+	docAndColl.HistoryLimit = 2
+
+	url := "http://localhost:3318/v1/db/doc"
+	doPutDocRequest(t, url, token, `{"o": {"n": "2"}}`, owlDB, tokenMap, subscribers, schema)
+	doPatchRequest(t, url, token, `[{"op": "ObjectAdd", "path": "/o/m", "value": "3"}]`, owlDB, tokenMap, subscribers, schema)
+	doPutDocRequest(t, url, token, `{"n": "4"}`, owlDB, tokenMap, subscribers, schema)
+
+	w := doGetRequest(t, url+"?mode=history", token, owlDB, tokenMap, subscribers, schema)
+	var history []struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatalf("unable to decode history %q: %v", w.Body.String(), err)
+	}
+	versions := make([]int, len(history))
+	for i, rev := range history {
+		versions[i] = rev.Version
+	}
+	if want := []int{4, 3, 2}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("history versions: got %v, want %v", versions, want)
+	}
+
+	w = doGetRequest(t, url+"?version=3", token, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"m": "3"`) {
+		t.Errorf("version 3: got %d %s", w.Code, w.Body.String())
+	}
+	if w := doGetRequest(t, url+"?version=1", token, owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("version dropped from history: got status %d, want 404", w.Code)
+	}
+
+	w = doPostRequest(t, url+"?mode=restore&version=2", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 200 {
+		t.Fatalf("restore: got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	w = doGetRequest(t, url+"?version=5", token, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"n": "2"`) || strings.Contains(w.Body.String(), `"m"`) {
+		t.Errorf("restored version 5: got %d %s", w.Code, w.Body.String())
+	}
+	if w := doPostRequest(t, url+"?mode=restore&version=1", token, "", owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("restore of a dropped version: got status %d, want 404", w.Code)
+	}
+}
+
+// testing that replacing a document keeps its collections, subscribers and creation metadata
+func TestDocReplaceKeepsChildren(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	for _, url := range []string{"http://localhost:3318/v1/db/doc", "http://localhost:3318/v1/db/doc/col/post"} {
+		doPutDocRequest(t, url, token, `{"a": {"b": "1"}}`, owlDB, tokenMap, subscribers, schema)
+		doPutRequest(t, url+"/replies/", owlDB, tokenMap, subscribers, schema, token)
+
+		before := getDocument(t, owlDB, url)
+		time.Sleep(2 * time.Millisecond)
+		if w := doPutDocRequest(t, url, token, `{"a": {"b": "2"}}`, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+			t.Fatalf("replace %s: got status %d, want 200", url, w.Code)
+		}
+		if w := doPatchRequest(t, url, token, `[{"op": "ObjectAdd", "path": "/a/c", "value": "3"}]`, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+			t.Fatalf("patch %s: got status %d, want 200", url, w.Code)
+		}
+		after := getDocument(t, owlDB, url)
+
+		if w := doGetRequest(t, url+"/replies/", token, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+			t.Errorf("collection of replaced document %s: got status %d, want 200", url, w.Code)
+		}
+		if after.Subscribers != before.Subscribers {
+			t.Errorf("replacing %s dropped its subscribers", url)
+		}
+		if after.Metadata.CreatedAt != before.Metadata.CreatedAt || after.Metadata.CreatedBy != before.Metadata.CreatedBy {
+			t.Errorf("replacing %s changed its creation metadata: %+v, was %+v", url, after.Metadata, before.Metadata)
+		}
+		if after.Metadata.LastModifiedAt == before.Metadata.LastModifiedAt {
+			t.Errorf("replacing %s did not update lastModifiedAt", url)
+		}
+	}
+}
+
+// resolves the path of url against the latest state
+func resolve(t *testing.T, owlDB *database_host.Database_host, url string) *handler.Parsed {
+	t.Helper()
+	path, err := parser.Parse(strings.TrimPrefix(url, "http://localhost:3318"))
+	if err != nil {
+		t.Fatalf("parse %s: %v", url, err)
+	}
+	return handler.Resolve(path, owlDB, nil)
+}
+
+// finds the current version of the document at url
+func getDocument(t *testing.T, owlDB *database_host.Database_host, url string) *docAndColl.Document {
+	t.Helper()
+	parse := resolve(t, owlDB, url)
+	if !parse.Exist || parse.ObjType != "document" {
+		t.Fatalf("document %s not found", url)
+	}
+	return parse.Document
+}
+
+// testing that a document with a time to live is not served once it expires and is then reaped
+func TestDocTTL(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	url := "http://localhost:3318/v1/db/doc/col/typing"
+
+	if w := doPutDocRequest(t, url+"?ttl=50ms", token, `{"user": "owl"}`, owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Fatalf("put with ttl: got status %d, want 201", w.Code)
+	}
+	doc := getDocument(t, owlDB, url)
+	subscriber := httptest.NewRecorder()
+	doc.Subscribers.Store(subscriber, true)
+
+	w := doGetRequest(t, url, token, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"expiresAt"`) {
+		t.Errorf("document before it expires: got %d %s", w.Code, w.Body.String())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	// expired documents are hidden before the reaper runs
+	if w := doGetRequest(t, url, token, owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("expired document: got status %d, want 404", w.Code)
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc/col/", token, owlDB, tokenMap, subscribers, schema); strings.Contains(w.Body.String(), "typing") {
+		t.Errorf("expired document is listed: %s", w.Body.String())
+	}
+
+	if reaped := owlDB.ReapExpired(time.Now()); reaped != 1 {
+		t.Errorf("reaped %d documents, want 1", reaped)
+	}
+	if !strings.Contains(subscriber.Body.String(), "event: delete") {
+		t.Errorf("subscriber did not get the delete event: %s", subscriber.Body.String())
+	}
+}
+
+// testing the reserved time to live field of a document body
+func TestDocTTLField(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	url := "http://localhost:3318/v1/db/invite"
+
+	if w := doPutDocRequest(t, url, token, `{"to": "owl", "_ttl": 3600}`, owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Fatalf("put with ttl field: got status %d, want 201", w.Code)
+	}
+	doc := getDocument(t, owlDB, url)
+	if strings.Contains(string(doc.Data), "_ttl") {
+		t.Errorf("ttl field was stored with the document: %s", doc.Data)
+	}
+	if lifetime := time.Until(time.UnixMilli(doc.Metadata.ExpiresAt)); lifetime < 59*time.Minute || lifetime > time.Hour {
+		t.Errorf("document expires in %v, want an hour", lifetime)
+	}
+	if reaped := owlDB.ReapExpired(time.Now()); reaped != 0 {
+		t.Errorf("reaped %d documents that have not expired", reaped)
+	}
+	// a replacement without a ttl keeps the expiry
+	doPutDocRequest(t, url, token, `{"to": "owl2"}`, owlDB, tokenMap, subscribers, schema)
+	if replaced := getDocument(t, owlDB, url); replaced.Metadata.ExpiresAt != doc.Metadata.ExpiresAt {
+		t.Errorf("replacement changed the expiry to %d, want %d", replaced.Metadata.ExpiresAt, doc.Metadata.ExpiresAt)
+	}
+	if w := doPutDocRequest(t, url+"?ttl=soon", token, `{"to": "owl"}`, owlDB, tokenMap, subscribers, schema); w.Code != 400 {
+		t.Errorf("invalid ttl: got status %d, want 400", w.Code)
+	}
+}
+
+// testing that a collection with a retention policy only keeps its most recent documents
+func TestColRetention(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	colURL := "http://localhost:3318/v1/db/doc/col/"
+
+	w := doConditionalRequest(t, "PUT", colURL+"?mode=retention", token, `{"maxDocuments": 2}`, nil, owlDB, tokenMap, schema)
+	if w.Code != 200 {
+		t.Fatalf("set retention policy: got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if w := doGetRequest(t, colURL+"?mode=retention", token, owlDB, tokenMap, subscribers, schema); !strings.Contains(w.Body.String(), `"maxDocuments": 2`) {
+		t.Errorf("retention policy: got %s", w.Body.String())
+	}
+
+	col := resolve(t, owlDB, "/v1/db/doc/col/").Collection
+	subscriber := httptest.NewRecorder()
+	col.Subscribers.Store(subscriber, true)
+
+	for _, name := range []string{"a", "b", "c"} {
+		doPutDocRequest(t, colURL+name, token, `{"n": "`+name+`"}`, owlDB, tokenMap, subscribers, schema)
+		time.Sleep(2 * time.Millisecond)
+	}
+	if w := doGetRequest(t, colURL+"a", token, owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("oldest document: got status %d, want 404", w.Code)
+	}
+	for _, name := range []string{"b", "c"} {
+		if w := doGetRequest(t, colURL+name, token, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+			t.Errorf("document %s: got status %d, want 200", name, w.Code)
+		}
+	}
+	if !strings.Contains(subscriber.Body.String(), "event: delete\ndata: /v1/db/doc/col/a") {
+		t.Errorf("subscriber did not get the delete event of the pruned document: %s", subscriber.Body.String())
+	}
+
+	w = doConditionalRequest(t, "PUT", colURL+"?mode=retention", token, `{"maxAge": "forever"}`, nil, owlDB, tokenMap, schema)
+	if w.Code != 400 {
+		t.Errorf("invalid retention policy: got status %d, want 400", w.Code)
+	}
+}
+
+// testing that the sweeper removes documents older than the retention policy of their database
+func TestDbRetentionSweep(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/db?mode=retention", token, `{"maxAge": "1h"}`, nil, owlDB, tokenMap, schema)
+	if w.Code != 200 {
+		t.Fatalf("set retention policy: got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if pruned := owlDB.SweepRetention(time.Now()); pruned != 0 {
+		t.Errorf("pruned %d documents that are not old enough", pruned)
+	}
+	if pruned := owlDB.SweepRetention(time.Now().Add(2 * time.Hour)); pruned != 1 {
+		t.Errorf("pruned %d documents, want 1", pruned)
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("pruned document: got status %d, want 404", w.Code)
+	}
+}
+
+// testing that moving a document takes its collections along, keeps its metadata and notifies both sides
+func TestDocMove(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/channel", token, `{"name": "c"}`, owlDB, tokenMap, subscribers, schema)
+	doPutRequest(t, "http://localhost:3318/v1/db/channel/posts/", owlDB, tokenMap, subscribers, schema, token)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/thread", token, `{"title": "t"}`, owlDB, tokenMap, subscribers, schema)
+
+	before := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc")
+	source := httptest.NewRecorder()
+	before.Subscribers.Store(source, true)
+	dest := httptest.NewRecorder()
+	resolve(t, owlDB, "/v1/db/channel/posts/").Collection.Subscribers.Store(dest, true)
+
+	w := doPostRequest(t, "http://localhost:3318/v1/db/doc?mode=move&to=/v1/db/channel/posts/moved", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 201 || !strings.Contains(w.Body.String(), `"/v1/db/channel/posts/moved"`) {
+		t.Fatalf("move: got %d %s", w.Code, w.Body.String())
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("moved document: got status %d at its old path, want 404", w.Code)
+	}
+	moved := getDocument(t, owlDB, "http://localhost:3318/v1/db/channel/posts/moved")
+	if moved.Metadata.CreatedAt != before.Metadata.CreatedAt || moved.Metadata.LastModifiedAt != before.Metadata.LastModifiedAt {
+		t.Errorf("move changed the metadata to %+v, was %+v", moved.Metadata, before.Metadata)
+	}
+	thread := getDocument(t, owlDB, "http://localhost:3318/v1/db/channel/posts/moved/col/thread")
+	if got := thread.URIPath(); got != "/v1/db/channel/posts/moved/col/thread" {
+		t.Errorf("uri of the nested document: got %s", got)
+	}
+	if !strings.Contains(source.Body.String(), "event: delete") {
+		t.Errorf("source subscriber did not get the delete event: %s", source.Body.String())
+	}
+	if !strings.Contains(dest.Body.String(), "event: update") {
+		t.Errorf("destination subscriber did not get the update event: %s", dest.Body.String())
+	}
+}
+
+// testing that copying a collection leaves the original in place, and that destinations are not overwritten
+func TestColCopy(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/post", token, `{"text": "hi"}`, owlDB, tokenMap, subscribers, schema)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/other", token, `{"n": "1"}`, owlDB, tokenMap, subscribers, schema)
+
+	w := doPostRequest(t, "http://localhost:3318/v1/db/doc/col/?mode=copy&to=/v1/db/other/archive/", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 201 {
+		t.Fatalf("copy: got %d %s", w.Code, w.Body.String())
+	}
+	for _, url := range []string{"http://localhost:3318/v1/db/doc/col/post", "http://localhost:3318/v1/db/other/archive/post"} {
+		if w := doGetRequest(t, url, token, owlDB, tokenMap, subscribers, schema); w.Code != 200 || !strings.Contains(w.Body.String(), `"hi"`) {
+			t.Errorf("%s after copy: got %d %s", url, w.Code, w.Body.String())
+		}
+	}
+
+	w = doPostRequest(t, "http://localhost:3318/v1/db/doc/col/?mode=move&to=/v1/db/other/archive/", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 409 {
+		t.Errorf("move onto an existing collection: got status %d, want 409", w.Code)
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc/col/post", token, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+		t.Errorf("source of a failed move: got status %d, want 200", w.Code)
+	}
+	w = doPostRequest(t, "http://localhost:3318/v1/db/doc?mode=move&to=/v1/db/doc/col/doc", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 400 {
+		t.Errorf("move into itself: got status %d, want 400", w.Code)
+	}
+}
+
+// testing that moving a collection notifies the document it lands under, and that the copy has metadata of its own
+func TestColMoveNotifiesDestination(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/post", token, `{"text": "hi"}`, owlDB, tokenMap, subscribers, schema)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/other", token, `{"n": "1"}`, owlDB, tokenMap, subscribers, schema)
+
+	dest := httptest.NewRecorder()
+	getDocument(t, owlDB, "http://localhost:3318/v1/db/other").Subscribers.Store(dest, true)
+	w := doPostRequest(t, "http://localhost:3318/v1/db/doc/col/?mode=copy&to=/v1/db/other/archive/", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 201 {
+		t.Fatalf("copy: got %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(dest.Body.String(), "event: update\ndata: {\n  \"path\": \"/other\"") {
+		t.Errorf("destination subscriber did not get the update event: %q", dest.Body.String())
+	}
+	if strings.Contains(dest.Body.String(), "/other/archive/post") {
+		t.Errorf("destination subscriber heard about a document of the collection: %q", dest.Body.String())
+	}
+
+	original := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc/col/post")
+	copied := getDocument(t, owlDB, "http://localhost:3318/v1/db/other/archive/post")
+	if original.Metadata == copied.Metadata {
+		t.Errorf("the copy shares the metadata of the original")
+	}
+	if original := resolve(t, owlDB, "/v1/db/doc/col/").Collection; original.Metadata == resolve(t, owlDB, "/v1/db/other/archive/").Collection.Metadata {
+		t.Errorf("the copied collection shares the metadata of the original")
+	}
+}
+
+// testing that the destination is decoded once, so an escaped character in a name survives
+func TestDocMoveEscapedDestination(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	w := doPostRequest(t, "http://localhost:3318/v1/db/doc?mode=copy&to=/v1/db/a%252Fb", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 201 || !strings.Contains(w.Body.String(), `"/v1/db/a%2Fb"`) {
+		t.Fatalf("copy: got %d %s", w.Code, w.Body.String())
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/a%252Fb", token, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+		t.Errorf("copied document: got status %d, want 200", w.Code)
+	}
+}
+
+// testing that a document that does not conform to the schema at the destination is not moved
+func TestDocMoveValidatesDestination(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/other", token, `{"n": "1"}`, owlDB, tokenMap, subscribers, schema)
+	doPutRequest(t, "http://localhost:3318/v1/db/other/strict/", owlDB, tokenMap, subscribers, schema, token)
+	if w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/db/other/strict/?mode=schema", token, `{"type": "object", "required": ["title"]}`, nil, owlDB, tokenMap, schema); w.Code != 200 {
+		t.Fatalf("schema: got %d %s", w.Code, w.Body.String())
+	}
+
+	w := doPostRequest(t, "http://localhost:3318/v1/db/doc?mode=move&to=/v1/db/other/strict/doc", token, "", owlDB, tokenMap, subscribers, schema)
+	if w.Code != 400 {
+		t.Errorf("move of a nonconforming document: got status %d, want 400: %s", w.Code, w.Body.String())
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+		t.Errorf("source of a refused move: got status %d, want 200", w.Code)
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/other/strict/doc", token, owlDB, tokenMap, subscribers, schema); w.Code != 404 {
+		t.Errorf("destination of a refused move: got status %d, want 404", w.Code)
+	}
+
+	doPutDocRequest(t, "http://localhost:3318/v1/db/titled", token, `{"title": "t"}`, owlDB, tokenMap, subscribers, schema)
+	if w := doPostRequest(t, "http://localhost:3318/v1/db/titled?mode=move&to=/v1/db/other/strict/titled", token, "", owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Errorf("move of a conforming document: got status %d, want 201: %s", w.Code, w.Body.String())
+	}
+}
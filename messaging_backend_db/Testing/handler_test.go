@@ -3,16 +3,25 @@
 package Testing
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/cors"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/handler"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/santhosh-tekuri/jsonschema"
 )
@@ -368,3 +377,720 @@ func TestDbPost201(t *testing.T) {
 
 	CheckResponseGet(t, w, 201, "patch_doc_200.json")
 }
+
+// decodes the per-operation statuses of a batch response
+func batchStatuses(t *testing.T, w *httptest.ResponseRecorder) []int {
+	t.Helper()
+	var results []struct {
+		Status int `json:"status"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("unable to decode batch response %q: %v", w.Body.String(), err)
+	}
+	statuses := make([]int, len(results))
+	for i, result := range results {
+		statuses[i] = result.Status
+	}
+	return statuses
+}
+
+// a batch applies its operations in order and reports the status of each one
+func TestDbPostBatch(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	batch := `[
+		{"op": "PUT", "path": "/a", "body": {"n": "1"}},
+		{"op": "PUT", "path": "/b", "body": {"n": "2"}},
+		{"op": "PUT", "path": "/a", "body": {"n": "3"}},
+		{"op": "DELETE", "path": "/b"},
+		{"op": "PUT", "path": "/a/col/"},
+		{"op": "DELETE", "path": "/missing"},
+		{"op": "GET", "path": "/a"},
+		{"op": "PUT", "path": "a"}
+	]`
+	w := doPostRequest(t, "http://localhost:3318/v1/db?mode=batch", token, batch, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 200 {
+		t.Fatalf("batch: got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	want := []int{201, 201, 200, 204, 201, 404, 400, 400}
+	if got := batchStatuses(t, w); !reflect.DeepEqual(got, want) {
+		t.Errorf("batch statuses: got %v, want %v", got, want)
+	}
+
+	w = doGetRequest(t, "http://localhost:3318/v1/db/a", token, owlDB, tokenMap, subscribers, schema)
+	var doc struct {
+		Doc map[string]string `json:"doc"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &doc)
+	if doc.Doc["n"] != "3" {
+		t.Errorf("document after batch: got %s", w.Body.String())
+	}
+	w = doGetRequest(t, "http://localhost:3318/v1/db/b", token, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 404 {
+		t.Errorf("deleted document: got status %d, want 404", w.Code)
+	}
+}
+
+// conditional headers of a batch or transaction are not applied to each of its operations
+func TestDbPostBatchHeaders(t *testing.T) {
+	token, owlDB, tokenMap, _, schema := setupForGet(t)
+	ifMatch := map[string]string{"If-Match": `"12"`, "If-None-Match": "*"}
+
+	batch := `[{"op": "PUT", "path": "/doc", "body": {"n": "1"}}, {"op": "PUT", "path": "/new", "body": {"n": "2"}}]`
+	for _, mode := range []string{"batch", "transaction"} {
+		w := doConditionalRequest(t, "POST", "http://localhost:3318/v1/db?mode="+mode, token, batch, ifMatch, owlDB, tokenMap, schema)
+		if w.Code != 200 {
+			t.Fatalf("%s with conditional headers: got status %d, want 200: %s", mode, w.Code, w.Body.String())
+		}
+		if got := batchStatuses(t, w); got[0] >= 400 || got[1] >= 400 {
+			t.Errorf("%s statuses with conditional headers: got %v", mode, got)
+		}
+	}
+}
+
+// a batch that is not an array or is not posted to a database is rejected
+func TestDbPostBatch400(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	w := doPostRequest(t, "http://localhost:3318/v1/db?mode=batch", token, `{"op": "PUT"}`, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 400 {
+		t.Errorf("batch with an object body: got status %d, want 400", w.Code)
+	}
+	w = doPostRequest(t, "http://localhost:3318/v1/nodb?mode=batch", token, `[]`, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 404 {
+		t.Errorf("batch into a missing database: got status %d, want 404", w.Code)
+	}
+}
+
+// subscribers of a document written several times in one batch are notified once, with its final state
+func TestDbPostBatchNotifiesOnce(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	db, _ := owlDB.GetDatabase("db")
+	doc, _ := db.GetDocumentFromDatabase("doc")
+	subscriber := httptest.NewRecorder()
+	doc.Subscribers.Store(subscriber, true)
+
+	batch := `[
+		{"op": "PUT", "path": "/doc", "body": {"n": "first"}},
+		{"op": "PUT", "path": "/doc", "body": {"n": "second"}},
+		{"op": "PUT", "path": "/doc", "body": {"n": "last"}}
+	]`
+	doPostRequest(t, "http://localhost:3318/v1/db?mode=batch", token, batch, owlDB, tokenMap, subscribers, schema)
+
+	events := subscriber.Body.String()
+	if n := strings.Count(events, "event: update"); n != 1 {
+		t.Errorf("subscriber got %d update events, want 1: %s", n, events)
+	}
+	if !strings.Contains(events, `"last"`) || strings.Contains(events, `"first"`) {
+		t.Errorf("subscriber did not get the final state: %s", events)
+	}
+}
+
+// a transaction applies all of its operations and reports the status of each one
+func TestDbPostTransaction(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	w := doGetRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, subscribers, schema)
+	var current struct {
+		Meta struct {
+			LastModifiedAt int64 `json:"lastModifiedAt"`
+		} `json:"meta"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &current)
+
+	tx := fmt.Sprintf(`[
+		{"op": "PUT", "path": "/doc", "body": {"replies": "1"}, "precondition": {"timestamp": %d}},
+		{"op": "PUT", "path": "/thread", "body": {"n": "1"}, "precondition": {"exists": false}}
+	]`, current.Meta.LastModifiedAt)
+	w = doPostRequest(t, "http://localhost:3318/v1/db?mode=transaction", token, tx, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 200 {
+		t.Fatalf("transaction: got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if got, want := batchStatuses(t, w), []int{200, 201}; !reflect.DeepEqual(got, want) {
+		t.Errorf("transaction statuses: got %v, want %v", got, want)
+	}
+}
+
+// a transaction whose precondition fails or whose operation fails changes nothing
+func TestDbPostTransactionAborts(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	post := func(tx string) *httptest.ResponseRecorder {
+		return doPostRequest(t, "http://localhost:3318/v1/db?mode=transaction", token, tx, owlDB, tokenMap, subscribers, schema)
+	}
+	exists := func(path string) bool {
+		return doGetRequest(t, "http://localhost:3318/v1/db"+path, token, owlDB, tokenMap, subscribers, schema).Code == 200
+	}
+
+	w := post(`[
+		{"op": "PUT", "path": "/new", "body": {"a": "b"}},
+		{"op": "DELETE", "path": "/doc", "precondition": {"timestamp": 1}}
+	]`)
+	if w.Code != 412 || exists("/new") {
+		t.Errorf("failed precondition: got status %d, /new exists %t", w.Code, exists("/new"))
+	}
+
+	w = post(`[
+		{"op": "PUT", "path": "/new", "body": {"a": "b"}},
+		{"op": "DELETE", "path": "/doc"},
+		{"op": "PUT", "path": "/doc/col/"},
+		{"op": "DELETE", "path": "/missing"}
+	]`)
+	if w.Code != 409 {
+		t.Errorf("failed operation: got status %d, want 409: %s", w.Code, w.Body.String())
+	}
+	if exists("/new") || !exists("/doc") || !exists("/doc/col/") {
+		t.Errorf("failed transaction was not rolled back: /new %t, /doc %t, /doc/col/ %t", exists("/new"), exists("/doc"), exists("/doc/col/"))
+	}
+
+	// a schema or retention update could not be rolled back, so it is not an operation
+	w = post(`[
+		{"op": "PUT", "path": "/doc/col/?mode=schema", "body": {"type": "object", "required": ["n"]}},
+		{"op": "DELETE", "path": "/missing"}
+	]`)
+	if w.Code != 400 {
+		t.Errorf("operation with a mode: got status %d, want 400: %s", w.Code, w.Body.String())
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc/col/?mode=schema", token, owlDB, tokenMap, subscribers, schema); strings.Contains(w.Body.String(), "required") {
+		t.Errorf("schema of a rejected transaction was applied: %s", w.Body.String())
+	}
+}
+
+// a transaction inserting into a collection with a retention policy prunes nothing if it is rolled back,
+// and prunes the oldest documents once it commits
+func TestDbPostTransactionRetention(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	colURL := "http://localhost:3318/v1/db/doc/col/"
+	if w := doConditionalRequest(t, "PUT", colURL+"?mode=retention", token, `{"maxDocuments": 2}`, nil, owlDB, tokenMap, schema); w.Code != 200 {
+		t.Fatalf("set retention policy: got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	for _, name := range []string{"a", "b"} {
+		doPutDocRequest(t, colURL+name, token, `{"n": "`+name+`"}`, owlDB, tokenMap, subscribers, schema)
+		time.Sleep(2 * time.Millisecond)
+	}
+	exists := func(name string) bool {
+		return doGetRequest(t, colURL+name, token, owlDB, tokenMap, subscribers, schema).Code == 200
+	}
+
+	w := doPostRequest(t, "http://localhost:3318/v1/db?mode=transaction", token, `[
+		{"op": "PUT", "path": "/doc/col/c", "body": {"n": "c"}},
+		{"op": "DELETE", "path": "/missing"}
+	]`, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 409 {
+		t.Fatalf("failed transaction: got status %d, want 409: %s", w.Code, w.Body.String())
+	}
+	if !exists("a") || !exists("b") || exists("c") {
+		t.Errorf("after the rollback: a %t, b %t, c %t, want a and b", exists("a"), exists("b"), exists("c"))
+	}
+
+	w = doPostRequest(t, "http://localhost:3318/v1/db?mode=transaction", token, `[
+		{"op": "PUT", "path": "/doc/col/c", "body": {"n": "c"}}
+	]`, owlDB, tokenMap, subscribers, schema)
+	if w.Code != 200 {
+		t.Fatalf("transaction: got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if exists("a") || !exists("b") || !exists("c") {
+		t.Errorf("after the commit: a %t, b %t, c %t, want b and c", exists("a"), exists("b"), exists("c"))
+	}
+}
+
+// reads of a database and its reaper wait for a transaction on it, so they never see writes it may roll back
+func TestDbPostTransactionIsolation(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	db, _ := owlDB.GetDatabase("db")
+
+	// a transaction in progress
+	db.TxMu.Lock()
+	read := make(chan int)
+	go func() {
+		read <- doGetRequest(t, "http://localhost:3318/v1/db/", token, owlDB, tokenMap, subscribers, schema).Code
+	}()
+	reaped := make(chan int)
+	go func() { reaped <- owlDB.ReapExpired(time.Now()) }()
+	select {
+	case <-read:
+		t.Errorf("a listing did not wait for the transaction")
+	case <-reaped:
+		t.Errorf("the reaper did not wait for the transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+	db.TxMu.Unlock()
+	if code := <-read; code != 200 {
+		t.Errorf("listing after the transaction: got status %d, want 200", code)
+	}
+	<-reaped
+
+	// other databases are not held off
+	doPutRequest(t, "http://localhost:3318/v1/other", owlDB, tokenMap, subscribers, schema, token)
+	db.TxMu.Lock()
+	defer db.TxMu.Unlock()
+	if w := doGetRequest(t, "http://localhost:3318/v1/other/", token, owlDB, tokenMap, subscribers, schema); w.Code != 200 {
+		t.Errorf("listing of another database: got status %d, want 200", w.Code)
+	}
+}
+
+// concurrent transactions moving a document back and forth never lose or duplicate it,
+// even while other writers use the same database
+func TestDbPostTransactionConcurrent(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/a", token, `{"a": "b"}`, owlDB, tokenMap, subscribers, schema)
+
+	move := func(from, to string) string {
+		return fmt.Sprintf(`[
+			{"op": "DELETE", "path": "/%s", "precondition": {"exists": true}},
+			{"op": "PUT", "path": "/%s", "body": {"a": "b"}, "precondition": {"exists": false}}
+		]`, from, to)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				from, to := "a", "b"
+				if (i+g)%2 == 0 {
+					from, to = to, from
+				}
+				w := doPostRequest(t, "http://localhost:3318/v1/db?mode=transaction", token, move(from, to), owlDB, tokenMap, subscribers, schema)
+				if w.Code != 200 && w.Code != 412 {
+					t.Errorf("move %s to %s: got status %d: %s", from, to, w.Code, w.Body.String())
+				}
+				doPutDocRequest(t, fmt.Sprintf("http://localhost:3318/v1/db/other%d", g), token, `{"a": "b"}`, owlDB, tokenMap, subscribers, schema)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	db, _ := owlDB.GetDatabase("db")
+	_, a := db.GetDocumentFromDatabase("a")
+	_, b := db.GetDocumentFromDatabase("b")
+	if a == b {
+		t.Errorf("after concurrent moves: a exists %t, b exists %t; want exactly one", a, b)
+	}
+}
+
+// opens a subscription through the handler and returns its response and a channel closed when its stream ends
+func subscribe(t *testing.T, url, token string, owlDB *database_host.Database_host, tokenMap *sync.Map, schema *jsonschema.Schema, subscribers *sync.Map) (*httptest.ResponseRecorder, chan struct{}) {
+	t.Helper()
+	req := httptest.NewRequest("GET", url+"?mode=subscribe", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.HndlRequest(w, req, owlDB, tokenMap, schema)
+	}()
+	// wait until the subscriber is registered
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		registered := false
+		subscribers.Range(func(any, any) bool { registered = true; return false })
+		if registered {
+			return w, done
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscription to %s was not registered", url)
+		}
+	}
+}
+
+// waits for the stream of a subscription to end
+func waitClosed(t *testing.T, done chan struct{}, url string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("stream of the subscription to %s was not closed", url)
+	}
+}
+
+// testing that shutting down the server sends subscribers a shutdown event and ends their streams, so the
+// shutdown does not wait for them, while a write in flight is finished
+func TestShutdownDrainsSubscribers(t *testing.T) {
+	token, owlDB, tokenMap, _, schema := setupForGet(t)
+	drain := docAndColl.NewDrain()
+	release := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			// a write still in flight when the shutdown begins
+			<-release
+		}
+		handler.HndlRequest(w, r, owlDB, tokenMap, schema)
+	}))
+	server.Config.BaseContext = func(net.Listener) context.Context {
+		return docAndColl.WithDrain(context.Background(), drain)
+	}
+	server.Config.RegisterOnShutdown(drain.Shutdown)
+	server.Start()
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/db/doc?mode=subscribe", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	put, _ := http.NewRequest(http.MethodPut, server.URL+"/v1/db/late", strings.NewReader(`{"a": 1}`))
+	put.Header.Set("Authorization", "Bearer "+token)
+	written := make(chan int)
+	go func() {
+		resp, err := http.DefaultClient.Do(put)
+		if err != nil {
+			written <- 0
+			return
+		}
+		resp.Body.Close()
+		written <- resp.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	shutdown := make(chan error)
+	go func() { shutdown <- server.Config.Shutdown(ctx) }()
+
+	body, err := io.ReadAll(stream.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "event: shutdown\n") {
+		t.Errorf("subscriber did not get the shutdown event: %q", body)
+	}
+
+	close(release)
+	if status := <-written; status != http.StatusCreated {
+		t.Errorf("write in flight got status %d, want 201", status)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("shutdown did not drain: %v", err)
+	}
+
+	// a subscription that arrives during the shutdown ends at once
+	late := httptest.NewRequest(http.MethodGet, "/v1/db/doc?mode=subscribe", nil)
+	late = late.WithContext(docAndColl.WithDrain(late.Context(), drain))
+	late.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.HndlRequest(w, late, owlDB, tokenMap, schema)
+	if !strings.Contains(w.Body.String(), "event: shutdown\n") {
+		t.Errorf("late subscriber did not get the shutdown event: %q", w.Body.String())
+	}
+}
+
+// testing that deleting a database notifies the subscribers deep inside it and closes their streams
+func TestDbDeleteCascades(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/post", token, `{"text": "hi"}`, owlDB, tokenMap, subscribers, schema)
+
+	post := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc/col/post")
+	col := resolve(t, owlDB, "/v1/db/doc/col/").Collection
+
+	postStream, postDone := subscribe(t, "http://localhost:3318/v1/db/doc/col/post", token, owlDB, tokenMap, schema, post.Subscribers)
+	colStream, colDone := subscribe(t, "http://localhost:3318/v1/db/doc/col/", token, owlDB, tokenMap, schema, &col.Subscribers)
+
+	if w := doDeleteRequest(t, "http://localhost:3318/v1/db", token, owlDB, tokenMap, subscribers, schema); w.Code != 204 {
+		t.Fatalf("delete database: got status %d, want 204", w.Code)
+	}
+	waitClosed(t, postDone, "the post")
+	waitClosed(t, colDone, "the collection")
+	if !strings.Contains(postStream.Body.String(), "event: delete\ndata: /v1/db/doc/col/post\n") {
+		t.Errorf("post subscriber did not get the delete event: %q", postStream.Body.String())
+	}
+	if !strings.Contains(colStream.Body.String(), "event: delete\ndata: /v1/db/doc/col/\n") {
+		t.Errorf("collection subscriber did not get the delete event: %q", colStream.Body.String())
+	}
+
+	// the closed subscriptions are released
+	for name, subs := range map[string]*sync.Map{"post": post.Subscribers, "collection": &col.Subscribers} {
+		subs.Range(func(key, _ any) bool {
+			t.Errorf("subscriber of the %s is still registered", name)
+			return false
+		})
+	}
+}
+
+// testing that deleting a collection closes the streams of the documents in it
+func TestColDeleteCascades(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/post", token, `{"text": "hi"}`, owlDB, tokenMap, subscribers, schema)
+	post := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc/col/post")
+
+	stream, done := subscribe(t, "http://localhost:3318/v1/db/doc/col/post", token, owlDB, tokenMap, schema, post.Subscribers)
+	doDeleteRequest(t, "http://localhost:4318/v1/db/doc/col/", token, owlDB, tokenMap, subscribers, schema)
+	waitClosed(t, done, "the post")
+	if !strings.Contains(stream.Body.String(), "event: delete") {
+		t.Errorf("post subscriber did not get the delete event: %q", stream.Body.String())
+	}
+}
+
+// every error is a JSON envelope with the code of its status, a message and the path of the request
+func TestErrorStatuses(t *testing.T) {
+	token, owlDB, tokenMap, _, schema := setupForGet(t)
+	host := "http://localhost:3318"
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		headers map[string]string
+		token   string
+		status  int
+	}{
+		{"extra slash", "GET", "/v1/db//", "", nil, token, 400},
+		{"document with end slash", "GET", "/v1/db/doc/", "", nil, token, 400},
+		{"invalid json document", "PUT", "/v1/db/bad", `{"a": `, nil, token, 400},
+		{"invalid patches", "PATCH", "/v1/db/doc", `{"op": "ObjectAdd"}`, nil, token, 400},
+		{"patch missing fields", "PATCH", "/v1/db/doc", `[{"op": "ObjectAdd"}]`, nil, token, 400},
+		{"patch of a collection", "PATCH", "/v1/db/doc/col/", `[]`, nil, token, 400},
+		{"batch not an array", "POST", "/v1/db?mode=batch", `{}`, nil, token, 400},
+		{"unknown mode", "GET", "/v1/db/doc?mode=bogus", "", nil, token, 400},
+		{"mode of another method", "DELETE", "/v1/db/doc?mode=history", "", nil, token, 400},
+		{"invalid ttl", "PUT", "/v1/db/doc?ttl=soon", `{}`, nil, token, 400},
+		{"missing token", "GET", "/v1/db/", "", nil, "", 401},
+		{"invalid token", "PUT", "/v1/db/doc", `{}`, nil, "nope", 401},
+		{"missing database", "GET", "/v1/nodb/", "", nil, token, 404},
+		{"missing document", "GET", "/v1/db/missing", "", nil, token, 404},
+		{"delete missing document", "DELETE", "/v1/db/missing", "", nil, token, 404},
+		{"delete missing database", "DELETE", "/v1/nodb", "", nil, token, 404},
+		{"missing version", "GET", "/v1/db/doc?version=99", "", nil, token, 404},
+		{"existing database", "PUT", "/v1/db", "", nil, token, 409},
+		{"existing collection", "PUT", "/v1/db/doc/col/", "", nil, token, 409},
+		{"if-match", "PUT", "/v1/db/doc", `{}`, map[string]string{"If-Match": `"999"`}, token, 412},
+		{"if-none-match", "PUT", "/v1/db/doc", `{}`, map[string]string{"If-None-Match": "*"}, token, 412},
+		{"conditional delete", "DELETE", "/v1/db/doc", "", map[string]string{"If-Match": `"999"`}, token, 412},
+		{"text body", "PUT", "/v1/db/doc", `{}`, map[string]string{"Content-Type": "text/plain"}, token, 415},
+		{"form post", "POST", "/v1/db/", `a=b`, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, token, 415},
+		{"unknown method", "TRACE", "/v1/db/", "", nil, token, 405},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := doConditionalRequest(t, test.method, host+test.path, test.token, test.body, test.headers, owlDB, tokenMap, schema)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+			var body docAndColl.ErrorFormat
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body is not an error envelope: %s", w.Body.String())
+			}
+			wantPath, _, _ := strings.Cut(test.path, "?")
+			if body.Code != docAndColl.ErrorCode(test.status) || body.Message == "" || body.Path != wantPath {
+				t.Errorf("got %+v, want code %s and path %s", body, docAndColl.ErrorCode(test.status), wantPath)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("got Content-Type %q", ct)
+			}
+		})
+	}
+}
+
+// testing that every body the handler reads is refused with 413 when it is larger than the server accepts
+func TestBodyTooLarge(t *testing.T) {
+	token, owlDB, tokenMap, _, schema := setupForGet(t)
+	large := `{"text": "` + strings.Repeat("a", 100) + `"}`
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/auth"},
+		{"PUT", "/v1/db/doc"},
+		{"PUT", "/v1/other"},
+		{"POST", "/v1/db/"},
+		{"PATCH", "/v1/db/doc"},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost:3318"+test.path, strings.NewReader(large))
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			req.Body = http.MaxBytesReader(w, req.Body, 64)
+			handler.HndlRequest(w, req, owlDB, tokenMap, schema)
+			var body docAndColl.ErrorFormat
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != 413 || body.Code != "too_large" {
+				t.Errorf("got %d %s, want 413", w.Code, w.Body.String())
+			}
+		})
+	}
+	if w := doGetRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, nil, schema); strings.Contains(w.Body.String(), "aaaa") {
+		t.Errorf("a refused body was written: %s", w.Body.String())
+	}
+}
+
+// every route of the handler is described in the OpenAPI document it serves, and nothing else is
+func TestOpenAPIRoutes(t *testing.T) {
+	_, owlDB, tokenMap, _, schema := setupForGet(t)
+
+	// the description is served without a token
+	w := doGetRequest(t, "http://localhost:3318/v1/openapi.json", "", owlDB, tokenMap, nil, schema)
+	if w.Code != 200 {
+		t.Fatalf("GET /v1/openapi.json: got %d %s", w.Code, w.Body.String())
+	}
+	var spec struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Parameters map[string]struct {
+				Name string `json:"name"`
+			} `json:"parameters"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("openapi.json is not JSON: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi version %q", spec.OpenAPI)
+	}
+
+	// the modes each operation describes
+	type operation struct {
+		Parameters []struct {
+			Name   string `json:"name"`
+			Schema struct {
+				Enum []string `json:"enum"`
+			} `json:"schema"`
+		} `json:"parameters"`
+	}
+	described := map[handler.Route]bool{}
+	for path, methods := range spec.Paths {
+		for method, raw := range methods {
+			if method == "parameters" {
+				continue
+			}
+			var op operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+			route := handler.Route{Method: strings.ToUpper(method), Path: path}
+			described[route] = true
+			for _, param := range op.Parameters {
+				if param.Name != "mode" {
+					continue
+				}
+				for _, mode := range param.Schema.Enum {
+					route.Mode = mode
+					described[route] = true
+				}
+			}
+		}
+	}
+
+	routes := map[handler.Route]bool{}
+	for _, route := range handler.Routes {
+		routes[route] = true
+		plain := handler.Route{Method: route.Method, Path: route.Path}
+		if !described[route] || !described[plain] {
+			t.Errorf("route %s %s mode=%q is not described in openapi.json", route.Method, route.Path, route.Mode)
+		}
+	}
+	for route := range described {
+		if route.Mode != "" && !routes[route] {
+			t.Errorf("openapi.json describes %s %s mode=%q, which is not a route", route.Method, route.Path, route.Mode)
+		}
+	}
+
+	// the query parameters the handlers read
+	names := map[string]bool{}
+	for _, param := range spec.Components.Parameters {
+		names[param.Name] = true
+	}
+	for _, name := range []string{"interval", "timestamp", "ttl", "asOf", "version", "to", "dryRun", "onInvalid", "path"} {
+		if !names[name] {
+			t.Errorf("query parameter %s is not described in openapi.json", name)
+		}
+	}
+}
+
+// responses carry the CORS headers of the configured policy, on errors, preflights and event streams too
+func TestCORS(t *testing.T) {
+	token, owlDB, tokenMap, _, schema := setupForGet(t)
+	url := "http://localhost:3318/v1/db/doc"
+	origin := map[string]string{"Origin": "https://app.example"}
+
+	// the default policy allows every origin
+	w := doConditionalRequest(t, "GET", url, token, "", origin, owlDB, tokenMap, schema)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("default policy: got Access-Control-Allow-Origin %q", got)
+	}
+	if exposed := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "ETag") || !strings.Contains(exposed, "X-Request-ID") {
+		t.Errorf("default policy: got Access-Control-Expose-Headers %q", exposed)
+	}
+	preflight := map[string]string{"Origin": "https://app.example", "Access-Control-Request-Method": "PATCH"}
+	w = doConditionalRequest(t, "OPTIONS", url, "", "", preflight, owlDB, tokenMap, schema)
+	if methods := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, "PATCH") {
+		t.Errorf("preflight: got Access-Control-Allow-Methods %q", methods)
+	}
+	if headers := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(headers, "Authorization") {
+		t.Errorf("preflight: got Access-Control-Allow-Headers %q", headers)
+	}
+	if allow := w.Header().Get("Allow"); !strings.Contains(allow, "PATCH") {
+		t.Errorf("preflight: got Allow %q", allow)
+	}
+
+	defer func(policy *cors.Policy) { handler.CORS = policy }(handler.CORS)
+	handler.CORS = &cors.Policy{
+		Origins:     []string{"https://app.example"},
+		Methods:     []string{"GET", "PUT"},
+		Headers:     []string{"Authorization"},
+		Credentials: true,
+		MaxAge:      10 * time.Minute,
+	}
+
+	// an allowed origin is echoed, since credentials are allowed
+	w = doConditionalRequest(t, "OPTIONS", url, "", "", preflight, owlDB, tokenMap, schema)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("allowed origin: got Access-Control-Allow-Origin %q", got)
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("preflight: got headers %v", w.Header())
+	}
+	if methods := w.Header().Get("Access-Control-Allow-Methods"); methods != "GET, PUT" {
+		t.Errorf("preflight: got Access-Control-Allow-Methods %q", methods)
+	}
+
+	// errors carry the headers too
+	w = doConditionalRequest(t, "GET", url, "nope", "", origin, owlDB, tokenMap, schema)
+	if w.Code != 401 || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example" {
+		t.Errorf("error: got %d with headers %v", w.Code, w.Header())
+	}
+
+	// other origins get none
+	w = doConditionalRequest(t, "GET", url, token, "", map[string]string{"Origin": "https://evil.example"}, owlDB, tokenMap, schema)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("other origin: got Access-Control-Allow-Origin %q", got)
+	}
+	// with credentials, * does not echo every origin back
+	handler.CORS.Origins = []string{"*"}
+	w = doConditionalRequest(t, "GET", url, token, "", map[string]string{"Origin": "https://evil.example"}, owlDB, tokenMap, schema)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("any origin with credentials: got Access-Control-Allow-Origin %q", got)
+	}
+	handler.CORS.Origins = []string{"https://app.example"}
+
+	// and so do event streams
+	req := httptest.NewRequest("GET", url+"?mode=subscribe", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Origin", "https://app.example")
+	stream := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.HndlRequest(stream, req, owlDB, tokenMap, schema)
+	}()
+	doc := getDocument(t, owlDB, url)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		registered := false
+		doc.Subscribers.Range(func(any, any) bool { registered = true; return false })
+		if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscription to %s was not registered", url)
+		}
+	}
+	doConditionalRequest(t, "DELETE", url, token, "", nil, owlDB, tokenMap, schema)
+	waitClosed(t, done, url)
+	if got := stream.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("event stream: got Access-Control-Allow-Origin %q", got)
+	}
+}
@@ -63,7 +63,7 @@ func TestDocPatch200false(t *testing.T) {
 	  ]`
 	w := doPatchRequest(t, docURL, token, requestBody, &owlDB, tokenMap, subscribers, schema)
 
-	CheckResponse(t, w, 404, "put_doc_404.json")
+	CheckResponse(t, w, 404, "patch_doc_404.json")
 }
 
 // tesitng patch where the return is true
@@ -129,9 +129,8 @@ func TestDocPatch404(t *testing.T) {
 			"address": "123"
 		}
 	}`
-	doPutDocRequest(t, docURL, token, requestBody, &owlDB, tokenMap, subscribers, schema)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/document", token, requestBody, &owlDB, tokenMap, subscribers, schema)
 
-	docURL = "http://localhost:3318/v1/db/document"
 	requestBody =
 		`[
 		{
@@ -144,5 +143,5 @@ func TestDocPatch404(t *testing.T) {
 	  ]`
 	w := doPatchRequest(t, docURL, token, requestBody, &owlDB, tokenMap, subscribers, schema)
 
-	CheckResponse(t, w, 404, "put_doc_404.json")
+	CheckResponse(t, w, 404, "patch_doc_404.json")
 }
@@ -0,0 +1,114 @@
+// tests the request IDs and the access log of the server
+package Testing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/handler"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/logging"
+)
+
+// tests that the request ID of the client is echoed back and logged with the access line of the request
+func TestRequestLog(t *testing.T) {
+	token, owlDB, tokenMap, _, schema := setupForGet(t)
+
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(&out, slog.LevelInfo, "json"))
+
+	req := httptest.NewRequest("GET", "http://localhost:3318/v1/db/doc?mode=nosubscribe", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Request-ID", "trace-42")
+	w := httptest.NewRecorder()
+	handler.HndlRequest(w, req, owlDB, tokenMap, schema)
+	if got := w.Header().Get("X-Request-ID"); got != "trace-42" {
+		t.Errorf("X-Request-ID: got %q, want trace-42", got)
+	}
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line is not JSON: %q", scanner.Text())
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("got %d log lines, want the access line only: %q", len(lines), out.String())
+	}
+	want := map[string]any{
+		"level":      "INFO",
+		"msg":        "request",
+		"request_id": "trace-42",
+		"method":     "GET",
+		"path":       "/v1/db/doc?mode=nosubscribe",
+		"status":     float64(w.Code),
+		"user":       "a_user",
+	}
+	for key, value := range want {
+		if lines[0][key] != value {
+			t.Errorf("%s: got %v, want %v", key, lines[0][key], value)
+		}
+	}
+	if _, ok := lines[0]["duration"]; !ok {
+		t.Error("the access line has no duration")
+	}
+	if strings.Contains(out.String(), token) {
+		t.Error("the token was logged")
+	}
+}
+
+// tests that a request ID unfit to be echoed back is replaced by a new one
+func TestRequestLogInvalidID(t *testing.T) {
+	_, owlDB, tokenMap, _, schema := setupForGet(t)
+	for _, id := range []string{"", "two words", strings.Repeat("x", 129)} {
+		req := httptest.NewRequest("GET", "http://localhost:3318/v1/db", nil)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		handler.HndlRequest(w, req, owlDB, tokenMap, schema)
+		got := w.Header().Get("X-Request-ID")
+		if got == id || !logging.ValidID(got) {
+			t.Errorf("X-Request-ID %q: got %q, want a new ID", id, got)
+		}
+	}
+}
+
+// tests that the events a write sends its subscribers are logged with the request ID of the write
+func TestRequestLogNotify(t *testing.T) {
+	token, owlDB, tokenMap, _, schema := setupForGet(t)
+	getDocument(t, owlDB, "http://localhost:3318/v1/db/doc").Subscribers.Store(httptest.NewRecorder(), true)
+
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(&out, slog.LevelDebug, "json"))
+
+	headers := map[string]string{"X-Request-ID": "trace-43"}
+	if w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/db/doc", token, `{"a": "b"}`, headers, owlDB, tokenMap, schema); w.Code != 200 {
+		t.Fatalf("put: got %d %s", w.Code, w.Body.String())
+	}
+
+	notified := false
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil || line["msg"] != "updating subscribers" {
+			continue
+		}
+		notified = true
+		if line["request_id"] != "trace-43" {
+			t.Errorf("request_id of the event: got %v, want trace-43", line["request_id"])
+		}
+	}
+	if !notified {
+		t.Errorf("the event was not logged: %q", out.String())
+	}
+}
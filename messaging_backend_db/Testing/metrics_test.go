@@ -0,0 +1,99 @@
+// tests the metrics served at /metrics
+package Testing
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/handler"
+)
+
+// scrapes /metrics without a token and returns the value of every series, keyed by its name and labels
+func scrape(t *testing.T, owlDB *database_host.Database_host) map[string]float64 {
+	t.Helper()
+	w := doGetRequest(t, "http://localhost:3318/metrics", "", owlDB, nil, nil, nil)
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("GET /metrics: got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	series := map[string]float64{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		cut := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[cut+1:], 64)
+		if cut < 0 || err != nil {
+			t.Fatalf("malformed metrics line %q", line)
+		}
+		series[line[:cut]] = value
+	}
+	return series
+}
+
+// tests that requests, authentication, subscribers, event fan-out and the size of the server are measured
+func TestMetrics(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	created := `owldb_http_requests_total{method="PUT",route="/v1/{db}/{document}",status="201"}`
+	replaced := `owldb_http_requests_total{method="PUT",route="/v1/{db}/{document}",status="200"}`
+	createdCount := `owldb_http_request_duration_seconds_count{method="PUT",route="/v1/{db}/{document}",status="201"}`
+	refused := `owldb_auth_total{result="failure"}`
+	before := scrape(t, owlDB)
+
+	doc := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc")
+	stream, done := subscribe(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, schema, doc.Subscribers)
+	during := scrape(t, owlDB)
+	if got := during[`owldb_subscribers{route="/v1/{db}/{document}"}`]; got != 1 {
+		t.Errorf("subscribers of documents: got %v, want 1", got)
+	}
+
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc", token, `{"a": 1}`, owlDB, tokenMap, subscribers, schema)
+	doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/inner", token, `{"b": 2}`, owlDB, tokenMap, subscribers, schema)
+	doGetRequest(t, "http://localhost:3318/v1/db/doc", "not-a-token", owlDB, tokenMap, subscribers, schema)
+	if !strings.Contains(stream.Body.String(), "event: update") {
+		t.Fatalf("subscriber did not get the update: %q", stream.Body.String())
+	}
+	doDeleteRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, subscribers, schema)
+	waitClosed(t, done, "the document")
+
+	after := scrape(t, owlDB)
+	checks := []struct {
+		name      string
+		got, want float64
+	}{
+		{"documents created", after[created] - before[created], 1},
+		{"documents replaced", after[replaced] - before[replaced], 1},
+		{"durations of documents created", after[createdCount] - before[createdCount], 1},
+		{"refused tokens", after[refused] - before[refused], 1},
+		{"update events", after[`owldb_events_total{event="update"}`] - before[`owldb_events_total{event="update"}`], 1},
+		{"delete deliveries", after[`owldb_event_deliveries_total{event="delete"}`] - before[`owldb_event_deliveries_total{event="delete"}`], 1},
+		{"databases", after["owldb_databases"], 1},
+		{"documents", after["owldb_documents"], 0},
+		{"collections", after["owldb_collections"], 0},
+	}
+	for _, check := range checks {
+		if check.got != check.want {
+			t.Errorf("%s: got %v, want %v", check.name, check.got, check.want)
+		}
+	}
+	if _, open := after[`owldb_subscribers{route="/v1/{db}/{document}"}`]; open {
+		t.Error("the ended stream is still counted")
+	}
+	if during["owldb_documents"] != 1 || during["owldb_collections"] != 1 {
+		t.Errorf("got %v documents and %v collections, want 1 and 1", during["owldb_documents"], during["owldb_collections"])
+	}
+}
+
+// tests that the metrics are not served on the main address when they have an address of their own
+func TestMetricsElsewhere(t *testing.T) {
+	_, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	handler.ServeMetrics = false
+	defer func() { handler.ServeMetrics = true }()
+	if w := doGetRequest(t, "http://localhost:3318/metrics", "", owlDB, tokenMap, subscribers, schema); w.Code != 401 {
+		t.Errorf("GET /metrics: got %d, want 401", w.Code)
+	}
+}
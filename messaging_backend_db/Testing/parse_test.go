@@ -9,6 +9,7 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
 	"sync"
@@ -17,6 +18,7 @@ import (
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/handler"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/santhosh-tekuri/jsonschema"
 )
@@ -54,6 +56,12 @@ func CheckResponse(t *testing.T, resp *httptest.ResponseRecorder, expectedStatus
 
 	// Case 1: Both are JSON objects
 	if errExpected == nil && errResult == nil {
+		// an error fixture is shared by requests to different paths, it only pins the code and message
+		if _, isError := expectedMap["code"]; isError {
+			if _, hasPath := expectedMap["path"]; !hasPath {
+				delete(resultMap, "path")
+			}
+		}
 		if !reflect.DeepEqual(resultMap, expectedMap) {
 			t.Errorf("Case 1: Response body does not match the expected output:\nExpected: %v\nGot: %v", expectedMap, resultMap)
 		}
@@ -299,7 +307,7 @@ func TestDocPut404(t *testing.T) {
 }
 
 // testing replacin a collection
-func TestColPut400DupCol(t *testing.T) {
+func TestColPut409DupCol(t *testing.T) {
 	owlDB := database_host.Database_host{Name: "db_host", DBSkipList: skiplist.NewList[string, *database.Database]("", "zzz")}
 	tokenMap := new(sync.Map)
 	subscribers := new(sync.Map)
@@ -319,7 +327,7 @@ func TestColPut400DupCol(t *testing.T) {
 	doPutRequest(t, colURL, &owlDB, tokenMap, subscribers, schema, token)
 	w := doPutRequest(t, colURL, &owlDB, tokenMap, subscribers, schema, token)
 
-	CheckResponse(t, w, 400, "put_col_400.json")
+	CheckResponse(t, w, 409, "put_col_dup.json")
 
 }
 
@@ -360,3 +368,82 @@ func TestColGet400woslash(t *testing.T) {
 	CheckResponseGet(t, w, 400, "get_doc_400.json")
 
 }
+
+// parsing resource paths into the kind of resource they name
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want parser.Path
+	}{
+		{"/v1/", parser.ServerPath{}},
+		{"/v1/db", parser.DatabasePath{DB: "db"}},
+		{"/v1/db/", parser.DatabasePath{DB: "db", Listing: true}},
+		{"/v1/db/doc", parser.DocumentPath{DB: "db", Names: []string{"doc"}}},
+		{"/v1/db/doc/col/", parser.CollectionPath{DB: "db", Names: []string{"doc", "col"}}},
+		{"/v1/db/doc/col/doc2", parser.DocumentPath{DB: "db", Names: []string{"doc", "col", "doc2"}}},
+		{"/v1/db/doc%2Fcol/", parser.CollectionPath{DB: "db", Names: []string{"doc", "col"}}},
+		{"/v1/db/a%20b%25", parser.DocumentPath{DB: "db", Names: []string{"a b%"}}},
+		{"/v1/db/doc/", nil},
+		{"/v1/db/doc/col", nil},
+		{"/v1/db//", nil},
+		{"/v1//doc", nil},
+		{"/v1/db/doc%", nil},
+		{"/v1/db/doc%4", nil},
+		{"/v1/db/doc%zz", nil},
+		{"/v2/db", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		got, err := parser.Parse(test.path)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("Parse(%q) = %#v, want an error", test.path, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q) = %#v, %v, want %#v", test.path, got, err, test.want)
+		}
+	}
+}
+
+// a name with escapes is decoded once, %2541 names 100%41 and not 100A
+func TestPathEscapes(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	w := doPutDocRequest(t, "http://localhost:3318/v1/db/100%2541", token, `{"a": 1}`, owlDB, tokenMap, subscribers, schema)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("put: got %d %s", w.Code, w.Body.String())
+	}
+	if doc := getDocument(t, owlDB, "/v1/db/100%2541"); doc.Name != "100%41" {
+		t.Errorf("name: got %q, want %q", doc.Name, "100%41")
+	}
+
+}
+
+// any path either fails to parse or parses back to itself from its escaped form, and decodes to its string form
+func FuzzParsePath(f *testing.F) {
+	for _, seed := range []string{"/v1/", "/v1/db", "/v1/db/", "/v1/db/doc", "/v1/db/doc/col/", "/v1/db/doc%2Fcol/d",
+		"/v1/db/a%20b", "/v1/db/%", "/v1/db/%4", "/v1/db//", "/v1/db/doc/", "/auth", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, escaped string) {
+		path, err := parser.Parse(escaped)
+		if err != nil {
+			return
+		}
+		again, err := parser.Parse(path.Escaped())
+		if err != nil {
+			t.Fatalf("Parse(%q) = %#v, its escaped form %q does not parse: %v", escaped, path, path.Escaped(), err)
+		}
+		if !reflect.DeepEqual(again, path) {
+			t.Fatalf("Parse(%q) = %#v, its escaped form %q parses to %#v", escaped, path, path.Escaped(), again)
+		}
+		if decoded, _ := url.PathUnescape(escaped); decoded != path.String() {
+			t.Fatalf("Parse(%q).String() = %q, want %q", escaped, path.String(), decoded)
+		}
+		if path.Parent().Kind() == path.Kind() && path.Kind() != "server" {
+			t.Fatalf("Parse(%q) = %#v is its own parent", escaped, path)
+		}
+	})
+}
@@ -1,6 +1,8 @@
 package Testing
 
 import (
+	"errors"
+	"reflect"
 	"sync"
 	"testing"
 
@@ -127,6 +129,138 @@ func TestDocDelete404doc(t *testing.T) {
 	doDeleteRequest(t, getURL, token, owlDB, tokenMap, subscribers, schema)
 	w := doDeleteRequest(t, getURL, token, owlDB, tokenMap, subscribers, schema)
 
-	CheckResponseGet(t, w, 400, "get_db_404.json")
+	CheckResponseGet(t, w, 404, "get_db_404.json")
+
+}
+
+// builds a skiplist holding the given keys, each mapped to its own length
+func newTestList(t *testing.T, keys ...string) *skiplist.List[string, int] {
+	t.Helper()
+	list := skiplist.NewList[string, int]("", "zzz")
+	for _, key := range keys {
+		c := func(key string, curr int, exists bool) (int, error) {
+			return len(key), nil
+		}
+		if _, err := list.Upsert(key, c); err != nil {
+			t.Fatalf("Upsert(%q) failed: %v", key, err)
+		}
+	}
+	return &list
+}
+
+// collects the keys yielded by an iterator
+func collectKeys(seq func(yield func(string, int) bool)) []string {
+	keys := make([]string, 0)
+	for key := range seq {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// iterators walk the list in key order in both directions, honoring seek keys and limits
+func TestSkipListIterators(t *testing.T) {
+	list := newTestList(t, "d", "a", "c", "e", "b")
+
+	tests := []struct {
+		name string
+		seq  func(yield func(string, int) bool)
+		want []string
+	}{
+		{"all", list.All(), []string{"a", "b", "c", "d", "e"}},
+		{"backward", list.Backward(), []string{"e", "d", "c", "b", "a"}},
+		{"ascend from missing key", list.Ascend("bb", 0), []string{"c", "d", "e"}},
+		{"ascend with limit", list.Ascend("b", 2), []string{"b", "c"}},
+		{"descend from key", list.Descend("c", 0), []string{"c", "b", "a"}},
+		{"descend from missing key with limit", list.Descend("cc", 1), []string{"c"}},
+		{"range", list.Range("b", "d", 0), []string{"b", "c", "d"}},
+		{"empty range", list.Range("f", "g", 0), []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := collectKeys(tt.seq); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// a cursor can change direction and skips keys removed while it is positioned elsewhere
+func TestSkipListCursor(t *testing.T) {
+	list := newTestList(t, "a", "b", "c", "d")
+
+	c := list.Cursor()
+	if !c.Seek("b") || c.Key() != "b" || c.Value() != 1 {
+		t.Fatalf("Seek(b) positioned on the wrong key")
+	}
+
+	list.Remove("c")
+	if !c.Next() || c.Key() != "d" {
+		t.Errorf("Next did not skip the removed key")
+	}
+	if !c.Prev() || c.Key() != "b" {
+		t.Errorf("Prev did not skip the removed key")
+	}
+	if !c.Prev() || c.Key() != "a" {
+		t.Errorf("Prev did not reach the first key")
+	}
+	if c.Prev() {
+		t.Errorf("Prev moved past the first key")
+	}
+}
+
+// a snapshot keeps seeing the values, insertions and removals as they were when it was taken
+func TestSkipListSnapshot(t *testing.T) {
+	list := newTestList(t, "a", "b", "c")
+	snap := skiplist.NewSnapshot()
+	defer snap.Release()
+
+	list.Upsert("b", func(string, int, bool) (int, error) { return 42, nil })
+	list.Upsert("d", func(string, int, bool) (int, error) { return 1, nil })
+	list.Remove("a")
+
+	view := list.At(snap)
+	if got, want := collectKeys(view.All()), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot keys: got %v, want %v", got, want)
+	}
+	if val, ok := view.Find("b"); !ok || val != 1 {
+		t.Errorf("snapshot Find(b) = %d, %t; want 1, true", val, ok)
+	}
+	if got, want := collectKeys(list.All()), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("latest keys: got %v, want %v", got, want)
+	}
+
+	// the removed key can be written again without disturbing the snapshot
+	list.Upsert("a", func(string, int, bool) (int, error) { return 7, nil })
+	if val, ok := view.Find("a"); !ok || val != 1 {
+		t.Errorf("snapshot Find(a) = %d, %t; want 1, true", val, ok)
+	}
+	if val, ok := list.Find("a"); !ok || val != 7 {
+		t.Errorf("latest Find(a) = %d, %t; want 7, true", val, ok)
+	}
+}
+
+// a sequence can only be read while a snapshot holds it; afterwards it is garbage collected
+func TestSkipListSnapshotAt(t *testing.T) {
+	list := newTestList(t, "a")
+	held := skiplist.NewSnapshot()
+	seq := held.Seq()
+
+	list.Upsert("a", func(string, int, bool) (int, error) { return 5, nil })
 
+	snap, err := skiplist.SnapshotAt(seq)
+	if err != nil {
+		t.Fatalf("SnapshotAt(%d) failed while held: %v", seq, err)
+	}
+	if val, _ := list.At(snap).Find("a"); val != 1 {
+		t.Errorf("Find(a) as of %d = %d, want 1", seq, val)
+	}
+	snap.Release()
+	held.Release()
+
+	list.Upsert("a", func(string, int, bool) (int, error) { return 6, nil })
+	if _, err := skiplist.SnapshotAt(seq); !errors.Is(err, skiplist.ErrSnapshotTooOld) {
+		t.Errorf("SnapshotAt(%d) after release: got %v, want ErrSnapshotTooOld", seq, err)
+	}
+	if _, err := skiplist.SnapshotAt(skiplist.CurrentSequence() + 1); err == nil {
+		t.Errorf("SnapshotAt of a future sequence succeeded")
+	}
 }
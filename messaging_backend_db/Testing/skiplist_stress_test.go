@@ -0,0 +1,312 @@
+// this is a concurrent stress suite for the skiplist. Goroutines hammer a shared list with upserts,
+// removes, finds and iterations, every operation is recorded with its invocation and response time,
+// and the recorded history of each key is then checked for linearizability. Run it with -race.
+// The duration defaults to one second and can be raised with OWLDB_STRESS_DURATION (e.g. "2m").
+package Testing
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
+)
+
+const (
+	opUpsert = iota
+	opRemove
+	opFind
+)
+
+// stressOp is one completed operation on a single key of the list
+type stressOp struct {
+	kind  int
+	arg   int   // value written by an upsert
+	val   int   // value returned by a remove or a find
+	ok    bool  // updated for an upsert, removed for a remove, found for a find
+	call  int64 // logical time of the invocation
+	ret   int64 // logical time of the response
+	actor int
+}
+
+// keyState is the state of a single key in the sequential model of the list
+type keyState struct {
+	present bool
+	val     int
+}
+
+// step applies op to the sequential model and reports whether its recorded result is possible
+func (st keyState) step(op stressOp) (keyState, bool) {
+	switch op.kind {
+	case opUpsert:
+		return keyState{present: true, val: op.arg}, op.ok == st.present
+	case opRemove:
+		if st.present {
+			return keyState{}, op.ok && op.val == st.val
+		}
+		return st, !op.ok
+	default:
+		if st.present {
+			return st, op.ok && op.val == st.val
+		}
+		return st, !op.ok
+	}
+}
+
+// linearizable reports whether the history of a single key can be explained by some sequential
+// order of its operations that respects real time. This is the Wing & Gong search with memoization
+// of (linearized set, model state); histories are kept below 64 operations per key.
+func linearizable(ops []stressOp) bool {
+	sort.Slice(ops, func(i, j int) bool { return ops[i].call < ops[j].call })
+	all := uint64(1)<<len(ops) - 1
+	failed := make(map[[2]uint64]bool)
+
+	var search func(done uint64, st keyState) bool
+	search = func(done uint64, st keyState) bool {
+		if done == all {
+			return true
+		}
+		state := uint64(st.val) << 1
+		if st.present {
+			state |= 1
+		}
+		memo := [2]uint64{done, state}
+		if failed[memo] {
+			return false
+		}
+		// the earliest response among pending operations bounds which ones may go next
+		minRet := int64(1 << 62)
+		for i, op := range ops {
+			if done&(1<<i) == 0 && op.ret < minRet {
+				minRet = op.ret
+			}
+		}
+		for i, op := range ops {
+			if done&(1<<i) != 0 || op.call > minRet {
+				continue
+			}
+			if next, ok := st.step(op); ok && search(done|1<<i, next) {
+				return true
+			}
+		}
+		failed[memo] = true
+		return false
+	}
+	return search(0, keyState{})
+}
+
+// stressDuration returns how long the stress test should run
+func stressDuration(t *testing.T) time.Duration {
+	t.Helper()
+	if env := os.Getenv("OWLDB_STRESS_DURATION"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			t.Fatalf("invalid OWLDB_STRESS_DURATION %q: %v", env, err)
+		}
+		return d
+	}
+	if testing.Short() {
+		return 200 * time.Millisecond
+	}
+	return time.Second
+}
+
+// concurrent upserts, removes and finds on shared keys must be linearizable, and iterators running
+// at the same time must always see keys in strictly increasing order
+func TestSkipListStressLinearizable(t *testing.T) {
+	const (
+		workers   = 8
+		keys      = 6
+		opsPerKey = 40 // per round, spread evenly over the workers
+	)
+
+	list := skiplist.NewList[string, int]("", "zzz")
+	var clock, values atomic.Int64
+	deadline := time.Now().Add(stressDuration(t))
+
+	// iterate constantly while the writers run
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func(backward bool) {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				seq, prev, first := list.All(), "", true
+				if backward {
+					seq = list.Backward()
+				}
+				for key := range seq {
+					if !first && ((!backward && key <= prev) || (backward && key >= prev)) {
+						t.Errorf("iterator out of order: %q after %q", key, prev)
+						return
+					}
+					prev, first = key, false
+				}
+			}
+		}(r == 1)
+	}
+
+	rounds := 0
+	for ; time.Now().Before(deadline); rounds++ {
+		histories := make([][]stressOp, keys)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < keys*opsPerKey/workers; i++ {
+					k := (i + w) % keys
+					key := fmt.Sprintf("r%06d-k%d", rounds, k)
+					op := stressOp{kind: (i*7 + w) % 3, actor: w}
+					if i%5 == 0 {
+						// keep the list from emptying out too often
+						op.kind = opUpsert
+					}
+
+					op.call = clock.Add(1)
+					switch op.kind {
+					case opUpsert:
+						op.arg = int(values.Add(1))
+						op.ok, _ = list.Upsert(key, func(string, int, bool) (int, error) { return op.arg, nil })
+					case opRemove:
+						op.val, op.ok = list.Remove(key)
+					case opFind:
+						op.val, op.ok = list.Find(key)
+					}
+					op.ret = clock.Add(1)
+
+					mu.Lock()
+					histories[k] = append(histories[k], op)
+					mu.Unlock()
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for k, history := range histories {
+			if !linearizable(history) {
+				t.Fatalf("round %d key %d: history is not linearizable: %+v", rounds, k, history)
+			}
+		}
+	}
+
+	close(stop)
+	readers.Wait()
+
+	// whatever is left must be sorted and findable
+	prev := ""
+	for key, val := range list.All() {
+		if key <= prev {
+			t.Errorf("list out of order: %q after %q", key, prev)
+		}
+		if found, ok := list.Find(key); !ok || found != val {
+			t.Errorf("Find(%q) = %d, %t; iteration saw %d", key, found, ok, val)
+		}
+		prev = key
+	}
+	t.Logf("ran %d rounds", rounds)
+}
+
+// many writers racing to create and replace the same keys must leave exactly one node per key
+func TestSkipListStressUpsertRace(t *testing.T) {
+	const workers = 16
+	list := skiplist.NewList[string, int]("", "zzz")
+	deadline := time.Now().Add(stressDuration(t))
+
+	for round := 0; time.Now().Before(deadline); round++ {
+		var created atomic.Int32
+		var wg sync.WaitGroup
+		key := fmt.Sprintf("race%06d", round)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				updated, err := list.Upsert(key, func(string, int, bool) (int, error) { return w, nil })
+				if err != nil {
+					t.Errorf("Upsert(%q) failed: %v", key, err)
+				}
+				if !updated {
+					created.Add(1)
+				}
+			}(w)
+		}
+		wg.Wait()
+		if created.Load() != 1 {
+			t.Fatalf("round %d: %d upserts created %q, want exactly 1", round, created.Load(), key)
+		}
+		if round%2 == 0 {
+			if _, removed := list.Remove(key); !removed {
+				t.Fatalf("round %d: Remove(%q) failed", round, key)
+			}
+		}
+	}
+}
+
+// a snapshot taken while writers run must read the same contents every time it is iterated,
+// and what it reads must stay stable until it is released
+func TestSkipListStressSnapshots(t *testing.T) {
+	const writers = 4
+	list := skiplist.NewList[string, int]("", "zzz")
+	deadline := time.Now().Add(stressDuration(t))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("k%02d", (i*writers+w)%32)
+				if i%3 == 0 {
+					list.Remove(key)
+				} else {
+					list.Upsert(key, func(string, int, bool) (int, error) { return i, nil })
+				}
+			}
+		}(w)
+	}
+
+	snaps := 0
+	for ; time.Now().Before(deadline); snaps++ {
+		snap := skiplist.NewSnapshot()
+		view := list.At(snap)
+		first := make(map[string]int)
+		for k, v := range view.All() {
+			first[k] = v
+		}
+		for pass := 0; pass < 3; pass++ {
+			seen := 0
+			for k, v := range view.All() {
+				if want, ok := first[k]; !ok || want != v {
+					t.Fatalf("snapshot %d: pass %d read %s=%d, first pass read %d (present %t)", snap.Seq(), pass, k, v, want, ok)
+				}
+				seen++
+			}
+			if seen != len(first) {
+				t.Fatalf("snapshot %d: pass %d read %d keys, first pass read %d", snap.Seq(), pass, seen, len(first))
+			}
+		}
+		snap.Release()
+	}
+
+	close(stop)
+	wg.Wait()
+	t.Logf("checked %d snapshots", snaps)
+}
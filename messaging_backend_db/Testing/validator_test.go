@@ -4,14 +4,17 @@ package Testing
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/handler"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/santhosh-tekuri/jsonschema"
@@ -161,3 +164,182 @@ func TestDbPost401(t *testing.T) {
 
 	CheckResponse(t, w, 401, "missingToken.json")
 }
+
+// testing that documents are validated against the schema of their nearest database or collection
+func TestNestedSchemas(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	userSchema := `{"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}, "o": {"properties": {"n": {"type": "string"}}}}}`
+	w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/users", token, userSchema, nil, owlDB, tokenMap, schema)
+	if w.Code != 201 {
+		t.Fatalf("create database with schema: got status %d, want 201: %s", w.Code, w.Body.String())
+	}
+	if w := doPutDocRequest(t, "http://localhost:3318/v1/users/owl", token, `{"text": "hi"}`, owlDB, tokenMap, subscribers, schema); w.Code != 400 {
+		t.Errorf("document against the database schema: got status %d, want 400", w.Code)
+	}
+	if w := doPutDocRequest(t, "http://localhost:3318/v1/users/owl", token, `{"name": "owl", "o": {}}`, owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Fatalf("valid document: got status %d, want 201", w.Code)
+	}
+
+	postSchema := `{"type": "object", "required": ["text"]}`
+	w = doConditionalRequest(t, "PUT", "http://localhost:3318/v1/users/owl/posts/", token, postSchema, nil, owlDB, tokenMap, schema)
+	if w.Code != 201 {
+		t.Fatalf("create collection with schema: got status %d, want 201: %s", w.Code, w.Body.String())
+	}
+	// the collection schema wins over the database schema
+	if w := doPostRequest(t, "http://localhost:3318/v1/users/owl/posts/", token, `{"text": "hi"}`, owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Errorf("post against the collection schema: got status %d, want 201", w.Code)
+	}
+	if w := doPatchRequest(t, "http://localhost:3318/v1/users/owl", token, `[{"op": "ObjectAdd", "path": "/o/n", "value": 3}]`, owlDB, tokenMap, subscribers, schema); strings.Contains(w.Body.String(), `"patchFailed": false`) {
+		t.Errorf("patch against the database schema was applied: %s", w.Body.String())
+	}
+
+	w = doGetRequest(t, "http://localhost:3318/v1/users/owl/posts/?mode=schema", token, owlDB, tokenMap, subscribers, schema)
+	var effective docAndColl.SchemaFormat
+	if err := json.Unmarshal(w.Body.Bytes(), &effective); err != nil || effective.Path != "/v1/users/owl/posts/" {
+		t.Errorf("effective schema of the posts: got %s", w.Body.String())
+	}
+	w = doGetRequest(t, "http://localhost:3318/v1/users/owl?mode=schema", token, owlDB, tokenMap, subscribers, schema)
+	if err := json.Unmarshal(w.Body.Bytes(), &effective); err != nil || effective.Path != "/v1/users/" {
+		t.Errorf("effective schema of a user: got %s", w.Body.String())
+	}
+	w = doGetRequest(t, "http://localhost:3318/v1/db/doc?mode=schema", token, owlDB, tokenMap, subscribers, schema)
+	if err := json.Unmarshal(w.Body.Bytes(), &effective); err != nil || effective.Path != "global" || !strings.Contains(string(effective.Schema), "generic-json-schema") {
+		t.Errorf("effective schema without an attached one: got %s", w.Body.String())
+	}
+}
+
+// testing the schema endpoint of an existing database
+func TestSchemaEndpoint(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+
+	w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/db?mode=schema&onInvalid=flag", token, `{"type": "object", "required": ["n"]}`, nil, owlDB, tokenMap, schema)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"/v1/db/"`) {
+		t.Fatalf("set schema: got %d %s", w.Code, w.Body.String())
+	}
+	if w := doPutDocRequest(t, "http://localhost:3318/v1/db/other", token, `{"m": "1"}`, owlDB, tokenMap, subscribers, schema); w.Code != 400 {
+		t.Errorf("document against the new schema: got status %d, want 400", w.Code)
+	}
+	if w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/db?mode=schema", token, `{"type": 7}`, nil, owlDB, tokenMap, schema); w.Code != 400 {
+		t.Errorf("invalid schema: got status %d, want 400", w.Code)
+	}
+	doConditionalRequest(t, "PUT", "http://localhost:3318/v1/db?mode=schema", token, `null`, nil, owlDB, tokenMap, schema)
+	if w := doPutDocRequest(t, "http://localhost:3318/v1/db/other", token, `{"m": "1"}`, owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Errorf("document after the schema is removed: got status %d, want 201", w.Code)
+	}
+}
+
+// testing that a schema update is checked against the stored documents, refused or applied with the invalid ones flagged
+func TestSchemaEvolution(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	dbSchema := "http://localhost:3318/v1/db?mode=schema"
+
+	if w := doConditionalRequest(t, "PUT", dbSchema, token, `{"type": "object"}`, nil, owlDB, tokenMap, schema); w.Code != 200 {
+		t.Fatalf("set schema: got %d %s", w.Code, w.Body.String())
+	}
+	if version := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc").Meta().SchemaVersion; version != 1 {
+		t.Errorf("schema version of a conforming document: got %d, want 1", version)
+	}
+	if w := doPutDocRequest(t, "http://localhost:3318/v1/db/doc/col/a", token, `{"n": "1"}`, owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Fatalf("put nested document: got status %d, want 201", w.Code)
+	}
+
+	tighter := `{"type": "object", "required": ["n"]}`
+	var report docAndColl.SchemaReport
+	w := doConditionalRequest(t, "PUT", dbSchema+"&dryRun=true", token, tighter, nil, owlDB, tokenMap, schema)
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != 200 || report.Applied {
+		t.Fatalf("dry run: got %d %s", w.Code, w.Body.String())
+	}
+	if report.Checked != 2 || len(report.Violations) != 1 || report.Violations[0].Path != "/v1/db/doc" || report.Version != 2 {
+		t.Errorf("dry run report: got %+v", report)
+	}
+
+	if w := doConditionalRequest(t, "PUT", dbSchema, token, tighter, nil, owlDB, tokenMap, schema); w.Code != 409 {
+		t.Errorf("refused update: got status %d, want 409", w.Code)
+	}
+	if w := doPutDocRequest(t, "http://localhost:3318/v1/db/other", token, `{"m": "1"}`, owlDB, tokenMap, subscribers, schema); w.Code != 201 {
+		t.Errorf("document after a refused update: got status %d, want 201", w.Code)
+	}
+
+	w = doConditionalRequest(t, "PUT", dbSchema+"&onInvalid=flag", token, tighter, nil, owlDB, tokenMap, schema)
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != 200 || !report.Applied || len(report.Violations) != 2 {
+		t.Fatalf("flagging update: got %d %s", w.Code, w.Body.String())
+	}
+	if meta := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc").Meta(); !meta.SchemaInvalid || meta.SchemaVersion != 1 {
+		t.Errorf("metadata of a flagged document: got %+v", meta)
+	}
+	if meta := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc/col/a").Meta(); meta.SchemaInvalid || meta.SchemaVersion != 2 {
+		t.Errorf("metadata of a conforming document: got %+v", meta)
+	}
+}
+
+// testing that stamping the documents with a new schema is not a write: their ETags stay valid for If-Match
+func TestSchemaEvolutionKeepsETag(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	w := doGetRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, subscribers, schema)
+	etag, sequence := w.Header().Get("ETag"), w.Header().Get("X-Owldb-Sequence")
+
+	if w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/db?mode=schema", token, `{"type": "object"}`, nil, owlDB, tokenMap, schema); w.Code != 200 {
+		t.Fatalf("set schema: got %d %s", w.Code, w.Body.String())
+	}
+	w = doGetRequest(t, "http://localhost:3318/v1/db/doc", token, owlDB, tokenMap, subscribers, schema)
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("ETag after a schema update: got %q, want %q", got, etag)
+	}
+	if got := w.Header().Get("X-Owldb-Sequence"); got != sequence {
+		t.Errorf("X-Owldb-Sequence after a schema update: got %q, want %q", got, sequence)
+	}
+	if !strings.Contains(w.Body.String(), `"schemaVersion": 1`) {
+		t.Errorf("stamped metadata: got %s", w.Body.String())
+	}
+	doc, stream := getDocument(t, owlDB, "http://localhost:3318/v1/db/doc"), httptest.NewRecorder()
+	var streams sync.Map
+	streams.Store(stream, true)
+	docAndColl.Update_subscribers(nil, "/v1/db/doc", &streams, "update", doc)
+	if !strings.Contains(stream.Body.String(), `"schemaVersion": 1`) {
+		t.Errorf("stamped metadata in an update event: got %q", stream.Body.String())
+	}
+	if w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/db/doc", token, `{"a": "b"}`, map[string]string{"If-Match": etag}, owlDB, tokenMap, schema); w.Code != 200 {
+		t.Errorf("If-Match with the ETag from before the schema update: got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+}
+
+// testing that documents that do not conform to their schema are rejected with the list of violations
+func TestValidationErrors(t *testing.T) {
+	token, owlDB, tokenMap, subscribers, schema := setupForGet(t)
+	userSchema := `{"type": "object", "required": ["name"], "properties": {"o": {"properties": {"n": {"type": "string"}}}}}`
+	if w := doConditionalRequest(t, "PUT", "http://localhost:3318/v1/users", token, userSchema, nil, owlDB, tokenMap, schema); w.Code != 201 {
+		t.Fatalf("create database with schema: got status %d, want 201", w.Code)
+	}
+
+	var body docAndColl.ErrorFormat
+	w := doPutDocRequest(t, "http://localhost:3318/v1/users/owl", token, `{"o": {}}`, owlDB, tokenMap, subscribers, schema)
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != 400 || len(body.Violations) != 1 {
+		t.Fatalf("put missing a required field: got %d %s", w.Code, w.Body.String())
+	}
+	if got := body.Violations[0]; got.InstancePath != "" || got.Keyword != "required" || !strings.HasSuffix(got.SchemaLocation, "#/required") {
+		t.Errorf("violation of required: got %+v", got)
+	}
+	w = doPostRequest(t, "http://localhost:3318/v1/users/", token, `{"name": "owl", "o": {"n": 3}}`, owlDB, tokenMap, subscribers, schema)
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != 400 || len(body.Violations) != 1 {
+		t.Fatalf("post with a wrong type: got %d %s", w.Code, w.Body.String())
+	}
+	if got := body.Violations[0]; got.InstancePath != "/o/n" || got.Keyword != "type" {
+		t.Errorf("violation of type: got %+v", got)
+	}
+
+	doPutDocRequest(t, "http://localhost:3318/v1/users/owl", token, `{"name": "owl", "o": {}}`, owlDB, tokenMap, subscribers, schema)
+	w = doPatchRequest(t, "http://localhost:3318/v1/users/owl", token, `[{"op": "ObjectAdd", "path": "/o/n", "value": 3}]`, owlDB, tokenMap, subscribers, schema)
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != 400 || len(body.Violations) != 1 || body.Violations[0].InstancePath != "/o/n" {
+		t.Errorf("invalid patch: got %d %s", w.Code, w.Body.String())
+	}
+
+	w = doPostRequest(t, "http://localhost:3318/v1/users?mode=batch", token, `[{"op": "PUT", "path": "/bad", "body": {}}]`, owlDB, tokenMap, subscribers, schema)
+	var results []struct {
+		Status int                    `json:"status"`
+		Body   docAndColl.ErrorFormat `json:"body"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].Status != 400 || len(results[0].Body.Violations) != 1 {
+		t.Errorf("invalid batch operation: got %s", w.Body.String())
+	}
+}
@@ -10,6 +10,9 @@ import (
 	"os"
 	"sync"
 	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/metrics"
 )
 
 // A Username contains string Username, Username is used for reading in the authentification request body containing the username.
@@ -24,10 +27,13 @@ type Token struct {
 	Expiration time.Time // Expiration: time until the token is valid to
 }
 
+// TokenTTL is how long a token created by New is valid
+var TokenTTL = time.Hour
+
 // New creates a new bearer token and maps it to its username and expiration, returns the bearer token string.
 func New(username string, tokenmap *sync.Map) string {
 	tokenValue := generateRandomString(14)
-	token := Token{TokenID: tokenValue, Username: username, Expiration: time.Now().Add(time.Hour)}
+	token := Token{TokenID: tokenValue, Username: username, Expiration: time.Now().Add(TokenTTL)}
 	tokenmap.Store(token.TokenID, token)
 	return token.TokenID
 }
@@ -60,15 +66,15 @@ func Authenticate(w http.ResponseWriter, r *http.Request, document []byte, token
 	// Umarhsal the document to get the username
 	errs := json.Unmarshal(document, &data)
 	if errs != nil {
-		slog.Error("Authentification: error unmarshaling username", "error", errs)
-		http.Error(w, `"No username in request body"`, http.StatusBadRequest)
+		slog.DebugContext(r.Context(), "Authentification: error unmarshaling username", "error", errs)
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "No username in request body")
 		return
 	}
 	temp, exists := data["username"]
 	username.Username = temp
 	if !exists || username.Username == "" {
-		slog.Error("Authentification: error parsing body request username")
-		http.Error(w, `"No username in request body"`, http.StatusBadRequest)
+		slog.DebugContext(r.Context(), "Authentification: error parsing body request username")
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "No username in request body")
 		return
 	}
 
@@ -79,8 +85,8 @@ func Authenticate(w http.ResponseWriter, r *http.Request, document []byte, token
 	response := map[string]string{"token": accessToken}
 	jsonResponse, errors := json.MarshalIndent(response, "", "  ")
 	if errors != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		slog.Error("Unable to Marshal token")
+		docAndColl.WriteError(w, r, http.StatusInternalServerError, "unable to marshal token")
+		slog.ErrorContext(r.Context(), "Unable to Marshal token", "error", errors)
 		return
 	}
 
@@ -94,10 +100,8 @@ func Authenticate(w http.ResponseWriter, r *http.Request, document []byte, token
 func Delete(w http.ResponseWriter, r *http.Request, tokenmap *sync.Map) {
 	// Get the token from header.
 	token := r.Header.Get("Authorization")
-	slog.Info(token)
 	if token == "" || len(token) < 7 || token[:7] != "Bearer " {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`"Missing or invalid bearer token"`))
+		unauthorized(w, r, "Missing or invalid bearer token")
 		return
 	}
 
@@ -109,12 +113,10 @@ func Delete(w http.ResponseWriter, r *http.Request, tokenmap *sync.Map) {
 	if ok {
 		// Token found, invalidate it.
 		tokenmap.Delete(tokenValue)
-		w.WriteHeader(http.StatusNoContent) // TODO: DO NOT KNOW IF THIS IS THE RIGHT CODE
-		w.Write([]byte("Logged Out"))
+		w.WriteHeader(http.StatusNoContent)
 	} else {
 		// Token not found, return an error response
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`"Missing or invalid bearer token"`))
+		unauthorized(w, r, "Missing or invalid bearer token")
 	}
 }
 
@@ -123,11 +125,16 @@ func defaultAuth(w http.ResponseWriter, r *http.Request, tokenmap *sync.Map) (bo
 	// Extract the bearer token from header
 	bearer_token := r.Header.Get("Authorization")
 
+	// a client that authenticated with a certificate needs no token, unless it sends one anyway
+	if username, ok := certificateUser(r); ok && bearer_token == "" {
+		metrics.Auth(true)
+		return true, username
+	}
+
 	// Validate the header
 	if bearer_token == "" || len(bearer_token) < 7 || bearer_token[:7] != "Bearer " {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`"Missing or invalid bearer token"`))
-		slog.Error("Authorize: Invalid or missing Bearer token")
+		unauthorized(w, r, "Missing or invalid bearer token")
+		slog.DebugContext(r.Context(), "Authorize: Invalid or missing Bearer token")
 		return false, ""
 	}
 
@@ -141,23 +148,38 @@ func defaultAuth(w http.ResponseWriter, r *http.Request, tokenmap *sync.Map) (bo
 		if ok {
 			// Token found, check expiration
 			if !tokenStruct.Expiration.Before(time.Now()) {
+				metrics.Auth(true)
 				return true, tokenStruct.Username
 			} else {
-				http.Error(w, "Token is expired", http.StatusUnauthorized)
+				unauthorized(w, r, "Token is expired")
 				return false, ""
 			}
 		}
 	} else {
 		// Token not found, return an error response
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`"Missing or invalid bearer token"`))
+		unauthorized(w, r, "Missing or invalid bearer token")
 		return false, ""
 	}
-	w.WriteHeader(http.StatusUnauthorized)
-	w.Write([]byte(`"Missing or invalid bearer token"`))
+	unauthorized(w, r, "Missing or invalid bearer token")
 	return false, ""
 }
 
+// certificateUser returns the username of a client certificate verified during the TLS handshake, its common name
+func certificateUser(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	username := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	return username, username != ""
+}
+
+// unauthorized writes a 401 asking for a bearer token
+func unauthorized(w http.ResponseWriter, r *http.Request, msg string) {
+	metrics.Auth(false)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	docAndColl.WriteError(w, r, http.StatusUnauthorized, msg)
+}
+
 // Initialize initializes the tokenMap from the given token file for the use of authentification.
 func Initialize(tokenFile string, tokenMap *sync.Map) {
 
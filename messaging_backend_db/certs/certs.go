@@ -0,0 +1,70 @@
+// Package certs serves TLS from certificate files that can be replaced while the server runs
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Reloader holds the TLS configuration read from a certificate, its key and, for mutual TLS, a file of client
+// CAs. Reload reads the files again, and new connections use them, while open connections keep the old ones
+type Reloader struct {
+	cert, key, clientCA string
+	current             atomic.Pointer[tls.Config]
+}
+
+// New reads the certificate and key, and the client CAs if clientCA is not "". With client CAs, clients may
+// present a certificate signed by one of them, and are refused if they present any other
+func New(cert, key, clientCA string) (*Reloader, error) {
+	reloader := &Reloader{cert: cert, key: key, clientCA: clientCA}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload reads the files again. If any of them is invalid the configuration in use is kept
+func (reloader *Reloader) Reload() error {
+	pair, err := tls.LoadX509KeyPair(reloader.cert, reloader.key)
+	if err != nil {
+		return fmt.Errorf("certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{pair},
+		// h2 first, so the event streams of a client share one connection
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if reloader.clientCA != "" {
+		pem, err := os.ReadFile(reloader.clientCA)
+		if err != nil {
+			return fmt.Errorf("client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA: no certificates in " + reloader.clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	reloader.current.Store(config)
+	return nil
+}
+
+// Config returns the configuration to serve with. It hands every new connection the configuration last loaded
+func (reloader *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return reloader.current.Load(), nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &reloader.current.Load().Certificates[0], nil
+		},
+	}
+}
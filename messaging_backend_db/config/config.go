@@ -0,0 +1,334 @@
+// Package config loads the settings of the server: defaults, overridden by a JSON config file, overridden by
+// OWLDB_* environment variables, overridden by command-line flags
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/authorize"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/cors"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+)
+
+// Config is the configuration of the server. Its JSON form is the config file, e.g.
+//
+//	{"listen": ":3318", "schema": "schema.json", "tokens": {"file": "tokens.json", "ttl": "1h"}, "logLevel": "warn"}
+//
+// There are no persistence settings: the server keeps its databases in memory only, and they are lost when it stops
+type Config struct {
+	// the address the server listens on, e.g. :3318 or 127.0.0.1:8080
+	Listen string    `json:"listen"`
+	TLS    TLSConfig `json:"tls"`
+	// the JSON schema file documents are validated against, "" to accept any JSON document
+	Schema   string      `json:"schema"`
+	Tokens   TokenConfig `json:"tokens"`
+	CORS     CORSConfig  `json:"cors"`
+	LogLevel string      `json:"logLevel"`
+	// json, or text for lines like key=value
+	LogFormat string `json:"logFormat"`
+	Limits    Limits `json:"limits"`
+	// the address /metrics is served on, by default one only the host itself reaches, "" to serve it on Listen
+	// where anyone who reaches the server can read it
+	MetricsListen string `json:"metricsListen"`
+}
+
+// TLSConfig is the certificate the server serves HTTPS with. Without one it serves plain HTTP
+// With ClientCA, clients may authenticate with a certificate signed by one of its CAs instead of a bearer token
+type TLSConfig struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"clientCA"`
+}
+
+// TokenConfig is how users are authenticated: the file of tokens to start with, and how long a login lasts
+type TokenConfig struct {
+	File string   `json:"file"`
+	TTL  Duration `json:"ttl"`
+}
+
+// CORSConfig is the policy for cross-origin requests, see package cors
+type CORSConfig struct {
+	Origins     []string `json:"origins"`
+	Methods     []string `json:"methods"`
+	Headers     []string `json:"headers"`
+	Credentials bool     `json:"credentials"`
+	MaxAge      Duration `json:"maxAge"`
+}
+
+// Limits bounds what the server keeps and accepts, and how often it cleans up
+type Limits struct {
+	// the number of prior versions kept per document
+	History int `json:"history"`
+	// the largest request body accepted, 0 for no limit
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+	// how long a client may take to send the headers of a request
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	// how often expired documents, documents retention policies don't keep, and the trash are cleaned up
+	ReapInterval       Duration `json:"reapInterval"`
+	RetentionInterval  Duration `json:"retentionInterval"`
+	TrashPurgeInterval Duration `json:"trashPurgeInterval"`
+	// how long deleted items can be restored
+	TrashRetention Duration `json:"trashRetention"`
+	// how long a shutdown waits for requests in flight before closing them
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+}
+
+// Duration is a time.Duration written like "10m" in the config file
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("durations are strings like \"10m\": %s", data)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the configuration of a server started without a config file, environment or flags
+func Default() *Config {
+	policy := cors.Default()
+	return &Config{
+		Listen:        ":3318",
+		MetricsListen: "127.0.0.1:9318",
+		Tokens:        TokenConfig{TTL: Duration(authorize.TokenTTL)},
+		CORS: CORSConfig{
+			Origins:     policy.Origins,
+			Methods:     policy.Methods,
+			Headers:     policy.Headers,
+			Credentials: policy.Credentials,
+			MaxAge:      Duration(policy.MaxAge),
+		},
+		LogLevel:  "info",
+		LogFormat: "json",
+		Limits: Limits{
+			History:            docAndColl.HistoryLimit,
+			MaxBodyBytes:       10 << 20,
+			ReadHeaderTimeout:  Duration(10 * time.Second),
+			ReapInterval:       Duration(time.Second),
+			RetentionInterval:  Duration(time.Minute),
+			TrashPurgeInterval: Duration(time.Minute),
+			TrashRetention:     Duration(docAndColl.TrashRetention),
+			ShutdownTimeout:    Duration(30 * time.Second),
+		},
+	}
+}
+
+// option is a setting that can be given by a flag and an environment variable
+type option struct {
+	flag    string
+	env     string
+	usage   string
+	boolean bool
+	set     func(cfg *Config, value string) error
+}
+
+var options = []option{
+	{"listen", "OWLDB_LISTEN", "address to listen on, e.g. :3318", false, func(cfg *Config, v string) error { cfg.Listen = v; return nil }},
+	{"metrics-listen", "OWLDB_METRICS_LISTEN", "address to serve /metrics on, \"\" to serve it on the main address", false, func(cfg *Config, v string) error { cfg.MetricsListen = v; return nil }},
+	{"p", "OWLDB_PORT", "port number, short for -listen :<port>", false, setPort},
+	{"tls-cert", "OWLDB_TLS_CERT", "certificate file to serve HTTPS with", false, func(cfg *Config, v string) error { cfg.TLS.Cert = v; return nil }},
+	{"tls-key", "OWLDB_TLS_KEY", "private key file of the certificate", false, func(cfg *Config, v string) error { cfg.TLS.Key = v; return nil }},
+	{"tls-client-ca", "OWLDB_TLS_CLIENT_CA", "CA certificates of the client certificates users may authenticate with", false, func(cfg *Config, v string) error { cfg.TLS.ClientCA = v; return nil }},
+	{"s", "OWLDB_SCHEMA", "JSON schema file name", false, func(cfg *Config, v string) error { cfg.Schema = v; return nil }},
+	{"t", "OWLDB_TOKEN_FILE", "file name for token", false, func(cfg *Config, v string) error { cfg.Tokens.File = v; return nil }},
+	{"token-ttl", "OWLDB_TOKEN_TTL", "how long a login lasts", false, durationOf(func(cfg *Config) *Duration { return &cfg.Tokens.TTL })},
+	{"cors-origins", "OWLDB_CORS_ORIGINS", "comma separated origins allowed to make cross-origin requests, * for any", false, listOf(func(cfg *Config) *[]string { return &cfg.CORS.Origins })},
+	{"cors-methods", "OWLDB_CORS_METHODS", "comma separated methods allowed cross-origin", false, listOf(func(cfg *Config) *[]string { return &cfg.CORS.Methods })},
+	{"cors-headers", "OWLDB_CORS_HEADERS", "comma separated request headers allowed cross-origin", false, listOf(func(cfg *Config) *[]string { return &cfg.CORS.Headers })},
+	{"cors-credentials", "OWLDB_CORS_CREDENTIALS", "allow cross-origin requests with credentials", true, func(cfg *Config, v string) (err error) {
+		cfg.CORS.Credentials, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"cors-max-age", "OWLDB_CORS_MAX_AGE", "how long browsers may cache preflight responses", false, durationOf(func(cfg *Config) *Duration { return &cfg.CORS.MaxAge })},
+	{"log-level", "OWLDB_LOG_LEVEL", "the least severe level logged: debug, info, warn or error", false, func(cfg *Config, v string) error { cfg.LogLevel = v; return nil }},
+	{"log-format", "OWLDB_LOG_FORMAT", "format of the log: json or text", false, func(cfg *Config, v string) error { cfg.LogFormat = v; return nil }},
+	{"history", "OWLDB_HISTORY", "number of prior versions kept per document", false, func(cfg *Config, v string) (err error) {
+		cfg.Limits.History, err = strconv.Atoi(v)
+		return err
+	}},
+	{"max-body", "OWLDB_MAX_BODY_BYTES", "largest request body accepted in bytes, 0 for no limit", false, func(cfg *Config, v string) (err error) {
+		cfg.Limits.MaxBodyBytes, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"read-header-timeout", "OWLDB_READ_HEADER_TIMEOUT", "how long a client may take to send request headers", false, durationOf(func(cfg *Config) *Duration { return &cfg.Limits.ReadHeaderTimeout })},
+	{"reap-interval", "OWLDB_REAP_INTERVAL", "how often documents whose time to live is over are removed", false, durationOf(func(cfg *Config) *Duration { return &cfg.Limits.ReapInterval })},
+	{"retention-interval", "OWLDB_RETENTION_INTERVAL", "how often retention policies are enforced", false, durationOf(func(cfg *Config) *Duration { return &cfg.Limits.RetentionInterval })},
+	{"trash-purge-interval", "OWLDB_TRASH_PURGE_INTERVAL", "how often deleted items whose retention is over are purged from the trash", false, durationOf(func(cfg *Config) *Duration { return &cfg.Limits.TrashPurgeInterval })},
+	{"trash-retention", "OWLDB_TRASH_RETENTION", "how long deleted items can be restored", false, durationOf(func(cfg *Config) *Duration { return &cfg.Limits.TrashRetention })},
+	{"shutdown-timeout", "OWLDB_SHUTDOWN_TIMEOUT", "how long a shutdown waits for requests in flight", false, durationOf(func(cfg *Config) *Duration { return &cfg.Limits.ShutdownTimeout })},
+}
+
+func setPort(cfg *Config, value string) error {
+	if port, err := strconv.Atoi(value); err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", value)
+	}
+	cfg.Listen = ":" + value
+	return nil
+}
+
+func durationOf(field func(*Config) *Duration) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		*field(cfg) = Duration(d)
+		return err
+	}
+}
+
+func listOf(field func(*Config) *[]string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = cors.List(value)
+		return nil
+	}
+}
+
+// Flags defines a flag for every setting on fs. The values of the flags given on the command line are
+// collected into the returned map, for Load
+func Flags(fs *flag.FlagSet) map[string]string {
+	given := map[string]string{}
+	for _, opt := range options {
+		usage := opt.usage + " (env " + opt.env + ")"
+		collect := func(value string) error {
+			given[opt.flag] = value
+			return nil
+		}
+		if opt.boolean {
+			fs.BoolFunc(opt.flag, usage, collect)
+		} else {
+			fs.Func(opt.flag, usage, collect)
+		}
+	}
+	return given
+}
+
+// Load returns the defaults, overridden by the config file at path if path is not "", by the environment as
+// looked up by lookupEnv, and by the flags given, as collected by Flags. The result is validated
+func Load(path string, lookupEnv func(string) (string, bool), flags map[string]string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	for _, opt := range options {
+		if value, ok := lookupEnv(opt.env); ok {
+			if err := opt.set(cfg, value); err != nil {
+				return nil, fmt.Errorf("environment variable %s: %w", opt.env, err)
+			}
+		}
+	}
+	for _, opt := range options {
+		if value, ok := flags[opt.flag]; ok {
+			if err := opt.set(cfg, value); err != nil {
+				return nil, fmt.Errorf("flag -%s: %w", opt.flag, err)
+			}
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks that the configuration can be served with, and returns every problem with it
+func (cfg *Config) Validate() error {
+	var errs []error
+	if err := checkAddress(cfg.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	}
+	if cfg.MetricsListen != "" {
+		if err := checkAddress(cfg.MetricsListen); err != nil {
+			errs = append(errs, fmt.Errorf("metricsListen: %w", err))
+		}
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		errs = append(errs, errors.New("tls: cert and key must be given together"))
+	}
+	if cfg.TLS.ClientCA != "" && cfg.TLS.Cert == "" {
+		errs = append(errs, errors.New("tls: clientCA needs a cert and key"))
+	}
+	for _, file := range []string{cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.ClientCA, cfg.Schema, cfg.Tokens.File} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.Tokens.TTL <= 0 {
+		errs = append(errs, errors.New("tokens: ttl must be positive"))
+	}
+	if _, err := cfg.Level(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.LogFormat != "json" && cfg.LogFormat != "text" {
+		errs = append(errs, fmt.Errorf("logFormat: %q is not json or text", cfg.LogFormat))
+	}
+	if len(cfg.CORS.Origins) == 0 {
+		errs = append(errs, errors.New("cors: origins must not be empty, use * for any"))
+	}
+	if cfg.CORS.Credentials && slices.Contains(cfg.CORS.Origins, "*") {
+		errs = append(errs, errors.New("cors: credentials need the origins listed, * would let every site use them"))
+	}
+	if cfg.CORS.MaxAge < 0 {
+		errs = append(errs, errors.New("cors: maxAge must not be negative"))
+	}
+	if cfg.Limits.History < 0 || cfg.Limits.MaxBodyBytes < 0 {
+		errs = append(errs, errors.New("limits: history and maxBodyBytes must not be negative"))
+	}
+	for name, interval := range map[string]Duration{
+		"readHeaderTimeout":  cfg.Limits.ReadHeaderTimeout,
+		"reapInterval":       cfg.Limits.ReapInterval,
+		"retentionInterval":  cfg.Limits.RetentionInterval,
+		"trashPurgeInterval": cfg.Limits.TrashPurgeInterval,
+		"trashRetention":     cfg.Limits.TrashRetention,
+		"shutdownTimeout":    cfg.Limits.ShutdownTimeout,
+	} {
+		if interval <= 0 {
+			errs = append(errs, fmt.Errorf("limits: %s must be positive", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checks that address is a host and port to listen on, e.g. :3318
+func checkAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// Level returns the log level of the configuration
+func (cfg *Config) Level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return level, fmt.Errorf("logLevel: %q is not debug, info, warn or error", cfg.LogLevel)
+	}
+	return level, nil
+}
@@ -0,0 +1,83 @@
+// Package cors decides which cross-origin requests browsers may make, and sets the headers that tell them
+package cors
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy is the CORS configuration of the server. An origin of "*" allows every origin
+// With Credentials, browsers may send cookies and Authorization headers cross-origin, so the origin of the
+// request is echoed back instead of "*", which browsers refuse for credentialed requests. Only origins that
+// are listed are echoed: "*" does not allow credentialed requests from every site
+type Policy struct {
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Credentials bool
+	// how long browsers may cache the answer to a preflight request, 0 to leave it to the browser
+	MaxAge time.Duration
+}
+
+// Default is the policy of a server started without CORS flags: every origin, every method the server
+// serves, and the headers its clients send
+func Default() *Policy {
+	return &Policy{
+		Origins: []string{"*"},
+		Methods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		Headers: []string{"Authorization", "Content-Type", "If-Match", "If-None-Match", "Last-Event-ID"},
+	}
+}
+
+// List takes in a comma separated flag value, e.g. "GET, PUT", and returns its entries
+func List(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// allowedOrigin returns the value of Access-Control-Allow-Origin for a request from origin, "" if it is not allowed
+func (policy *Policy) allowedOrigin(origin string) string {
+	switch {
+	case origin == "":
+		return ""
+	case slices.Contains(policy.Origins, origin):
+		return origin
+	case slices.Contains(policy.Origins, "*") && !policy.Credentials:
+		return "*"
+	}
+	return ""
+}
+
+// Apply sets the CORS headers of the response to r. It is called before anything else is written, so every
+// response carries them: errors, event streams and preflight responses alike
+func (policy *Policy) Apply(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	origin := policy.allowedOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if policy.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	header.Set("Access-Control-Expose-Headers", "ETag, X-Owldb-Sequence, X-Request-ID, WWW-Authenticate")
+
+	// the rest answers a preflight request
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return
+	}
+	header.Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+	header.Set("Access-Control-Allow-Headers", strings.Join(policy.Headers, ", "))
+	if policy.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+	}
+}
@@ -3,17 +3,19 @@ package database
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/validator"
-	"github.com/santhosh-tekuri/jsonschema"
 )
 
 // Defines a database struct that contains a skiplist of documents
@@ -23,6 +25,19 @@ type Database struct {
 	URI         []byte
 	DocumentMap map[string]*docAndColl.Document // Map of document IDs to document instances
 	DocSkipList skiplist.List[string, *docAndColl.Document]
+
+	// deleted documents and collections of the database
+	Trash docAndColl.Trash
+
+	// the retention policy of the documents of the database, nil if it keeps every document
+	Retention atomic.Pointer[docAndColl.RetentionPolicy]
+
+	// the schema of the documents of the database, nil to use the global one
+	Schema atomic.Pointer[docAndColl.Schema]
+
+	// held shared by every read and write of the database, by its reaper and retention sweeper, and
+	// exclusively by a transaction, so a transaction never interleaves with them
+	TxMu sync.RWMutex
 }
 
 // Defines a struct that helps with formatting when returning a database
@@ -43,116 +58,186 @@ func NewDatabase(name string) Database {
 // Takes in a document name and attempts to get that document from the database
 // Returns the document and true on success, or an empty value and false on failure
 func (db *Database) GetDocumentFromDatabase(docName string) (*docAndColl.Document, bool) {
+	doc, _, exist := db.GetDocumentFromDatabaseAt(nil, docName)
+	return doc, exist
+}
+
+// Takes in a snapshot and a document name and attempts to get that document as it was at the snapshot.
+// A nil snapshot reads the latest state.
+// Returns the document, its version and true on success, or an empty value and false on failure
+func (db *Database) GetDocumentFromDatabaseAt(snap *skiplist.Snapshot, docName string) (*docAndColl.Document, uint64, bool) {
 	db.Mu.Lock()
 	defer db.Mu.Unlock()
 
-	doc, exist := db.DocSkipList.Find(docName)
+	doc, version, exist := db.DocSkipList.At(snap).FindVersion(docName)
+	if exist && doc.Expired(time.Now()) {
+		return nil, 0, false
+	}
+	return doc, version, exist
+}
 
-	return doc, exist
+// Takes in the current time and removes the expired documents of the database, and of every collection below it
+// Subscribers of a removed document get the delete event. Returns how many documents were removed
+func (db *Database) ReapExpired(now time.Time) int {
+	reaped := 0
+	for name, doc := range db.DocSkipList.All() {
+		if !doc.Expired(now) {
+			reaped += doc.ReapCollections(now)
+			continue
+		}
+		// only the expired version is removed, a document written in the meantime stays
+		if _, removed := db.DocSkipList.RemoveIf(name, func(curr *docAndColl.Document) bool { return curr == doc }); removed {
+			slog.Debug("reaped expired document", "path", doc.URIPath())
+			doc.Removed(nil)
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// Takes in the request that inserted a document, if any, and the current time and removes the documents of the
+// database its retention policy does not keep. Subscribers of each document get the delete event
+// Within a transaction, nothing is removed until it commits
+func (db *Database) EnforceRetention(r *http.Request, now time.Time) int {
+	if docAndColl.Deferred(r, db) {
+		return 0
+	}
+	pruned := db.Retention.Load().Prune(&db.DocSkipList, now)
+	for _, doc := range pruned {
+		doc.Removed(r)
+	}
+	return len(pruned)
+}
+
+// Takes in the current time and enforces the retention policies of the database and of every collection below it
+func (db *Database) SweepRetention(now time.Time) int {
+	pruned := db.EnforceRetention(nil, now)
+	for _, doc := range db.DocSkipList.All() {
+		pruned += doc.SweepRetention(now)
+	}
+	return pruned
+}
+
+// Takes in a snapshot and returns how many documents and collections are in the database as of it
+func (db *Database) Count(snap *skiplist.Snapshot) (documents int, collections int) {
+	for _, doc := range db.DocSkipList.At(snap).All() {
+		docs, cols := doc.Count(snap)
+		documents += 1 + docs
+		collections += cols
+	}
+	return documents, collections
 }
 
 // Formats the database for printing purposes
-func (db *Database) DatabaseFormat(w http.ResponseWriter, r *http.Request) {
-	slog.Info("DatabaseFormat: " + db.Name)
+// The documents are read as of the given snapshot, so the listing is consistent even while documents are written
+func (db *Database) DatabaseFormat(w http.ResponseWriter, r *http.Request, snap *skiplist.Snapshot) {
 	queryParams := r.URL.Query()
 	interval := queryParams.Get("interval")
-	slog.Info("interval", interval)
 	start := ""
 	end := ""
 	if interval != "" {
 		trimmedData := strings.Trim(interval, "[]")
 		parts := strings.Split(trimmedData, ",")
 		if len(parts) < 2 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("unable to parse interval request"))
+			docAndColl.WriteError(w, r, http.StatusBadRequest, "unable to parse interval request")
+			return
 		}
 		start = parts[0]
 		end = parts[1]
 
 	}
 
-	var dbFormat []Format
-	dbFormat = make([]Format, 0)
-	results := db.DocSkipList.Query(start, end)
-
-	var docName string
-	var document *docAndColl.Document
-	for i, _ := range results {
-		docName = results[i].Key
-		document = results[i].Value
-		var data any
-
-		if err := json.Unmarshal(document.Data, &data); err != nil {
-			slog.Error("unable to unmarshal data", "error", err)
+	formats := func(yield func(Format) bool) {
+		view := db.DocSkipList.At(snap)
+		docs := view.Ascend(start, 0)
+		if end != "" {
+			docs = view.Range(start, end, 0)
 		}
+		now := time.Now()
+		for docName, document := range docs {
+			if document.Expired(now) {
+				continue
+			}
+			var data any
 
-		output := Format{
-			Path: "/" + docName,
-			Doc:  data,
-			Meta: document.Metadata,
-		}
+			if err := json.Unmarshal(document.Data, &data); err != nil {
+				slog.ErrorContext(r.Context(), "unable to unmarshal data", "error", err)
+			}
 
-		dbFormat = append(dbFormat, output)
+			output := Format{
+				Path: "/" + docName,
+				Doc:  data,
+				Meta: document.Meta(),
+			}
 
+			if !yield(output) {
+				return
+			}
+		}
 	}
-	jsonData, err := json.MarshalIndent(dbFormat, "", "  ")
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unable to marshal document " + db.Name))
-	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonData)
+
+	docAndColl.WriteJSONArray(w, formats)
 }
 
 // Takes in a writer and a document name and attempts to delete that document from the database
+// The document is moved to the trash of the database, from where it can be restored until it is purged
 // Writes the appropriate message to the header based on success/failure
-func (db *Database) DeleteDocument(w http.ResponseWriter, docName string) {
-	slog.Info("DeleteDocument (from Database): " + docName)
+func (db *Database) DeleteDocument(w http.ResponseWriter, r *http.Request, docName string, username string) {
+
+	// conditional deletes only remove the version their preconditions were checked against
+	prev, version, exists := db.DocSkipList.FindVersion(docName)
+	if msg, ok := docAndColl.CheckPreconditions(r, exists, version); !ok {
+		docAndColl.PreconditionFailed(w, r, msg)
+		return
+	}
+	var check func(*docAndColl.Document) bool
+	if docAndColl.Conditional(r) {
+		check = func(doc *docAndColl.Document) bool { return doc == prev }
+	}
 
 	// SKIPLISTS:
-	doc, removed := db.DocSkipList.Remove(docName)
+	doc, removed := db.DocSkipList.RemoveIf(docName, check)
 
-	if !removed {
-		slog.Info("did not remove document successfully")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`"not found"`))
+	if !removed && check != nil && exists {
+		docAndColl.PreconditionFailed(w, r, docAndColl.ErrPreconditionFailed.Error())
+	} else if !removed {
+		docAndColl.WriteError(w, r, http.StatusNotFound, "unable to delete document "+docName+": not found")
 	} else {
 		// updating subs after removing
-		docAndColl.Update_subscribers(string(doc.URI), doc.Subscribers, "delete", nil)
-		slog.Info("removed document successfully, docname: " + doc.Name)
+		doc.Removed(r)
+		slog.DebugContext(r.Context(), "deleted document", "path", doc.URIPath())
+		db.Trash.Add(docAndColl.TrashPath(r), "document", username, doc)
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
 // Takes in information on a document and attempts to put the document into the database
 // Writes the appropriate header based on success/failure and whether a patch, update, or insertion occurred
-func (db *Database) PutDocIntoDatabase(w http.ResponseWriter, r *http.Request, desc []byte, name string, schema *jsonschema.Schema, username string, patch bool) {
-	slog.Info("PutDocIntoDatabase: " + db.Name)
+func (db *Database) PutDocIntoDatabase(w http.ResponseWriter, r *http.Request, desc []byte, name string, schema *docAndColl.Schema, username string, patch bool) {
 
-	valid, err := validator.Validate(schema, desc)
-	if !valid {
-		slog.Error("document does not conform to schema")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("invalid document:" + err.Error()))
+	desc, expiresAt, err := docAndColl.ParseTTL(r, desc)
+	if err != nil {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, err.Error())
 		return
+	}
 
+	valid, err := validator.Validate(schema.Compiled, desc)
+	if !valid {
+		slog.DebugContext(r.Context(), "document does not conform to schema")
+		docAndColl.WriteValidationError(w, r, err)
+		return
 	}
 
 	newDocument := docAndColl.NewDocument(name, desc)
 	meta := docAndColl.NewMetadata(username)
-
-	newDocument.ColSkipList = skiplist.NewList[string, *docAndColl.Collection]("", "zzz")
+	meta.ExpiresAt = expiresAt
+	meta.SchemaVersion = schema.Version
 
 	// Check if document already exists
-	// TODO: wouldnt it make more sense to check this first and then we only need to change the prev_doc.body and metadata without having to make a new document?
-	// that way we can ensure that the subscribers stay the same and its overall less error prone?
-	slog.Info("checking if doc already exists")
-	prev_doc, exists := db.DocSkipList.Find(newDocument.Name)
-
-	if exists {
-		slog.Info("prev_doc exists already")
-	} else {
-		slog.Info("prev_doc does not exist")
+	prev_doc, version, exists := db.DocSkipList.FindVersion(newDocument.Name)
+	// an expired document is replaced like one that does not exist
+	if exists && prev_doc.Expired(time.Now()) {
+		prev_doc, version, exists = nil, 0, false
 	}
 
 	var uri map[string]string
@@ -168,8 +253,14 @@ func (db *Database) PutDocIntoDatabase(w http.ResponseWriter, r *http.Request, d
 	jsonData, err := json.MarshalIndent(uri, "", "  ")
 	newDocument.URI = jsonData
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unable to create database " + newDocument.Name + ": url cannot be marshalled"))
+		docAndColl.WriteError(w, r, http.StatusInternalServerError, "unable to create document "+newDocument.Name+": url cannot be marshalled")
+		return
+	}
+
+	// If-Match and If-None-Match are checked against the version found above
+	if msg, ok := docAndColl.CheckPreconditions(r, exists, version); !ok {
+		docAndColl.PreconditionFailed(w, r, msg)
+		return
 	}
 
 	if exists {
@@ -177,63 +268,73 @@ func (db *Database) PutDocIntoDatabase(w http.ResponseWriter, r *http.Request, d
 		queryParams := r.URL.Query()
 		timestamp := queryParams.Get("timestamp")
 		if timestamp != "" {
-			slog.Info("timestamp found")
 			// Convert string to int64
 			timestamp_num, err := strconv.ParseInt(timestamp, 10, 64)
 			if err != nil {
-				slog.Error(err.Error())
+				docAndColl.WriteError(w, r, http.StatusBadRequest, "invalid timestamp "+timestamp)
+				return
 			}
 			if timestamp_num != prev_doc.Metadata.LastModifiedAt {
-				slog.Error("timestamps dont match")
+				slog.DebugContext(r.Context(), "timestamps dont match")
 				str := fmt.Sprintf("unable to create/replace document: pre-condition timestamp %d doesn't match current timestamp %d ", timestamp_num, prev_doc.Metadata.LastModifiedAt)
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(str))
+				docAndColl.PreconditionFailed(w, r, str)
 
 				// call return as we dont need to change anything
 				return
 			}
 
 		}
-
-		meta.CreatedAt = prev_doc.Metadata.CreatedAt
-		meta.CreatedBy = prev_doc.Metadata.CreatedBy
-		newDocument.Subscribers = prev_doc.Subscribers
-
 	}
 
 	newDocument.Metadata = meta
 
 	// SKIPLISTS:
 
-	newDocument.ColSkipList = skiplist.NewList[string, *docAndColl.Collection]("", "zzz")
-
 	// first do the check for updating
-	c := func(name string, doc *docAndColl.Document, exists bool) (newValue *docAndColl.Document, err error) {
-		// if the node alrady exists (exists == true), then we want to update.
-		// if the node does not exist, return the new empty document
+	conditional := docAndColl.Conditional(r)
+	replacing := false
+	c := func(name string, doc *docAndColl.Document, currExists bool) (newValue *docAndColl.Document, err error) {
+		replacing = currExists && !doc.Expired(time.Now())
+		// a conditional write only replaces the version its preconditions were checked against
+		if conditional && (replacing != exists || (replacing && doc != prev_doc)) {
+			return nil, docAndColl.ErrPreconditionFailed
+		}
 
-		if exists {
+		// if the node alrady exists (exists == true), then we want to update, keeping its collections and subscribers.
+		// if the node does not exist, return the new empty document
+		if replacing {
+			newDocument.Replaces(doc)
 			return &newDocument, nil
 		} else {
 			return &newDocument, nil
 		}
 	}
 
-	slog.Info("running Upsert")
-
-	updating, err := db.DocSkipList.Upsert(newDocument.Name, c)
-	if err != nil {
-		slog.Error("error after upsert in PutDocIntoCollection:", err)
+	_, seq, err := db.DocSkipList.UpsertVersion(newDocument.Name, c)
+	updating := replacing
+	if errors.Is(err, docAndColl.ErrPreconditionFailed) {
+		docAndColl.PreconditionFailed(w, r, "unable to create/replace document: "+err.Error())
+		return
+	} else if err != nil {
+		// nothing was written, so there is no version to report and nothing to notify about
+		slog.ErrorContext(r.Context(), "unable to put document", "path", newDocument.URIPath(), "error", err)
+		docAndColl.WriteError(w, r, http.StatusInternalServerError, "unable to create/replace document "+newDocument.Name+": "+err.Error())
+		return
+	}
+	w.Header().Set("ETag", docAndColl.ETag(seq))
+	if updating {
+		docAndColl.Notify(r, r.URL.Path, newDocument.Subscribers, "update", &newDocument)
+	} else {
+		db.EnforceRetention(r, time.Now())
 	}
 
 	if !patch {
 		if updating {
-			slog.Info("PutDocIntoDatabase: replacing Document", "Name", newDocument.Name)
-			docAndColl.Update_subscribers(r.URL.Path, prev_doc.Subscribers, "update", &newDocument)
+			slog.DebugContext(r.Context(), "replaced document", "path", newDocument.URIPath())
 			w.WriteHeader(http.StatusOK)
 			w.Write(newDocument.URI)
 		} else {
-			slog.Info("PutDocIntoDatabase: creating Document", "Name", newDocument.Name)
+			slog.DebugContext(r.Context(), "created document", "path", newDocument.URIPath())
 			w.WriteHeader(http.StatusCreated)
 			w.Write(newDocument.URI)
 		}
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
@@ -19,11 +20,13 @@ type Database_host struct {
 	Mu          sync.Mutex
 	DatabaseMap map[string]*database.Database // Map of database names to database instances
 	DBSkipList  skiplist.List[string, *database.Database]
+
+	// deleted databases
+	Trash docAndColl.Trash
 }
 
 // Constructs a new database_host
 func NewDatabaseHost(name string) *Database_host {
-	slog.Info("making new databasehost")
 	return &Database_host{
 		Name:       name,
 		DBSkipList: skiplist.NewList[string, *database.Database]("", "zzz"),
@@ -33,72 +36,116 @@ func NewDatabaseHost(name string) *Database_host {
 // Takes in the name of a database and attempts to retrieve that database from the database host
 // Returns the database and true on success, or an empty value and false on failure
 func (db_host *Database_host) GetDatabase(databaseName string) (*database.Database, bool) {
+	return db_host.GetDatabaseAt(nil, databaseName)
+}
+
+// Takes in a snapshot and the name of a database and attempts to retrieve that database as it was at the snapshot
+// A nil snapshot reads the latest state
+func (db_host *Database_host) GetDatabaseAt(snap *skiplist.Snapshot, databaseName string) (*database.Database, bool) {
 	db_host.Mu.Lock()
 	defer db_host.Mu.Unlock()
 
-	slog.Info("start get db")
-	db, exist := db_host.DBSkipList.Find(databaseName)
+	db, exist := db_host.DBSkipList.At(snap).Find(databaseName)
 	if !exist {
-		slog.Error("db doesnt exist")
 		return nil, false
 	}
-	slog.Info("middle of get database")
-
-	slog.Info("get database, from db_host, returning db and exist")
 
 	return db, exist
 
 }
 
 // Takes in a writer and a database name and attempts to delete that database from the database host
+// The database is moved to the trash of the host, from where it can be restored until it is purged
 // Writes the appropriate message to the header based on success/failure
-func (db_host *Database_host) DeleteDatabase(w http.ResponseWriter, dbName string) {
-	slog.Info("In delete database")
-	slog.Info("DeleteDatabase: " + dbName)
+func (db_host *Database_host) DeleteDatabase(w http.ResponseWriter, r *http.Request, dbName string, username string) {
 
 	// SKIPLISTS:
 	db, removed := db_host.DBSkipList.Remove(dbName)
 
 	if !removed {
-		slog.Info("did not remove database successfully")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`"not found"`))
+		docAndColl.WriteError(w, r, http.StatusNotFound, "unable to delete database "+dbName+": not found")
 	} else {
-		slog.Info("removed database successfully, dbname: " + db.Name)
+		slog.InfoContext(r.Context(), "deleted database", "name", dbName)
+		db_host.Trash.Add(dbName, "database", username, db)
+		// every subscriber inside the database hears about the delete, and their streams are closed
+		for _, doc := range db.DocSkipList.All() {
+			doc.Removed(r)
+		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 
 }
 
+// Takes in the current time and purges every trash of the host that holds items deleted more than
+// docAndColl.TrashRetention ago. Returns how many items were purged
+func (db_host *Database_host) PurgeTrash(now time.Time) int {
+	purged := db_host.Trash.Purge(now)
+	for _, db := range db_host.DBSkipList.All() {
+		db.TxMu.RLock()
+		purged += db.Trash.Purge(now)
+		db.TxMu.RUnlock()
+	}
+	return purged
+}
+
+// Takes in the current time and removes the expired documents of every database of the host
+// Returns how many documents were removed
+func (db_host *Database_host) ReapExpired(now time.Time) int {
+	reaped := 0
+	for _, db := range db_host.DBSkipList.All() {
+		// a transaction in progress may roll back to documents the reaper would remove
+		db.TxMu.RLock()
+		reaped += db.ReapExpired(now)
+		db.TxMu.RUnlock()
+	}
+	return reaped
+}
+
+// Takes in the current time and enforces the retention policies of every database of the host
+// Returns how many documents were removed
+func (db_host *Database_host) SweepRetention(now time.Time) int {
+	pruned := 0
+	for _, db := range db_host.DBSkipList.All() {
+		db.TxMu.RLock()
+		pruned += db.SweepRetention(now)
+		db.TxMu.RUnlock()
+	}
+	return pruned
+}
+
+// Takes in a snapshot and returns how many databases, documents and collections the host holds as of it
+func (db_host *Database_host) Count(snap *skiplist.Snapshot) (databases int, documents int, collections int) {
+	for _, db := range db_host.DBSkipList.At(snap).All() {
+		docs, cols := db.Count(snap)
+		databases++
+		documents += docs
+		collections += cols
+	}
+	return databases, documents, collections
+}
+
 // Takes in information on a database and attempts to put the database into the database host
+// schema is the schema attached to the new database, or nil
 // Writes the appropriate header based on success/failure
-func (db_host *Database_host) PutDatabaseIntoServer(owlDB *Database_host, w http.ResponseWriter, r *http.Request, name string) {
-	slog.Info("server success")
-	slog.Info(owlDB.Name)
+func (db_host *Database_host) PutDatabaseIntoServer(owlDB *Database_host, w http.ResponseWriter, r *http.Request, name string, schema *docAndColl.Schema) {
 
 	var newDatabase database.Database
 
-	slog.Info("before .Name")
-
 	//adding values to database
 	newDatabase.Name = name
 
-	slog.Info("after name")
-
 	uri := map[string]string{
 		"uri": r.URL.Path,
 	}
-	slog.Info("after uri")
 
 	jsonData, err := json.MarshalIndent(uri, "", "  ")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unable to create database " + newDatabase.Name + ": url cannot be marshalled"))
+		docAndColl.WriteError(w, r, http.StatusInternalServerError, "unable to create database "+newDatabase.Name+": url cannot be marshalled")
+		return
 	}
-	slog.Info("after JSON")
 
 	newDatabase.URI = jsonData
-	slog.Info("starting skiplist, PutDatabaseIntoServer")
+	newDatabase.Schema.Store(schema)
 
 	// SKIPLISTS:
 
@@ -115,23 +162,12 @@ func (db_host *Database_host) PutDatabaseIntoServer(owlDB *Database_host, w http
 		}
 	}
 
-	slog.Info("running Upsert")
-	slog.Info(newDatabase.Name)
-
-	updating, err := owlDB.DBSkipList.Upsert(newDatabase.Name, c)
-	if err != nil {
-		slog.Error("error after upsert in PutDocIntoCollection:", err)
-	}
-
+	// the only error is the check refusing an existing database, reported below
+	updating, _ := owlDB.DBSkipList.Upsert(newDatabase.Name, c)
 	if updating {
-		slog.Info("PUT unable to create database " + newDatabase.Name + ": exists")
-		w.WriteHeader(http.StatusBadRequest)
-		msg := "unable to create database " + newDatabase.Name + ": exists"
-		jsonMsg, _ := json.Marshal(msg)
-		w.Write(jsonMsg)
-
+		docAndColl.WriteError(w, r, http.StatusConflict, "unable to create database "+newDatabase.Name+": exists")
 	} else {
-		slog.Info("PUT database: creating Database", "Name", newDatabase.Name)
+		slog.InfoContext(r.Context(), "created database", "name", newDatabase.Name)
 		w.WriteHeader(http.StatusCreated)
 		w.Write(newDatabase.URI)
 	}
@@ -2,16 +2,18 @@ package docAndColl
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/validator"
-	"github.com/santhosh-tekuri/jsonschema"
 )
 
 // this a struct that represents a collection: it contains information of the metadata, path, skip list containing child documents, and current substribbers
@@ -23,6 +25,10 @@ type Collection struct {
 	DocumentMap map[string]*Document // Map of document IDs to document instances
 	Subscribers sync.Map
 	DocSkipList skiplist.List[string, *Document]
+	// the retention policy of the collection, nil if it keeps every document (see retention.go)
+	Retention atomic.Pointer[RetentionPolicy]
+	// the schema of the documents below the collection, nil to use the one of its ancestors (see schema.go)
+	Schema atomic.Pointer[Schema]
 }
 
 // Constructs a new collection
@@ -35,97 +41,113 @@ func NewCollection(name string) Collection {
 
 // given a pointer to a document finds a collection in that document
 func (col *Collection) GetDocumentFromCollection(docName string) (*Document, bool) {
+	doc, _, exist := col.GetDocumentFromCollectionAt(nil, docName)
+	return doc, exist
+}
+
+// given a snapshot finds a document in the collection as it was at that snapshot, together with its version
+// a nil snapshot reads the latest state
+func (col *Collection) GetDocumentFromCollectionAt(snap *skiplist.Snapshot, docName string) (*Document, uint64, bool) {
 	col.Mu.Lock()
 	defer col.Mu.Unlock()
 
 	// SKIPLISTS:
-	doc, exist := col.DocSkipList.Find(docName)
-
-	return doc, exist
-
+	doc, version, exist := col.DocSkipList.At(snap).FindVersion(docName)
+	if exist && doc.Expired(time.Now()) {
+		return nil, 0, false
+	}
+	return doc, version, exist
 }
 
 // formats the collection to be written to the response writer in a json format
-func (col *Collection) CollectionFormat(w http.ResponseWriter) {
-	slog.Info("success")
-	slog.Info(col.Name)
-	var dbFormat []Format
-	dbFormat = make([]Format, 0)
-	results := col.DocSkipList.Query("", "")
-
-	var document *Document
-	for i, _ := range results {
-		document = results[i].Value
-		var data any
-
-		if err := json.Unmarshal(document.Data, &data); err != nil {
-			slog.Error("unable to unmarshal data", "error", err)
-		}
-		var jsonMap map[string]string
-		json.Unmarshal(document.URI, &jsonMap)
-		uri, _ := jsonMap["uri"]
-		parts := strings.Split(uri, "/")
-		substr := strings.Join(parts[3:], "/")
-		substr = "/" + substr
-		output := Format{
-			Path: substr,
-			Doc:  data,
-			Meta: document.Metadata,
-		}
+// the documents are streamed from the skip list so the listing is never held in memory as a whole
+// they are read as of the given snapshot, so the listing never shows a collection in the middle of an update
+func (col *Collection) CollectionFormat(w http.ResponseWriter, r *http.Request, snap *skiplist.Snapshot) {
+	formats := func(yield func(Format) bool) {
+		now := time.Now()
+		for _, document := range col.DocSkipList.At(snap).All() {
+			if document.Expired(now) {
+				continue
+			}
+			var data any
 
-		dbFormat = append(dbFormat, output)
+			if err := json.Unmarshal(document.Data, &data); err != nil {
+				slog.ErrorContext(r.Context(), "unable to unmarshal data", "error", err)
+			}
+			var jsonMap map[string]string
+			json.Unmarshal(document.URI, &jsonMap)
+			uri, _ := jsonMap["uri"]
+			parts := strings.Split(uri, "/")
+			substr := strings.Join(parts[3:], "/")
+			substr = "/" + substr
+			output := Format{
+				Path: substr,
+				Doc:  data,
+				Meta: document.Meta(),
+			}
 
+			if !yield(output) {
+				return
+			}
+		}
 	}
 
-	jsonData, err := json.MarshalIndent(dbFormat, "", "  ")
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unable to marshal document " + col.Name))
-	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonData)
+	WriteJSONArray(w, formats)
 }
 
-// Delete the given docuemnt
-func (col *Collection) DeleteDocument(w http.ResponseWriter, docName string) *Document {
-	slog.Info("Delete Document (from Collection): ")
-	slog.Info(docName)
+// Delete the given docuemnt, moving it to the trash of its database
+func (col *Collection) DeleteDocument(w http.ResponseWriter, r *http.Request, docName string, trash *Trash, username string) *Document {
+
+	// conditional deletes only remove the version their preconditions were checked against
+	prev, version, exists := col.DocSkipList.FindVersion(docName)
+	if msg, ok := CheckPreconditions(r, exists, version); !ok {
+		PreconditionFailed(w, r, msg)
+		return nil
+	}
+	var check func(*Document) bool
+	if Conditional(r) {
+		check = func(doc *Document) bool { return doc == prev }
+	}
 
 	// SKIPLISTS:
-	doc, removed := col.DocSkipList.Remove(docName)
+	doc, removed := col.DocSkipList.RemoveIf(docName, check)
 
-	if !removed {
-		slog.Info("did not remove document successfully")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`"not found"`))
+	if !removed && check != nil && exists {
+		PreconditionFailed(w, r, ErrPreconditionFailed.Error())
+	} else if !removed {
+		WriteError(w, r, http.StatusNotFound, "unable to delete document "+docName+": not found")
 	} else {
-		slog.Info("removed document successfully, docname: " + doc.Name)
+		slog.DebugContext(r.Context(), "deleted document", "path", doc.URIPath())
+		trash.Add(TrashPath(r), "document", username, doc)
 		w.WriteHeader(http.StatusNoContent)
 	}
 	return doc
 }
 
 // given a collection pointer creates a new document and meta and inserts the document
-func (col *Collection) PutDocIntoCollection(w http.ResponseWriter, r *http.Request, desc []byte, name string, schema *jsonschema.Schema, username string, patch bool) {
+func (col *Collection) PutDocIntoCollection(w http.ResponseWriter, r *http.Request, desc []byte, name string, schema *Schema, username string, patch bool) {
 
-	slog.Info("database success")
-	slog.Info(col.Name)
 	// Convert request into a database
 
-	valid, err := validator.Validate(schema, desc)
+	desc, expiresAt, err := ParseTTL(r, desc)
+	if err != nil {
+		WriteError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	valid, err := validator.Validate(schema.Compiled, desc)
 
 	if !valid {
-		slog.Error("document does not conform to schema")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("invalid document:" + err.Error()))
+		slog.DebugContext(r.Context(), "document does not conform to schema")
+		WriteValidationError(w, r, err)
 		return
-
 	}
 
 	newDocument := NewDocument(name, desc)
 	metadata := NewMetadata(username)
+	metadata.ExpiresAt = expiresAt
+	metadata.SchemaVersion = schema.Version
 
-	slog.Info("before")
 	var uri map[string]string
 	if r.Method == http.MethodPost {
 		uri = map[string]string{
@@ -139,31 +161,39 @@ func (col *Collection) PutDocIntoCollection(w http.ResponseWriter, r *http.Reque
 	jsonData, err := json.MarshalIndent(uri, "", "  ")
 	newDocument.URI = jsonData
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unable to create database " + newDocument.Name + ": url cannot be marshalled"))
+		WriteError(w, r, http.StatusInternalServerError, "unable to create document "+newDocument.Name+": url cannot be marshalled")
+		return
 	}
 
 	newDocument.Metadata = metadata
-	slog.Info("after")
 
-	prev_doc, exists := col.DocSkipList.Find(newDocument.Name)
+	prev_doc, version, exists := col.DocSkipList.FindVersion(newDocument.Name)
+	// an expired document is replaced like one that does not exist
+	if exists && prev_doc.Expired(time.Now()) {
+		prev_doc, version, exists = nil, 0, false
+	}
+
+	// If-Match and If-None-Match are checked against the version found above
+	if msg, ok := CheckPreconditions(r, exists, version); !ok {
+		PreconditionFailed(w, r, msg)
+		return
+	}
+
 	if exists {
-		slog.Info("document exits in collection")
 		// check timestamp
 		queryParams := r.URL.Query()
 		timestamp := queryParams.Get("timestamp")
 		if timestamp != "" {
-			slog.Info("timestamp found")
 			// Convert string to int64
 			timestamp_num, err := strconv.ParseInt(timestamp, 10, 64)
 			if err != nil {
-				slog.Error(err.Error())
+				WriteError(w, r, http.StatusBadRequest, "invalid timestamp "+timestamp)
+				return
 			}
 			if timestamp_num != prev_doc.Metadata.LastModifiedAt {
-				slog.Error("timestamps dont match")
+				slog.DebugContext(r.Context(), "timestamps dont match")
 				str := fmt.Sprintf("unable to create/replace document: pre-condition timestamp %d doesn't match current timestamp %d ", timestamp_num, prev_doc.Metadata.LastModifiedAt)
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(str))
+				PreconditionFailed(w, r, str)
 				// call return as we dont need to change anything
 				return
 			}
@@ -175,37 +205,77 @@ func (col *Collection) PutDocIntoCollection(w http.ResponseWriter, r *http.Reque
 	newDocument.ColSkipList = skiplist.NewList[string, *Collection]("", "zzz")
 
 	// first do the check for updating
-	c := func(name string, doc *Document, exists bool) (newValue *Document, err error) {
+	conditional := Conditional(r)
+	replacing := false
+	c := func(name string, doc *Document, currExists bool) (newValue *Document, err error) {
+		replacing = currExists && !doc.Expired(time.Now())
+		// a conditional write only replaces the version its preconditions were checked against
+		if conditional && (replacing != exists || (replacing && doc != prev_doc)) {
+			return nil, ErrPreconditionFailed
+		}
+
 		// if the node alrady exists (exists == true), then we want to update.
 		// if the node does not exist, return the new empty document
 
 		// for documents, do we want to return the newDocument no matter what?
-		if exists {
+		if replacing {
+			newDocument.Replaces(doc)
 			return &newDocument, nil
 		} else {
 			return &newDocument, nil
 		}
 	}
 
-	slog.Info("running Upsert")
-
-	updating, err := col.DocSkipList.Upsert(newDocument.Name, c)
-
-	slog.Info("Updating collection subscribers if they exist")
-	Update_subscribers(r.URL.Path, &col.Subscribers, "update", &newDocument)
+	_, seq, err := col.DocSkipList.UpsertVersion(newDocument.Name, c)
+	updating := replacing
+	if errors.Is(err, ErrPreconditionFailed) {
+		PreconditionFailed(w, r, "unable to create/replace document: "+err.Error())
+		return
+	} else if err != nil {
+		// nothing was written, so there is no version to report and nothing to notify about
+		slog.ErrorContext(r.Context(), "unable to put document", "path", newDocument.URIPath(), "error", err)
+		WriteError(w, r, http.StatusInternalServerError, "unable to create/replace document "+newDocument.Name+": "+err.Error())
+		return
+	}
 
-	if err != nil {
-		slog.Error("error after upsert in PutDocIntoCollection:", err)
+	Notify(r, r.URL.Path, &col.Subscribers, "update", &newDocument)
+	if updating {
+		Notify(r, r.URL.Path, newDocument.Subscribers, "update", &newDocument)
+	} else {
+		col.EnforceRetention(r, time.Now())
 	}
+
+	w.Header().Set("ETag", ETag(seq))
 	if !patch {
 		if updating {
-			slog.Info("PUT document: replacing Document", "Name", newDocument.Name)
+			slog.DebugContext(r.Context(), "replaced document", "path", newDocument.URIPath())
 			w.WriteHeader(http.StatusOK)
 			w.Write(newDocument.URI)
 		} else {
-			slog.Info("PUT document: creating Document", "Name", newDocument.Name)
+			slog.DebugContext(r.Context(), "created document", "path", newDocument.URIPath())
 			w.WriteHeader(http.StatusCreated)
 			w.Write(newDocument.URI)
 		}
 	}
 }
+
+// Count returns how many documents are in the collection and below it, and how many collections are below
+// it, as of the given snapshot
+func (col *Collection) Count(snap *skiplist.Snapshot) (documents int, collections int) {
+	for _, doc := range col.DocSkipList.At(snap).All() {
+		docs, cols := doc.Count(snap)
+		documents += 1 + docs
+		collections += cols
+	}
+	return documents, collections
+}
+
+// Count returns how many documents and collections are below the document, as of the given snapshot
+func (doc *Document) Count(snap *skiplist.Snapshot) (documents int, collections int) {
+	for _, col := range doc.ColSkipList.At(snap).All() {
+		docs, cols := col.Count(snap)
+		documents += docs
+		collections += 1 + cols
+	}
+	return documents, collections
+}
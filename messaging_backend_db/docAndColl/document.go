@@ -1,17 +1,20 @@
 package docAndColl
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"iter"
 	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/jsonPatch"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/jsonvisit"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/metrics"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/validator"
 
@@ -35,6 +38,11 @@ type Document struct {
 	CollectionMap map[string]*Collection // Map of collection names to collection instances
 	ColSkipList   skiplist.List[string, *Collection]
 	Subscribers   *sync.Map
+	// the number of this version of the document and the prior versions that are kept (see history.go)
+	RevisionNumber int
+	History        []Revision
+	// the schema the stored version was last checked against, when that happened after it was written (see evolve.go)
+	stamp atomic.Pointer[schemaStamp]
 }
 
 // Metadata type structure represents the metadata this struct is used in database, colleciton and document to hold their respective metadata
@@ -43,11 +51,16 @@ type Metadata struct {
 	CreatedBy      string `json:"createdBy"`
 	LastModifiedAt int64  `json:"lastModifiedAt"`
 	LastModifiedBy string `json:"lastModifiedBy"`
+	// when a document with a time to live expires, in milliseconds (see ttl.go)
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// the version of the schema the document was last validated against, and whether it failed a later one (see evolve.go)
+	SchemaVersion int  `json:"schemaVersion,omitempty"`
+	SchemaInvalid bool `json:"schemaInvalid,omitempty"`
 }
 
 // creates a new metadata
 func NewMetadata(name string) *Metadata {
-	return &Metadata{time.Now().UnixMilli(), name, time.Now().UnixMilli(), name}
+	return &Metadata{CreatedAt: time.Now().UnixMilli(), CreatedBy: name, LastModifiedAt: time.Now().UnixMilli(), LastModifiedBy: name}
 }
 
 // this is a struct that hold all the information to be marshalled for the response writer
@@ -66,42 +79,58 @@ type PatchResponse struct {
 
 // NewPatchRespons constructs a new patch response.
 func NewPatchResponse(uri string, PatchFailed bool, Message string) PatchResponse {
-	return PatchResponse{uri, PatchFailed, Message}
+	return PatchResponse{Uri: uri, PatchFailed: PatchFailed, Message: Message}
 }
 
 // Constructs a new document
 func NewDocument(name string, data []byte) Document {
 	return Document{
-		Name:        name,
-		Data:        data,
-		ColSkipList: skiplist.NewList[string, *Collection]("", "zzz"),
-		Subscribers: new(sync.Map),
+		Name:           name,
+		Data:           data,
+		ColSkipList:    skiplist.NewList[string, *Collection]("", "zzz"),
+		Subscribers:    new(sync.Map),
+		RevisionNumber: 1,
 	}
 }
 
+// Replaces makes the document the next version of prev, the document it is replacing. Only the data and the
+// last modification change: the child collections, the subscribers and the creation metadata of prev are kept
+// So is the time to live of prev, unless the document sets its own
+func (doc *Document) Replaces(prev *Document) {
+	doc.ColSkipList = prev.ColSkipList
+	doc.Subscribers = prev.Subscribers
+	doc.Metadata.CreatedAt = prev.Metadata.CreatedAt
+	doc.Metadata.CreatedBy = prev.Metadata.CreatedBy
+	if doc.Metadata.ExpiresAt == 0 {
+		doc.Metadata.ExpiresAt = prev.Metadata.ExpiresAt
+	}
+	doc.Succeeds(prev)
+}
+
 // this retruns a pointer to the colleciton that we are looking for
 func (doc *Document) GetCollection(colName string) (*Collection, bool) {
+	return doc.GetCollectionAt(nil, colName)
+}
+
+// this returns a pointer to the collection as it was at the given snapshot. a nil snapshot reads the latest state
+func (doc *Document) GetCollectionAt(snap *skiplist.Snapshot, colName string) (*Collection, bool) {
 	doc.Mu.Lock()
 	defer doc.Mu.Unlock()
 
 	// SKIPLISTS:
-	cols, exist := doc.ColSkipList.Find(colName)
+	cols, exist := doc.ColSkipList.At(snap).Find(colName)
 
 	return cols, exist
 
 }
 
 // This gets the inputted document. Essentially the GET function for Documents.
-func (doc *Document) DocumentFormat(w http.ResponseWriter) {
-	slog.Info("success")
-	slog.Info(doc.Name)
-	w.WriteHeader(http.StatusOK)
-
+func (doc *Document) DocumentFormat(w http.ResponseWriter, r *http.Request) {
 	var data any
 	if err := json.Unmarshal(doc.Data, &data); err != nil {
-		slog.Error("unable to unmarshal data", "error", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unable to unmarshal document " + doc.Name))
+		slog.ErrorContext(r.Context(), "unable to unmarshal data", "error", err)
+		WriteError(w, r, http.StatusInternalServerError, "unable to unmarshal document "+doc.Name)
+		return
 	}
 	var jsonMap map[string]string
 	json.Unmarshal(doc.URI, &jsonMap)
@@ -111,61 +140,53 @@ func (doc *Document) DocumentFormat(w http.ResponseWriter) {
 	output := Format{
 		Path: "/" + substr,
 		Doc:  data,
-		Meta: doc.Metadata,
+		Meta: doc.Meta(),
 	}
-	slog.Info("output ", output)
 	jsonData, err := json.MarshalIndent(output, "", "  ")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unable to marshal document " + doc.Name))
+		WriteError(w, r, http.StatusInternalServerError, "unable to marshal document "+doc.Name)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonData)
 }
 
-// Delete the collection from the document
-func (doc *Document) DeleteCollection(w http.ResponseWriter, colName string) {
-	slog.Info("Delete Collection: ")
-	slog.Info(colName)
+// Delete the collection from the document, moving it to the trash of its database
+func (doc *Document) DeleteCollection(w http.ResponseWriter, r *http.Request, colName string, trash *Trash, username string) {
 
 	// SKIPLISTS:
 	col, removed := doc.ColSkipList.Remove(colName)
 
 	if !removed {
-		slog.Info("did not remove collection successfully")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`"not found"`))
+		WriteError(w, r, http.StatusNotFound, "unable to delete collection "+colName+": not found")
 	} else {
-		slog.Info("removed collection successfully, colname: " + col.Name)
-		slog.Info("updating collection subscribers about delete event")
-		Update_subscribers(string(col.URI), &col.Subscribers, "delete", doc)
+		slog.DebugContext(r.Context(), "deleted collection", "path", col.URIPath())
+		trash.Add(TrashPath(r), "collection", username, col)
+		col.Removed(r)
 		w.WriteHeader(http.StatusNoContent)
-		w.Write([]byte(`"bad resource path"`))
 	}
 }
 
 // puts a collection given a document and creates the collection struct
-func (doc *Document) PutColIntoDocument(w http.ResponseWriter, r *http.Request, name string) {
+// schema is the schema attached to the new collection, or nil
+func (doc *Document) PutColIntoDocument(w http.ResponseWriter, r *http.Request, name string, schema *Schema) {
 
-	slog.Info("collection success")
-	slog.Info(name)
 	// Convert request into a database
 	newCollection := NewCollection(name)
 	metadata := NewMetadata("username")
 
-	slog.Info("before")
 	uri := map[string]string{
 		"uri": r.URL.Path,
 	}
 	jsonData, err := json.MarshalIndent(uri, "", "  ")
 	newCollection.URI = jsonData
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unable to create collection " + newCollection.Name + ": url cannot be marshalled"))
+		WriteError(w, r, http.StatusInternalServerError, "unable to create collection "+newCollection.Name+": url cannot be marshalled")
+		return
 	}
 
 	newCollection.Metadata = metadata
-	slog.Info("after")
+	newCollection.Schema.Store(schema)
 
 	//Lock database before writting to it
 	doc.Mu.Lock()
@@ -188,19 +209,14 @@ func (doc *Document) PutColIntoDocument(w http.ResponseWriter, r *http.Request,
 		}
 	}
 
-	slog.Info("running Upsert")
-
-	updating, err := doc.ColSkipList.Upsert(newCollection.Name, c)
-	if err != nil {
-		slog.Error("error after upsert in PutDocIntoCollection:", err)
-	}
+	// the only error is the check refusing an existing collection, reported below
+	updating, _ := doc.ColSkipList.Upsert(newCollection.Name, c)
 
 	if updating {
-		slog.Info("PUT Collection: replacing collection", "Name", newCollection.Name)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`"unable to create collection: exists"`))
+		slog.DebugContext(r.Context(), "collection exists", "path", r.URL.Path)
+		WriteError(w, r, http.StatusConflict, "unable to create collection: exists")
 	} else {
-		slog.Info("PUT Collection: creating collection", "Name", newCollection.Name)
+		slog.DebugContext(r.Context(), "created collection", "path", r.URL.Path)
 		w.WriteHeader(http.StatusCreated)
 		w.Write(newCollection.URI)
 	}
@@ -215,11 +231,9 @@ func (doc *Document) Patch(w http.ResponseWriter, r *http.Request, data []byte,
 	message := "patch applied"
 
 	// get all the patches
-	slog.Info("unmarshal patch")
 	var patches []map[string]interface{}
 	if err := json.Unmarshal(data, &patches); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid patches: " + err.Error()))
+		WriteError(w, r, http.StatusBadRequest, "invalid patches: "+err.Error())
 		return doc.Data, err
 	}
 
@@ -231,21 +245,18 @@ func (doc *Document) Patch(w http.ResponseWriter, r *http.Request, data []byte,
 
 		// if missing fields for one patch
 		if !opExists || !valueExists || !pathExists {
-			slog.Info("Patch did not have all necessary values")
-			sendPatchResponse(w, http.StatusOK, NewPatchResponse(r.URL.Path, true, "Each patch object must have 'op', 'value', and 'path' fields."))
-			return doc.Data, nil
-		}
-		var err error
-		if err != nil {
-			sendPatchResponse(w, http.StatusOK, NewPatchResponse(r.URL.Path, true, fmt.Sprintf("Validation failed for patch operation: %v", err)))
-			return doc.Data, nil
+			slog.DebugContext(r.Context(), "patch did not have all necessary values")
+			err := errors.New("each patch object must have 'op', 'value', and 'path' fields")
+			WriteError(w, r, http.StatusBadRequest, err.Error())
+			return doc.Data, err
 		}
 		// if no errors applyPatch
+		var err error
 		newdoc, err = applyPatch(path, val, newdoc, op)
 		if err != nil {
-			slog.Error(err.Error())
-			sendPatchResponse(w, http.StatusOK, NewPatchResponse(r.URL.Path, true, err.Error()))
-			return doc.Data, nil
+			slog.DebugContext(r.Context(), "unable to apply patch", "error", err)
+			WriteError(w, r, http.StatusBadRequest, err.Error())
+			return doc.Data, err
 		}
 
 	}
@@ -254,9 +265,9 @@ func (doc *Document) Patch(w http.ResponseWriter, r *http.Request, data []byte,
 	valid, err := validator.Validate(schema, newdoc)
 
 	if !valid {
-		slog.Error("document does not conform to schema")
-		sendPatchResponse(w, http.StatusOK, NewPatchResponse(r.URL.Path, true, fmt.Sprintf("patched document is invalid: %v", err.Error())))
-		return doc.Data, nil
+		slog.DebugContext(r.Context(), "document does not conform to schema")
+		WriteValidationError(w, r, err)
+		return doc.Data, err
 	}
 
 	sendPatchResponse(w, http.StatusOK, NewPatchResponse(r.URL.Path, false, message))
@@ -267,8 +278,6 @@ func (doc *Document) Patch(w http.ResponseWriter, r *http.Request, data []byte,
 // This is a helper fucntion for patch the trys to apply the diven patchs given by the body of the handler request
 func applyPatch(path string, value interface{}, data []byte, op string) ([]byte, error) {
 
-	slog.Info("op code:", op)
-
 	var docMap map[string]interface{}
 	if err := json.Unmarshal(data, &docMap); err != nil {
 		// Handle error, return data as is
@@ -282,11 +291,7 @@ func applyPatch(path string, value interface{}, data []byte, op string) ([]byte,
 	var new_components []string
 	if op == "ObjectAdd" {
 		newkey = components[lastIndex]
-		slog.Info("newkey:", newkey)
 		new_components = components[:len(components)-1]
-		for _, component := range new_components {
-			slog.Info("new array:", component)
-		}
 		jsonpatch = jsonPatch.New(new_components, value, op, newkey)
 	} else {
 
@@ -295,12 +300,7 @@ func applyPatch(path string, value interface{}, data []byte, op string) ([]byte,
 
 	// Validate the patch docMap
 	res, err := jsonvisit.Accept(docMap, jsonpatch)
-
-	slog.Info(fmt.Sprintf("patched%t", res))
-
 	if err != nil {
-		slog.Error(err.Error())
-		slog.Info("Result:", res)
 		return nil, err
 	}
 
@@ -310,7 +310,6 @@ func applyPatch(path string, value interface{}, data []byte, op string) ([]byte,
 		return data, err
 	}
 
-	slog.Info("Document after patch:", string(resultData))
 	return resultData, nil
 }
 
@@ -318,8 +317,7 @@ func applyPatch(path string, value interface{}, data []byte, op string) ([]byte,
 func sendPatchResponse(w http.ResponseWriter, statusCode int, output PatchResponse) {
 	jsonData, err := json.MarshalIndent(output, "", "  ")
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Internal server error: unable to marshal patch response"))
+		WriteError(w, nil, http.StatusInternalServerError, "unable to marshal patch response")
 		return
 	}
 
@@ -328,8 +326,35 @@ func sendPatchResponse(w http.ResponseWriter, statusCode int, output PatchRespon
 	w.Write(jsonData)
 }
 
+// WriteJSONArray writes a 200 response whose body is a JSON array of the given items.
+// Items are marshalled and written one at a time, so the full listing is never built in memory.
+func WriteJSONArray[T any](w http.ResponseWriter, items iter.Seq[T]) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("["))
+
+	sep := "\n  "
+	for item := range items {
+		jsonData, err := json.MarshalIndent(item, "  ", "  ")
+		if err != nil {
+			slog.Error("unable to marshal list item", "error", err)
+			continue
+		}
+		w.Write([]byte(sep))
+		w.Write(jsonData)
+		sep = ",\n  "
+	}
+
+	if sep == "\n  " {
+		// nothing was written, match the output of json.MarshalIndent for an empty slice
+		w.Write([]byte("]"))
+		return
+	}
+	w.Write([]byte("\n]"))
+}
+
 // this updates the substribers when a new subscriber is added to a specific document or collection
-func Update_subscribers(path string, subscribers *sync.Map, event string, doc *Document) {
+// r is the request that caused the event, nil for the sweepers
+func Update_subscribers(r *http.Request, path string, subscribers *sync.Map, event string, doc *Document) {
 
 	// Check if the map is empty
 	isEmpty := true
@@ -351,13 +376,13 @@ func Update_subscribers(path string, subscribers *sync.Map, event string, doc *D
 		eventID := time.Now().UnixNano()
 		eventData = fmt.Sprintf("event: delete\ndata: %s\nid: %d\n\n", path, eventID)
 
-		slog.Info("Updating each subscriber about delete event for", "path", path, "eventID", eventID)
+		slog.DebugContext(contextOf(r), "updating subscribers", "event", event, "path", path, "id", eventID)
 
 	case "update":
 
 		var data any
 		if err := json.Unmarshal(doc.Data, &data); err != nil {
-			slog.Error("unable to unmarshal data", "error", err)
+			slog.ErrorContext(contextOf(r), "unable to unmarshal data", "error", err)
 		}
 
 		var jsonMap map[string]string
@@ -370,82 +395,78 @@ func Update_subscribers(path string, subscribers *sync.Map, event string, doc *D
 		output := Format{
 			Path: substr,
 			Doc:  data,
-			Meta: doc.Metadata,
+			Meta: doc.Meta(),
 		}
 
 		jsonData, err := json.MarshalIndent(output, "", "  ")
 		if err != nil {
-			slog.Error(err.Error())
+			slog.ErrorContext(contextOf(r), "unable to marshal event", "path", path, "error", err)
 		}
 
 		//event format
 		eventID := time.Now().UnixNano()
 		eventData = fmt.Sprintf("event: update\ndata: %s\nid: %d\n\n", jsonData, eventID)
 
-		slog.Info("Updating each subscriber about update event for", "path", path, "eventID", eventID)
+		slog.DebugContext(contextOf(r), "updating subscribers", "event", event, "path", path, "id", eventID)
 	}
 
-	// going through the subscribers
+	// going through the subscribers, the event is followed by an empty line
+	start := time.Now()
+	recipients := 0
 	subscribers.Range(func(key, value interface{}) bool {
-		if subscriber, ok := key.(writeFlusher); ok {
-			subscriber.Write([]byte(eventData))
-			subscriber.Flush()
-			var evt bytes.Buffer
-			evt.WriteString("\n")
-			slog.Info("Now Sending the empty line", "msg", evt.String())
-			// Send event
-			subscriber.Write(evt.Bytes())
-			subscriber.Flush()
-		}
+		deliver(key, value, []byte(eventData+"\n"))
+		recipients++
 		return true
 	})
+	metrics.Fanout(event, recipients, time.Since(start))
 }
 
 // this creates a new subscriber and only occurs once per subsriber
-func CreateSubscriber(path string, w http.ResponseWriter, r *http.Request, subscribers *sync.Map) {
+// route is the path template of path, the stream is counted under it in the metrics
+func CreateSubscriber(path string, route string, w http.ResponseWriter, r *http.Request, subscribers *sync.Map) {
 
-	slog.Info("Mode = subscribe. Processing server-sent events")
 	// Handle server-sent events logic here
 
 	// ResponseWriter ==> writeFlusher
 	wf, ok := w.(writeFlusher)
 	if !ok {
-		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		WriteError(w, r, http.StatusInternalServerError, "streaming unsupported")
 		return
 	}
-	slog.Info("Converted to writeFlusher")
 
 	// Set up event stream connection
 	wf.Header().Set("Content-Type", "text/event-stream")
 	wf.Header().Set("Cache-Control", "no-cache")
 	wf.Header().Set("Connection", "keep-alive")
-	wf.Header().Set("Access-Control-Allow-Origin", "*")
 	wf.WriteHeader(http.StatusOK)
 	wf.Flush()
 
-	slog.Info("Sent headers")
-
-	slog.Info("store new subscriber to:", path)
-
 	// store subscribers in a mapping of name to slice of subscribers
 	// check if a name to subscriber mapping already exists
-	if _, ok := subscribers.Load(wf); !ok {
-		// a new subscriber
-		subscribers.Store(wf, true)
+	sub := &subscription{wf: wf, done: make(chan struct{})}
+	if _, ok := subscribers.LoadOrStore(wf, sub); !ok {
+		// a new subscriber, forgotten again when its stream ends
+		defer subscribers.CompareAndDelete(wf, sub)
+		defer sub.close()
+		if !track(r, sub) {
+			return
+		}
+		defer untrack(r, sub)
+		metrics.Subscribed(route, 1)
+		defer metrics.Subscribed(route, -1)
 
 		for {
 			select {
 			case <-r.Context().Done():
 				// Client closed connection
-				slog.Info("Client closed connection")
+				slog.DebugContext(r.Context(), "subscriber closed connection", "path", path)
+				return
+			case <-sub.done:
+				// what the client subscribed to was removed
+				slog.DebugContext(r.Context(), "subscription closed", "path", path)
 				return
 			case <-time.After(15 * time.Second): // Send a comment line every 15 seconds to prevent connection timeout
-				var evt bytes.Buffer
-				evt.WriteString("\n")
-				slog.Info("Sending", "msg", evt.String())
-				// Send event
-				wf.Write(evt.Bytes())
-				wf.Flush()
+				sub.send([]byte("\n"))
 			}
 		}
 	}
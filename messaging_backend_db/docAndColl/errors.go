@@ -0,0 +1,70 @@
+package docAndColl
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/validator"
+)
+
+// ErrorFormat is the body of every error response: a code naming the status, what went wrong and the path
+// of the request. Violations lists why a document does not conform to its schema, for invalid documents
+type ErrorFormat struct {
+	Code       string                `json:"code"`
+	Message    string                `json:"message"`
+	Path       string                `json:"path"`
+	Violations []validator.Violation `json:"violations,omitempty"`
+}
+
+// the codes of the statuses errors are reported with
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusInternalServerError:   "internal_error",
+}
+
+// ErrorCode returns the code of an error status, e.g. not_found for 404
+func ErrorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	return "error"
+}
+
+// WriteError writes an error response with the given status and message. The path is the one of the
+// request, r may be nil when there is none
+func WriteError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	writeErrorFormat(w, status, newErrorFormat(r, status, msg))
+}
+
+// WriteValidationError writes a 400 listing the violations in an error returned by validator.Validate
+func WriteValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	body := newErrorFormat(r, http.StatusBadRequest, "invalid document")
+	body.Violations = validator.Violations(err)
+	writeErrorFormat(w, http.StatusBadRequest, body)
+}
+
+// builds the body of an error response to r
+func newErrorFormat(r *http.Request, status int, msg string) ErrorFormat {
+	body := ErrorFormat{Code: ErrorCode(status), Message: msg}
+	if r != nil {
+		body.Path = r.URL.Path
+	}
+	return body
+}
+
+// writes an error response. Headers set before, like Allow or WWW-Authenticate, are kept
+func writeErrorFormat(w http.ResponseWriter, status int, body ErrorFormat) {
+	jsonData, _ := json.MarshalIndent(body, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
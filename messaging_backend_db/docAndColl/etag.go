@@ -0,0 +1,66 @@
+package docAndColl
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrPreconditionFailed is returned by an update check when the document changed after the
+// preconditions of a conditional request were checked
+var ErrPreconditionFailed = errors.New("document changed concurrently")
+
+// ETag formats the version of a document, the sequence number of the write that stored it, as an entity tag
+func ETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// Conditional reports whether a write request only applies to a certain state of the document,
+// through If-Match, If-None-Match or the timestamp query parameter
+func Conditional(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" || r.URL.Query().Get("timestamp") != ""
+}
+
+// CheckPreconditions takes in a write request and the current version of the document it writes to, if it exists
+// Returns an error message and false if the If-Match or If-None-Match header of the request does not hold
+func CheckPreconditions(r *http.Request, exists bool, version uint64) (string, bool) {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !(exists && matchETag(ifMatch, version, false)) {
+		if !exists {
+			return "precondition failed: document does not exist", false
+		}
+		return "precondition failed: If-Match " + ifMatch + " doesn't match current ETag " + ETag(version), false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && exists && matchETag(ifNoneMatch, version, true) {
+		return "precondition failed: document exists with ETag " + ETag(version), false
+	}
+	return "", true
+}
+
+// PreconditionFailed writes a 412 response to r with the given message
+func PreconditionFailed(w http.ResponseWriter, r *http.Request, msg string) {
+	WriteError(w, r, http.StatusPreconditionFailed, msg)
+}
+
+// NotModified reports whether a GET of the document can be answered with 304 because of its If-None-Match header
+func NotModified(r *http.Request, version uint64) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	return ifNoneMatch != "" && matchETag(ifNoneMatch, version, true)
+}
+
+// matchETag reports whether the value of an If-Match or If-None-Match header, a list of entity tags or "*",
+// matches the version. With weak, weak tags are compared like strong ones, as for If-None-Match; otherwise
+// a weak tag never matches, as If-Match requires (RFC 7232, section 3.1)
+func matchETag(header string, version uint64, weak bool) bool {
+	etag := ETag(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package docAndColl
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/validator"
+)
+
+// Violation is a stored document that does not conform to a schema, and why
+type Violation struct {
+	Path   string                `json:"path"`
+	Errors []validator.Violation `json:"errors"`
+}
+
+// SchemaReport is the response to a schema update: the documents it was checked against and the ones that
+// do not conform. Applied is false for a dry run and for an update that was refused
+type SchemaReport struct {
+	Path       string      `json:"path"`
+	Version    int         `json:"version"`
+	Applied    bool        `json:"applied"`
+	Checked    int         `json:"checked"`
+	Violations []Violation `json:"violations"`
+}
+
+// schemaStamp is the outcome of checking a stored document against a schema applied after it was written
+type schemaStamp struct {
+	version int
+	invalid bool
+}
+
+// Meta returns the metadata of the document, with the schema version and invalid flag of the last schema it
+// was checked against. The result is a copy whenever the document was stamped, the stored metadata never changes
+func (doc *Document) Meta() *Metadata {
+	stamp := doc.stamp.Load()
+	if stamp == nil {
+		return doc.Metadata
+	}
+	meta := *doc.Metadata
+	meta.SchemaVersion, meta.SchemaInvalid = stamp.version, stamp.invalid
+	return &meta
+}
+
+// governed calls yield with every document of the list, and of the collections below them, that is validated
+// against a schema attached above the list. Collections with a schema of their own are skipped, with everything
+// below them. Returns false if yield asked to stop
+func governed(list *skiplist.List[string, *Document], yield func(*skiplist.List[string, *Document], *Document) bool) bool {
+	now := time.Now()
+	for _, doc := range list.All() {
+		if doc.Expired(now) {
+			continue
+		}
+		if !yield(list, doc) {
+			return false
+		}
+		for _, col := range doc.ColSkipList.All() {
+			if col.Schema.Load() != nil {
+				continue
+			}
+			if !governed(&col.DocSkipList, yield) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CheckDocuments is the dry run of a schema update: it validates the documents the schema would apply to,
+// below the list of documents of the database or collection it is attached to, and changes nothing
+func CheckDocuments(list *skiplist.List[string, *Document], schema *Schema) *SchemaReport {
+	report := &SchemaReport{Path: schema.Path, Version: schema.Version, Violations: []Violation{}}
+	governed(list, func(_ *skiplist.List[string, *Document], doc *Document) bool {
+		report.Checked++
+		if valid, err := validator.Validate(schema.Compiled, doc.Data); !valid {
+			report.Violations = append(report.Violations, Violation{Path: doc.URIPath(), Errors: validator.Violations(err)})
+		}
+		return true
+	})
+	return report
+}
+
+// StampDocuments records the version of a schema that was just applied in the metadata of the documents it
+// applies to. Documents that do not conform keep the version they were written with and are flagged invalid
+// The stamp is kept beside the stored version of the document, not written as a new one, so its sequence
+// number and ETag do not change
+func StampDocuments(r *http.Request, list *skiplist.List[string, *Document], schema *Schema) {
+	governed(list, func(_ *skiplist.List[string, *Document], doc *Document) bool {
+		valid, _ := validator.Validate(schema.Compiled, doc.Data)
+		meta := doc.Meta()
+		stamp := schemaStamp{version: meta.SchemaVersion, invalid: !valid}
+		if valid {
+			stamp.version = schema.Version
+		}
+		if stamp.version == meta.SchemaVersion && stamp.invalid == meta.SchemaInvalid {
+			return true
+		}
+		doc.stamp.Store(&stamp)
+		if !valid {
+			slog.DebugContext(r.Context(), "flagged document invalid against schema", "path", doc.URIPath(), "schema", schema.Path, "version", schema.Version)
+		}
+		return true
+	})
+}
+
+// ReportFormat writes a schema report with the given status
+func ReportFormat(w http.ResponseWriter, status int, report *SchemaReport) {
+	jsonData, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		WriteError(w, nil, http.StatusInternalServerError, "unable to marshal schema report")
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
@@ -0,0 +1,108 @@
+package docAndColl
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HistoryLimit is the number of prior versions kept for every document. Zero keeps no history
+var HistoryLimit = 10
+
+// Revision is one version of a document: its number, counting from 1 for the version that created
+// the document, and the body and metadata it had
+type Revision struct {
+	Number   int
+	Data     []byte
+	Metadata *Metadata
+}
+
+// RevisionFormat is the information marshalled for one version of a document
+type RevisionFormat struct {
+	Version int         `json:"version"`
+	Path    string      `json:"path"`
+	Doc     interface{} `json:"doc"`
+	Meta    *Metadata   `json:"meta"`
+}
+
+// Succeeds makes the document the next version of prev: it gets the next revision number and
+// keeps prev and its own history, up to HistoryLimit versions
+func (doc *Document) Succeeds(prev *Document) {
+	doc.RevisionNumber = prev.RevisionNumber + 1
+
+	history := append([]Revision{{prev.RevisionNumber, prev.Data, prev.Meta()}}, prev.History...)
+	if limit := max(HistoryLimit, 0); len(history) > limit {
+		history = history[:limit]
+	}
+	// never share the backing array with prev, older documents may still be read
+	doc.History = append([]Revision(nil), history...)
+}
+
+// GetRevision returns the version of the document with the given number, if it is the current one or still retained
+func (doc *Document) GetRevision(number int) (Revision, bool) {
+	if number == doc.RevisionNumber {
+		return Revision{doc.RevisionNumber, doc.Data, doc.Meta()}, true
+	}
+	for _, rev := range doc.History {
+		if rev.Number == number {
+			return rev, true
+		}
+	}
+	return Revision{}, false
+}
+
+// formats a version of the document for the response writer
+func (doc *Document) revisionFormat(r *http.Request, rev Revision) RevisionFormat {
+	var data any
+	if err := json.Unmarshal(rev.Data, &data); err != nil {
+		slog.ErrorContext(r.Context(), "unable to unmarshal data", "error", err)
+	}
+	var jsonMap map[string]string
+	json.Unmarshal(doc.URI, &jsonMap)
+	parts := strings.Split(jsonMap["uri"], "/")
+	return RevisionFormat{
+		Version: rev.Number,
+		Path:    "/" + strings.Join(parts[3:], "/"),
+		Doc:     data,
+		Meta:    rev.Metadata,
+	}
+}
+
+// HistoryFormat writes the current version of the document and its retained prior versions, newest first
+func (doc *Document) HistoryFormat(w http.ResponseWriter, r *http.Request) {
+	revisions := func(yield func(RevisionFormat) bool) {
+		if !yield(doc.revisionFormat(r, Revision{doc.RevisionNumber, doc.Data, doc.Meta()})) {
+			return
+		}
+		for _, rev := range doc.History {
+			if !yield(doc.revisionFormat(r, rev)) {
+				return
+			}
+		}
+	}
+	WriteJSONArray(w, revisions)
+}
+
+// VersionFormat writes the version of the document given by the version query parameter
+func (doc *Document) VersionFormat(w http.ResponseWriter, r *http.Request, version string) {
+	number, err := strconv.Atoi(version)
+	if err != nil {
+		WriteError(w, r, http.StatusBadRequest, "invalid version "+version)
+		return
+	}
+	rev, ok := doc.GetRevision(number)
+	if !ok {
+		WriteError(w, r, http.StatusNotFound, "version "+version+" of document "+doc.Name+" is not retained")
+		return
+	}
+
+	jsonData, err := json.MarshalIndent(doc.revisionFormat(r, rev), "", "  ")
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, "unable to marshal document "+doc.Name)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
@@ -0,0 +1,94 @@
+package docAndColl
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// notifyKey identifies one resource watched by one set of subscribers
+type notifyKey struct {
+	subscribers *sync.Map
+	path        string
+}
+
+// pendingEvent is the latest event held back for a resource while a batch runs
+type pendingEvent struct {
+	event string
+	doc   *Document
+}
+
+// Batch collects the subscriber notifications of several writes so each affected resource is
+// notified once, with its final state, when the batch is flushed
+type Batch struct {
+	mu     sync.Mutex
+	order  []notifyKey
+	events map[notifyKey]pendingEvent
+	// subscribers whose streams are closed once the events are sent
+	closes []*sync.Map
+}
+
+// batchContextKey is the context key under which the batch of a request is stored
+type batchContextKey struct{}
+
+// WithBatch returns a context that makes every Notify call of a request using it wait for the returned batch
+func WithBatch(ctx context.Context) (context.Context, *Batch) {
+	batch := &Batch{events: make(map[notifyKey]pendingEvent)}
+	return context.WithValue(ctx, batchContextKey{}, batch), batch
+}
+
+// Notify updates the subscribers about an event on the resource at path. If the request is part of a batch,
+// the event replaces any earlier event on the same resource and is only sent when the batch is flushed
+func Notify(r *http.Request, path string, subscribers *sync.Map, event string, doc *Document) {
+	if subscribers == nil {
+		return
+	}
+	if r == nil {
+		Update_subscribers(r, path, subscribers, event, doc)
+		return
+	}
+	batch, ok := r.Context().Value(batchContextKey{}).(*Batch)
+	if !ok {
+		Update_subscribers(r, path, subscribers, event, doc)
+		return
+	}
+
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+	key := notifyKey{subscribers, path}
+	if _, seen := batch.events[key]; !seen {
+		batch.order = append(batch.order, key)
+	}
+	batch.events[key] = pendingEvent{event, doc}
+}
+
+// Flush sends the collected events of the batch request r, one per resource and in the order the resources were first touched
+func (batch *Batch) Flush(r *http.Request) {
+	batch.mu.Lock()
+	order, events, closes := batch.order, batch.events, batch.closes
+	batch.order, batch.events, batch.closes = nil, make(map[notifyKey]pendingEvent), nil
+	batch.mu.Unlock()
+
+	for _, key := range order {
+		pending := events[key]
+		Update_subscribers(r, key.path, key.subscribers, pending.event, pending.doc)
+	}
+	for _, subscribers := range closes {
+		closeSubscribers(subscribers)
+	}
+}
+
+// contextOf returns the context of r, or the background context for work no request asked for
+func contextOf(r *http.Request) context.Context {
+	if r == nil {
+		return context.Background()
+	}
+	return r.Context()
+}
+
+// Discard drops the collected events without sending them, e.g. because the writes were rolled back
+func (batch *Batch) Discard() {
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+	batch.order, batch.events, batch.closes = nil, make(map[notifyKey]pendingEvent), nil
+}
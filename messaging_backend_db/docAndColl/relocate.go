@@ -0,0 +1,66 @@
+package docAndColl
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
+)
+
+// marshals a path the way URIs are stored
+func marshalURI(path string) []byte {
+	jsonData, _ := json.MarshalIndent(map[string]string{"uri": path}, "", "  ")
+	return jsonData
+}
+
+// URIPath returns the path of the collection, e.g. /v1/db/doc/col/
+func (col *Collection) URIPath() string {
+	var jsonMap map[string]string
+	json.Unmarshal(col.URI, &jsonMap)
+	return jsonMap["uri"]
+}
+
+// CopyTo returns a copy of the document and of every collection below it, stored at the given path
+// The data, metadata and history are kept, the uris of the whole subtree are rewritten for the new path
+// The copy has no subscribers, they are watching the original path, and its metadata and history are its own
+func (doc *Document) CopyTo(path string, name string) *Document {
+	copied := NewDocument(name, doc.Data)
+	copied.URI = marshalURI(path)
+	metadata := *doc.Meta()
+	copied.Metadata = &metadata
+	copied.RevisionNumber = doc.RevisionNumber
+	copied.History = slices.Clone(doc.History)
+	for colName, col := range doc.ColSkipList.All() {
+		copiedCol := col.CopyTo(path+"/"+colName+"/", colName)
+		copied.ColSkipList.Upsert(colName, func(string, *Collection, bool) (*Collection, error) { return copiedCol, nil })
+	}
+	return &copied
+}
+
+// CopyTo returns a copy of the collection and of every document below it, stored at the given path
+// The metadata, retention policy and schema are kept, the uris of the whole subtree are rewritten for the new path
+func (col *Collection) CopyTo(path string, name string) *Collection {
+	metadata := *col.Metadata
+	copied := &Collection{
+		Name:        name,
+		Metadata:    &metadata,
+		URI:         marshalURI(path),
+		DocSkipList: skiplist.NewList[string, *Document]("", "zzz"),
+	}
+	copied.Retention.Store(col.Retention.Load())
+	if schema := col.Schema.Load(); schema != nil {
+		moved := *schema
+		moved.Path = path
+		copied.Schema.Store(&moved)
+	}
+	now := time.Now()
+	for docName, doc := range col.DocSkipList.All() {
+		if doc.Expired(now) {
+			continue
+		}
+		copiedDoc := doc.CopyTo(path+docName, docName)
+		copied.DocSkipList.Upsert(docName, func(string, *Document, bool) (*Document, error) { return copiedDoc, nil })
+	}
+	return copied
+}
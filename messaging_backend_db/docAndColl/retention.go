@@ -0,0 +1,188 @@
+package docAndColl
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
+)
+
+// RetentionPolicy bounds the documents kept in a collection or database: only the MaxDocuments most recently
+// created documents are kept, and only documents created less than MaxAge ago. A zero bound does not apply
+// Documents dropped by the policy are removed like deleted ones, and their subscribers get the delete event
+type RetentionPolicy struct {
+	MaxDocuments int    `json:"maxDocuments,omitempty"`
+	MaxAge       string `json:"maxAge,omitempty"`
+	maxAge       time.Duration
+}
+
+// ParseRetentionPolicy takes in the body of a PUT ...?mode=retention request, e.g. {"maxDocuments": 100, "maxAge": "24h"}
+// Returns a nil policy for an empty one, which removes the policy
+func ParseRetentionPolicy(desc []byte) (*RetentionPolicy, error) {
+	var policy RetentionPolicy
+	if err := json.Unmarshal(desc, &policy); err != nil {
+		return nil, fmt.Errorf("invalid retention policy: %w", err)
+	}
+	if policy.MaxDocuments < 0 {
+		return nil, fmt.Errorf("invalid retention policy: maxDocuments must not be negative")
+	}
+	if policy.MaxAge != "" {
+		maxAge, err := time.ParseDuration(policy.MaxAge)
+		if err != nil || maxAge <= 0 {
+			return nil, fmt.Errorf("invalid retention policy: maxAge %q is not a positive duration", policy.MaxAge)
+		}
+		policy.maxAge = maxAge
+	}
+	if policy.MaxDocuments == 0 && policy.maxAge == 0 {
+		return nil, nil
+	}
+	return &policy, nil
+}
+
+// RetentionFormat writes the policy, or an empty object if there is none
+func RetentionFormat(w http.ResponseWriter, policy *RetentionPolicy) {
+	if policy == nil {
+		policy = &RetentionPolicy{}
+	}
+	jsonData, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		WriteError(w, nil, http.StatusInternalServerError, "unable to marshal retention policy")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// Prune removes the documents of the list the policy does not keep and returns them
+// A nil policy keeps every document
+func (policy *RetentionPolicy) Prune(list *skiplist.List[string, *Document], now time.Time) []*Document {
+	if policy == nil {
+		return nil
+	}
+
+	var live, dropped []*Document
+	for _, doc := range list.All() {
+		if doc.Expired(now) {
+			continue
+		}
+		if policy.maxAge > 0 && doc.Metadata.CreatedAt <= now.Add(-policy.maxAge).UnixMilli() {
+			dropped = append(dropped, doc)
+		} else {
+			live = append(live, doc)
+		}
+	}
+	if policy.MaxDocuments > 0 && len(live) > policy.MaxDocuments {
+		// oldest first, so the extra documents are at the front
+		slices.SortFunc(live, func(a, b *Document) int {
+			return cmp.Or(cmp.Compare(a.Metadata.CreatedAt, b.Metadata.CreatedAt), cmp.Compare(a.Name, b.Name))
+		})
+		dropped = append(dropped, live[:len(live)-policy.MaxDocuments]...)
+	}
+
+	removed := dropped[:0]
+	for _, doc := range dropped {
+		// only the version that was dropped is removed, a document written in the meantime stays
+		if _, ok := list.RemoveIf(doc.Name, func(curr *Document) bool { return curr == doc }); ok {
+			removed = append(removed, doc)
+		}
+	}
+	return removed
+}
+
+// Retainer is a database or collection, whose documents are bounded by its retention policy
+type Retainer interface {
+	EnforceRetention(r *http.Request, now time.Time) int
+}
+
+// PendingRetention holds the databases and collections a transaction wrote to. Their retention policies are only
+// enforced once the transaction commits, so rolling it back never has to bring back pruned documents
+type PendingRetention struct {
+	mu        sync.Mutex
+	retainers []Retainer
+	done      bool
+}
+
+// pendingRetentionContextKey is the context key under which the pending retention of a transaction is stored
+type pendingRetentionContextKey struct{}
+
+// WithPendingRetention returns a context that makes the retention enforced for a request using it wait for the
+// returned PendingRetention
+func WithPendingRetention(ctx context.Context) (context.Context, *PendingRetention) {
+	pending := new(PendingRetention)
+	return context.WithValue(ctx, pendingRetentionContextKey{}, pending), pending
+}
+
+// Deferred reports whether the retention of the database or collection is left to the transaction of the request,
+// and if so remembers it, to be enforced when the transaction commits
+func Deferred(r *http.Request, retainer Retainer) bool {
+	if r == nil {
+		return false
+	}
+	pending, ok := r.Context().Value(pendingRetentionContextKey{}).(*PendingRetention)
+	if !ok {
+		return false
+	}
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	if pending.done {
+		return false
+	}
+	if !slices.Contains(pending.retainers, retainer) {
+		pending.retainers = append(pending.retainers, retainer)
+	}
+	return true
+}
+
+// Enforce enforces the retention policies that were held back, with the request that committed the transaction
+// Returns how many documents were removed
+func (pending *PendingRetention) Enforce(r *http.Request, now time.Time) int {
+	pending.mu.Lock()
+	retainers := pending.retainers
+	pending.retainers, pending.done = nil, true
+	pending.mu.Unlock()
+
+	pruned := 0
+	for _, retainer := range retainers {
+		pruned += retainer.EnforceRetention(r, now)
+	}
+	return pruned
+}
+
+// EnforceRetention removes the documents of the collection its retention policy does not keep
+// Subscribers of the collection and of everything removed get the delete event, coalesced with the request if there is one
+// Within a transaction, nothing is removed until it commits
+func (col *Collection) EnforceRetention(r *http.Request, now time.Time) int {
+	if Deferred(r, col) {
+		return 0
+	}
+	pruned := col.Retention.Load().Prune(&col.DocSkipList, now)
+	for _, doc := range pruned {
+		Notify(r, doc.URIPath(), &col.Subscribers, "delete", doc)
+		doc.Removed(r)
+	}
+	return len(pruned)
+}
+
+// SweepRetention enforces the retention policies of the collection and of every collection below it
+func (col *Collection) SweepRetention(now time.Time) int {
+	pruned := col.EnforceRetention(nil, now)
+	for _, doc := range col.DocSkipList.All() {
+		pruned += doc.SweepRetention(now)
+	}
+	return pruned
+}
+
+// SweepRetention enforces the retention policies of every collection of the document
+func (doc *Document) SweepRetention(now time.Time) int {
+	pruned := 0
+	for _, col := range doc.ColSkipList.All() {
+		pruned += col.SweepRetention(now)
+	}
+	return pruned
+}
@@ -0,0 +1,70 @@
+package docAndColl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/santhosh-tekuri/jsonschema"
+)
+
+// Schema is a JSON schema attached to a database or collection. Documents are validated against the schema
+// of their nearest ancestor that has one, or against the global schema given with -s if none does
+type Schema struct {
+	// where the schema is attached, e.g. /v1/db/doc/col/, or "global"
+	Path     string
+	Source   json.RawMessage
+	Compiled *jsonschema.Schema
+	// counts the schemas attached at Path, starting at 1. The global schema is version 0
+	Version int
+}
+
+// SchemaFormat is the information marshalled for the schema that applies at a path
+type SchemaFormat struct {
+	Path    string          `json:"path"`
+	Version int             `json:"version,omitempty"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+// CompileSchema takes in the source of a JSON schema, the path it is attached to and its version there and compiles it
+func CompileSchema(path string, source []byte, version int) (*Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	location := "owldb://schema" + path
+	if err := compiler.AddResource(location, bytes.NewReader(source)); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	compiled, err := compiler.Compile(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return &Schema{Path: path, Source: json.RawMessage(bytes.TrimSpace(source)), Compiled: compiled, Version: version}, nil
+}
+
+// GlobalSchema wraps the schema compiled from the -s flag. Its source is read back from the file it was compiled from
+func GlobalSchema(compiled *jsonschema.Schema) *Schema {
+	schema := &Schema{Path: "global", Source: json.RawMessage("{}"), Compiled: compiled}
+	if compiled == nil {
+		return schema
+	}
+	// the url of a schema compiled from a file is its path, or a file url
+	if location, err := url.Parse(compiled.URL); err == nil && (location.Scheme == "" || location.Scheme == "file") {
+		if source, err := os.ReadFile(location.Path); err == nil {
+			schema.Source = json.RawMessage(bytes.TrimSpace(source))
+		}
+	}
+	return schema
+}
+
+// SchemaFormat writes the schema and where it is attached
+func (schema *Schema) SchemaFormat(w http.ResponseWriter) {
+	jsonData, err := json.MarshalIndent(SchemaFormat{Path: schema.Path, Version: schema.Version, Schema: schema.Source}, "", "  ")
+	if err != nil {
+		WriteError(w, nil, http.StatusInternalServerError, "unable to marshal schema")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
@@ -0,0 +1,180 @@
+package docAndColl
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// subscription is one open event stream. Events and keep-alives are written under its lock, and nothing is
+// written once it is closed, so a stream that ends is never written to by a late notification
+type subscription struct {
+	mu     sync.Mutex
+	wf     writeFlusher
+	done   chan struct{}
+	closed bool
+}
+
+// writes data to the stream unless it is closed
+func (sub *subscription) send(data []byte) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.wf.Write(data)
+	sub.wf.Flush()
+}
+
+// ends the stream, the request serving it returns
+func (sub *subscription) close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.done)
+	}
+}
+
+// Drain tracks the open event streams of a server, so they can be ended when it shuts down
+type Drain struct {
+	mu       sync.Mutex
+	streams  map[*subscription]struct{}
+	draining bool
+}
+
+// drainContextKey is the context key under which the drain of the server serving a request is stored
+type drainContextKey struct{}
+
+// NewDrain returns a drain without streams
+func NewDrain() *Drain {
+	return &Drain{streams: make(map[*subscription]struct{})}
+}
+
+// WithDrain returns a context that makes the event streams of requests using it tracked by drain
+// It is meant to be the base context of a server, see http.Server.BaseContext
+func WithDrain(ctx context.Context, drain *Drain) context.Context {
+	return context.WithValue(ctx, drainContextKey{}, drain)
+}
+
+// Shutdown sends every subscriber a shutdown event, so clients reconnect elsewhere, and ends the streams
+// Streams opened afterwards get the event and end at once. It is meant to be registered with
+// http.Server.RegisterOnShutdown, as the server waits for its requests, and a stream never finishes by itself
+func (drain *Drain) Shutdown() {
+	drain.mu.Lock()
+	drain.draining = true
+	streams := drain.streams
+	drain.streams = make(map[*subscription]struct{})
+	drain.mu.Unlock()
+
+	event := shutdownEvent()
+	for sub := range streams {
+		sub.send(event)
+		sub.close()
+	}
+}
+
+// track adds the stream of a request to the drain of its server, if it has one. Returns false if the
+// server is shutting down, and the stream got the shutdown event and should end
+func track(r *http.Request, sub *subscription) bool {
+	drain, ok := r.Context().Value(drainContextKey{}).(*Drain)
+	if !ok {
+		return true
+	}
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+	if drain.draining {
+		sub.send(shutdownEvent())
+		return false
+	}
+	drain.streams[sub] = struct{}{}
+	return true
+}
+
+// untrack removes an ended stream from the drain of its server
+func untrack(r *http.Request, sub *subscription) {
+	if drain, ok := r.Context().Value(drainContextKey{}).(*Drain); ok {
+		drain.mu.Lock()
+		delete(drain.streams, sub)
+		drain.mu.Unlock()
+	}
+}
+
+// the event telling a subscriber the server is going away, formatted like the events of Update_subscribers
+func shutdownEvent() []byte {
+	return []byte(fmt.Sprintf("event: shutdown\ndata: server shutting down\nid: %d\n\n\n", time.Now().UnixNano()))
+}
+
+// deliver writes an event to one subscriber of a subscriber map
+func deliver(key, value any, data []byte) {
+	if sub, ok := value.(*subscription); ok {
+		sub.send(data)
+	} else if wf, ok := key.(writeFlusher); ok {
+		wf.Write(data)
+		wf.Flush()
+	}
+}
+
+// closeSubscribers ends every stream of the subscriber map and forgets them
+func closeSubscribers(subscribers *sync.Map) {
+	subscribers.Range(func(key, _ any) bool {
+		if value, loaded := subscribers.LoadAndDelete(key); loaded {
+			if sub, ok := value.(*subscription); ok {
+				sub.close()
+			}
+		}
+		return true
+	})
+}
+
+// Close ends the event streams of the subscribers, after the events notified before. If the request is
+// part of a batch, the streams are only closed when the batch is flushed
+func Close(r *http.Request, subscribers *sync.Map) {
+	if subscribers == nil {
+		return
+	}
+	if r != nil {
+		if batch, ok := r.Context().Value(batchContextKey{}).(*Batch); ok {
+			batch.mu.Lock()
+			batch.closes = append(batch.closes, subscribers)
+			batch.mu.Unlock()
+			return
+		}
+	}
+	closeSubscribers(subscribers)
+}
+
+// Removed tells the subscribers of the document, and of every collection and document below it, that it
+// was removed, and then closes their streams. A removed subtree is never written again, so its
+// subscriptions are released with it
+func (doc *Document) Removed(r *http.Request) {
+	for _, col := range doc.ColSkipList.All() {
+		col.Removed(r)
+	}
+	Notify(r, doc.URIPath(), doc.Subscribers, "delete", doc)
+	Close(r, doc.Subscribers)
+}
+
+// Added tells the subscribers of where the document was put back or relocated to, e.g. its collection, that it is there
+func (doc *Document) Added(r *http.Request, subscribers *sync.Map) {
+	Notify(r, doc.URIPath(), subscribers, "update", doc)
+}
+
+// CollectionAdded tells the subscribers of the document that a collection was put back or relocated under it,
+// with an update event for the document itself. The documents of the collection are not announced, a document
+// subscription is about the document
+func (doc *Document) CollectionAdded(r *http.Request) {
+	Notify(r, doc.URIPath(), doc.Subscribers, "update", doc)
+}
+
+// Removed tells the subscribers of the collection, and of every document and collection below it, that it
+// was removed, and then closes their streams
+func (col *Collection) Removed(r *http.Request) {
+	for _, doc := range col.DocSkipList.All() {
+		doc.Removed(r)
+	}
+	Notify(r, col.URIPath(), &col.Subscribers, "delete", nil)
+	Close(r, &col.Subscribers)
+}
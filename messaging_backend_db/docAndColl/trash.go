@@ -0,0 +1,106 @@
+package docAndColl
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrashRetention is how long deleted documents, collections and databases stay in the trash before they are purged
+var TrashRetention = 24 * time.Hour
+
+// TrashEntry is a deleted document, collection or database. Path is the path of a document or collection within its
+// database, e.g. "/doc/col/", or the name of a deleted database
+type TrashEntry struct {
+	Path      string `json:"path"`
+	Kind      string `json:"kind"`
+	DeletedBy string `json:"deletedBy"`
+	DeletedAt int64  `json:"deletedAt"`
+	// the deleted *Document, *Collection or database, restored as is
+	Item any `json:"-"`
+}
+
+// TrashPath returns the path of the document or collection a request deletes, relative to its database
+func TrashPath(r *http.Request) string {
+	parts := strings.SplitN(r.URL.Path, "/", 4)
+	if len(parts) < 4 {
+		return "/"
+	}
+	return "/" + parts[3]
+}
+
+// Trash keeps deleted items until they are restored or purged. Each database has one for its documents and
+// collections, and the database host has one for databases
+type Trash struct {
+	mu      sync.Mutex
+	entries []*TrashEntry
+}
+
+// Add puts a deleted item into the trash
+func (trash *Trash) Add(path string, kind string, deletedBy string, item any) {
+	trash.mu.Lock()
+	defer trash.mu.Unlock()
+	trash.entries = append(trash.entries, &TrashEntry{
+		Path:      path,
+		Kind:      kind,
+		DeletedBy: deletedBy,
+		DeletedAt: time.Now().UnixMilli(),
+		Item:      item,
+	})
+}
+
+// Take removes the most recently deleted item at path from the trash and returns it
+func (trash *Trash) Take(path string) (*TrashEntry, bool) {
+	trash.mu.Lock()
+	defer trash.mu.Unlock()
+	for i := len(trash.entries) - 1; i >= 0; i-- {
+		if entry := trash.entries[i]; entry.Path == path {
+			trash.entries = append(trash.entries[:i:i], trash.entries[i+1:]...)
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// Put gives back an entry that was taken but could not be restored
+func (trash *Trash) Put(entry *TrashEntry) {
+	trash.mu.Lock()
+	defer trash.mu.Unlock()
+	trash.entries = append(trash.entries, entry)
+}
+
+// Purge drops the items that were deleted more than TrashRetention ago. Returns how many were dropped
+func (trash *Trash) Purge(now time.Time) int {
+	cutoff := now.Add(-TrashRetention).UnixMilli()
+	trash.mu.Lock()
+	defer trash.mu.Unlock()
+	kept := trash.entries[:0]
+	for _, entry := range trash.entries {
+		if entry.DeletedAt > cutoff {
+			kept = append(kept, entry)
+		}
+	}
+	purged := len(trash.entries) - len(kept)
+	clear(trash.entries[len(kept):])
+	trash.entries = kept
+	return purged
+}
+
+// TrashFormat writes the items in the trash, oldest deletion first
+func (trash *Trash) TrashFormat(w http.ResponseWriter) {
+	trash.mu.Lock()
+	entries := make([]TrashEntry, len(trash.entries))
+	for i, entry := range trash.entries {
+		entries[i] = *entry
+	}
+	trash.mu.Unlock()
+
+	WriteJSONArray(w, func(yield func(TrashEntry) bool) {
+		for _, entry := range entries {
+			if !yield(entry) {
+				return
+			}
+		}
+	})
+}
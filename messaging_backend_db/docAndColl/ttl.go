@@ -0,0 +1,99 @@
+package docAndColl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TTLField is the reserved top level field of a document body that sets its time to live, like the ttl query
+// parameter. It is removed from the body before the document is validated and stored
+const TTLField = "_ttl"
+
+// ParseTTL takes in a write request and its body and returns the body without TTLField and the time the
+// document expires at, in milliseconds, or zero if it does not expire. The ttl query parameter takes
+// precedence over the field. A ttl is a duration like "30s" or "5m", or a number of seconds
+func ParseTTL(r *http.Request, desc []byte) ([]byte, int64, error) {
+	ttl := r.URL.Query().Get("ttl")
+
+	if bytes.Contains(desc, []byte(`"`+TTLField+`"`)) {
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(desc, &body); err == nil {
+			if field, ok := body[TTLField]; ok {
+				delete(body, TTLField)
+				stripped, err := json.Marshal(body)
+				if err != nil {
+					return nil, 0, err
+				}
+				desc = stripped
+				if ttl == "" {
+					var value any
+					json.Unmarshal(field, &value)
+					ttl = fmt.Sprint(value)
+				}
+			}
+		}
+	}
+	if ttl == "" {
+		return desc, 0, nil
+	}
+
+	lifetime, err := time.ParseDuration(ttl)
+	if err != nil {
+		seconds, numErr := strconv.ParseFloat(ttl, 64)
+		if numErr != nil {
+			return nil, 0, fmt.Errorf("invalid ttl %q", ttl)
+		}
+		lifetime = time.Duration(seconds * float64(time.Second))
+	}
+	if lifetime <= 0 {
+		return nil, 0, fmt.Errorf("invalid ttl %q: must be positive", ttl)
+	}
+	return desc, time.Now().Add(lifetime).UnixMilli(), nil
+}
+
+// Expired reports whether the document has a time to live that is over. Expired documents are
+// never served, even before the reaper removes them
+func (doc *Document) Expired(now time.Time) bool {
+	return doc.Metadata != nil && doc.Metadata.ExpiresAt != 0 && doc.Metadata.ExpiresAt <= now.UnixMilli()
+}
+
+// URIPath returns the path of the document, e.g. /v1/db/doc/col/doc
+func (doc *Document) URIPath() string {
+	var jsonMap map[string]string
+	json.Unmarshal(doc.URI, &jsonMap)
+	return jsonMap["uri"]
+}
+
+// ReapExpired removes the expired documents of the collection, and of every collection below it
+// Subscribers of the collection and of everything removed get the delete event. Returns how many documents were removed
+func (col *Collection) ReapExpired(now time.Time) int {
+	reaped := 0
+	for name, doc := range col.DocSkipList.All() {
+		if !doc.Expired(now) {
+			reaped += doc.ReapCollections(now)
+			continue
+		}
+		// only the expired version is removed, a document written in the meantime stays
+		if _, removed := col.DocSkipList.RemoveIf(name, func(curr *Document) bool { return curr == doc }); removed {
+			slog.Debug("reaped expired document", "path", doc.URIPath())
+			Update_subscribers(nil, doc.URIPath(), &col.Subscribers, "delete", doc)
+			doc.Removed(nil)
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// ReapCollections removes the expired documents of every collection of the document
+func (doc *Document) ReapCollections(now time.Time) int {
+	reaped := 0
+	for _, col := range doc.ColSkipList.All() {
+		reaped += col.ReapExpired(now)
+	}
+	return reaped
+}
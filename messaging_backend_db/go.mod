@@ -1,6 +1,6 @@
 module github.com/RICE-COMP318-FALL23/owldb-p1group07
 
-go 1.21.0
+go 1.23
 
 require github.com/santhosh-tekuri/jsonschema v1.2.4
 
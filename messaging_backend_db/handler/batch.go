@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+	"github.com/santhosh-tekuri/jsonschema"
+)
+
+// BatchOp is one operation of a batch request. Path is relative to the database the batch was posted to,
+// e.g. "/doc" or "/doc/col/", and may carry query parameters such as a timestamp. Operations are plain writes
+// of documents and collections: a mode, e.g. a schema or retention update, is not allowed, since a transaction
+// could not roll it back
+type BatchOp struct {
+	Op           string          `json:"op"`
+	Path         string          `json:"path"`
+	Body         json.RawMessage `json:"body,omitempty"`
+	Precondition *Precondition   `json:"precondition,omitempty"`
+}
+
+// BatchResult is the outcome of one operation of a batch request
+type BatchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Takes in the body of a POST /v1/<db>?mode=batch request and applies its PUT, PATCH and DELETE operations in order
+// Each operation runs exactly like its own request would, and the response is an array with one status per operation
+// Subscribers are notified once per affected resource after all operations have run
+func handleBatch(w http.ResponseWriter, r *http.Request, desc []byte, dbName string, owlDB *database_host.Database_host, tokenmap *sync.Map, schema *jsonschema.Schema) {
+	var ops []BatchOp
+	if err := json.Unmarshal(desc, &ops); err != nil {
+		slog.DebugContext(r.Context(), "batch: unable to parse operations", "error", err)
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "invalid batch: body must be an array of operations")
+		return
+	}
+
+	ctx, batch := docAndColl.WithBatch(r.Context())
+	defer batch.Flush(r)
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = runBatchOp(r.WithContext(ctx), op, dbName, owlDB, tokenmap, schema)
+	}
+
+	jsonData, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		docAndColl.WriteError(w, r, http.StatusInternalServerError, "unable to marshal batch results")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// Takes in one operation of a batch or transaction and runs it as its own request, returning its outcome
+// An operation whose precondition does not hold is not run and fails with 412
+func runBatchOp(r *http.Request, op BatchOp, dbName string, owlDB *database_host.Database_host, tokenmap *sync.Map, schema *jsonschema.Schema) BatchResult {
+	rec := &responseRecorder{header: make(http.Header)}
+	sub, err := newBatchRequest(r, op, dbName)
+	if err != nil {
+		docAndColl.WriteError(rec, r, http.StatusBadRequest, err.Error())
+	} else if err := op.Precondition.check(sub.URL.EscapedPath(), owlDB); err != nil {
+		docAndColl.PreconditionFailed(rec, sub, err.Error())
+	} else {
+		serve(rec, sub, owlDB, tokenmap, schema)
+	}
+	return rec.result()
+}
+
+// batchError is an invalid operation in a batch request
+type batchError string
+
+func (err batchError) Error() string {
+	return string(err)
+}
+
+// the headers of a batch request its operations are sent with: they are authorized as the same user and
+// logged under the same request ID. Conditional headers such as If-Match apply to the batch, not to its operations
+var batchHeaders = []string{"Authorization", "Content-Type", "X-Request-ID"}
+
+// Takes in the batch request and one of its operations and builds the request that performs the operation
+// The new request keeps the context of the batch and the headers in batchHeaders
+func newBatchRequest(r *http.Request, op BatchOp, dbName string) (*http.Request, error) {
+	method := strings.ToUpper(op.Op)
+	if method != http.MethodPut && method != http.MethodPatch && method != http.MethodDelete {
+		return nil, batchError("invalid batch operation " + op.Op + ": must be PUT, PATCH or DELETE")
+	}
+	if !strings.HasPrefix(op.Path, "/") || op.Path == "/" {
+		return nil, batchError("invalid batch path " + op.Path + ": must name a resource in the database")
+	}
+
+	target, err := url.Parse("/v1/" + url.PathEscape(dbName) + op.Path)
+	if err != nil {
+		return nil, batchError("invalid batch path " + op.Path)
+	}
+	if _, err := parser.Parse(target.EscapedPath()); err != nil {
+		return nil, batchError("invalid batch path " + op.Path + ": must name a resource in the database")
+	}
+	if target.Query().Has("mode") {
+		return nil, batchError("invalid batch path " + op.Path + ": operations cannot have a mode")
+	}
+
+	sub := r.Clone(r.Context())
+	sub.Header = make(http.Header)
+	for _, key := range batchHeaders {
+		if values := r.Header.Values(key); len(values) > 0 {
+			sub.Header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+	sub.Method = method
+	sub.URL = target
+	sub.RequestURI = target.RequestURI()
+	sub.Body = io.NopCloser(bytes.NewReader(op.Body))
+	sub.ContentLength = int64(len(op.Body))
+	return sub, nil
+}
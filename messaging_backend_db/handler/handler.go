@@ -2,575 +2,566 @@
 package handler
 
 import (
+	"errors"
 	"io"
 	"log/slog"
 	"math/rand"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/authorize"
-	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/cors"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/logging"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/santhosh-tekuri/jsonschema"
 )
 
+// CORS is the policy for cross-origin requests, set from the flags given to the server
+var CORS = cors.Default()
+
 // This is the main fucntion for the handler requests, it determines which method is called, calles differnet functions to parse the body and path
 // it also calls helper methods to change the database, docoments and collumns as well as some general error handling
+// The path is parsed once here, and every method works from the parsed path
+// Every request is counted in the metrics, see metrics.go, and logged once it is served. Its ID, from the
+// X-Request-ID header or generated, is echoed back and carried in its context to every line logged for it
 func HndlRequest(w http.ResponseWriter, r *http.Request, owlDB *database_host.Database_host, tokenmap *sync.Map, schema *jsonschema.Schema) {
+	start := time.Now()
+	id := r.Header.Get("X-Request-ID")
+	if !logging.ValidID(id) {
+		id = logging.NewID()
+	}
+	ctx, req := logging.WithRequest(r.Context(), id)
+	r = r.WithContext(ctx)
+	w.Header().Set("X-Request-ID", id)
+
+	rec := &observed{ResponseWriter: w}
+	defer func() {
+		observe(r, start, rec)
+		slog.LogAttrs(ctx, slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.RequestURI()),
+			slog.Int("status", rec.code()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("user", req.User()))
+	}()
+	serve(rec, r, owlDB, tokenmap, schema)
+}
+
+// serve is HndlRequest without the metrics, for the requests of batches and transactions, which are counted once
+func serve(w http.ResponseWriter, r *http.Request, owlDB *database_host.Database_host, tokenmap *sync.Map, schema *jsonschema.Schema) {
 	// Handle incoming HTTP requests here
 
+	// every response, errors included, carries the CORS headers
+	CORS.Apply(w, r)
+
+	// the description of the api and the metrics are public
+	if r.Method == http.MethodGet && r.URL.Path == openAPIRoute {
+		openAPIFormat(w)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == metricsRoute && ServeMetrics {
+		Metrics(w, r, owlDB)
+		return
+	}
+
 	// Athorize all incoming requests
-	slog.Info("authorize")
 	flag, username := authorize.Authorize(w, r, tokenmap)
 	if !flag {
 		// if flag is false the request couldnt be authorized/authentificated therefore we cant do anything
 		return
 	}
-	slog.Info("after authroize")
-	switch r.Method {
+	logging.FromContext(r.Context()).SetUser(username)
+	if (r.Method == http.MethodPut || r.Method == http.MethodPost || r.Method == http.MethodPatch) && !jsonBody(r) {
+		docAndColl.WriteError(w, r, http.StatusUnsupportedMediaType, "unsupported content type "+r.Header.Get("Content-Type")+": bodies must be JSON")
+		return
+	}
 
-	case http.MethodOptions:
-		slog.Info("IN OPTIONS")
-		w.Header().Set("Allow", "GET,POST,PUT,DELETE,OPTIONS")
-		w.Header().Set("Access-Control-Allow-Origin", "*") // TODO: should patch be added?
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	if r.Method == http.MethodOptions {
+		// the CORS headers of a preflight request are set above
+		w.Header().Set("Allow", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
 		w.WriteHeader(http.StatusOK)
+		return
+	}
 
-	case http.MethodGet:
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		slog.Info("IN GET")
-
-		// call parser to get fields
-		segments, stopPoint := parser.ParseURL(r.URL.Path, false)
-		parse := GetValid(segments, owlDB, stopPoint)
-
-		// CHECK IF MODE IS SUBSCRIBE
-		queryParams := r.URL.Query()
-		mode := queryParams.Get("mode")
-
-		slog.Info("mode is ", mode)
-
-		// finding obj in system to return
-		// should I convert to JSON obj? and how do you return the value
-		if parse.Exist {
-			switch parse.ObjType {
-			case "database":
-				slog.Info("case database")
-				if !hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"bad resource path"`))
-				} else {
-					parse.Database.DatabaseFormat(w, r)
-				}
-			case "document":
-				slog.Info("case doc")
-				if string(mode) == "subscribe" {
-					slog.Info("mode is subcribe")
-					docAndColl.CreateSubscriber(r.URL.Path, w, r, parse.Document.Subscribers)
-				}
-				if hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"bad resource path"`))
-				} else {
-					parse.Document.DocumentFormat(w)
-				}
-			case "collection":
-				slog.Info("case col")
-				if mode == "subscribe" {
-					docAndColl.CreateSubscriber(r.URL.Path, w, r, &parse.Collection.Subscribers)
-				}
-				if !hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"bad resource path"`))
-				} else {
-					parse.Collection.CollectionFormat(w)
-				}
+	// logging in and out
+	if r.URL.Path == "/auth" {
+		switch r.Method {
+		case http.MethodPost:
+			desc, ok := readBody(w, r)
+			if !ok {
+				return
 			}
+			authorize.Authenticate(w, r, desc, tokenmap)
+		case http.MethodDelete:
+			authorize.Delete(w, r, tokenmap)
+		default:
+			w.Header().Set("Allow", "POST,DELETE,OPTIONS")
+			docAndColl.WriteError(w, r, http.StatusMethodNotAllowed, "method "+r.Method+" not allowed")
+		}
+		return
+	}
+
+	path, err := parser.Parse(r.URL.EscapedPath())
+	if err != nil {
+		slog.DebugContext(r.Context(), "bad resource path", "error", err)
+		var pathErr *parser.PathError
+		errors.As(err, &pathErr)
+		// a path into a database that does not exist is not found, whatever its shape
+		if _, exist := owlDB.GetDatabase(pathErr.DB); pathErr.DB != "" && !exist {
+			docAndColl.WriteError(w, r, http.StatusNotFound, pathMessage(r.Method, pathErr.Kind, "not found"))
 		} else {
-			slog.Error("url given does not exist in system")
-
-			if parse.ObjType == "" {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(`"bad resource path"`))
-			} else {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(`"` + parse.ObjType + `"`))
-			}
+			docAndColl.WriteError(w, r, http.StatusBadRequest, pathMessage(r.Method, pathErr.Kind, "bad resource path"))
 		}
+		return
+	}
+	if !routed(r, path) {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "unsupported mode "+r.URL.Query().Get("mode")+" for "+r.Method+" "+routePath(path))
+		return
+	}
 
+	switch r.Method {
+	case http.MethodGet:
+		handleGet(w, r, path, owlDB, schema)
 	case http.MethodPut:
-		slog.Info("IN PUT")
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-
-		// read the body
-		desc, err := io.ReadAll(r.Body)
-		//desc1, err1 := io.ReadAll(r.URL.Path)
-
-		defer r.Body.Close()
-		if err != nil {
-			slog.Error("PUT database: error reading database request", "error", err)
-			http.Error(w, `"invalid database format"`, http.StatusBadRequest)
-			return
-		}
+		handlePut(w, r, path, owlDB, schema, username)
+	case http.MethodPost:
+		handlePost(w, r, path, owlDB, tokenmap, schema, username)
+	case http.MethodDelete:
+		handleDelete(w, r, path, owlDB, username)
+	case http.MethodPatch:
+		handlePatch(w, r, path, owlDB, schema, username)
+	default:
+		w.Header().Set("Allow", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
+		docAndColl.WriteError(w, r, http.StatusMethodNotAllowed, "method "+r.Method+" not allowed")
+	}
+}
 
-		// call parser for putting
-		segments, stopPoint := parser.ParseURL(r.URL.Path, true)
-		parse := PutValid(segments, owlDB, stopPoint)
-		w.Header().Set("Content-Type", "application/json")
-		if parse.Exist {
-			switch parse.ObjType {
-			case "server":
-				slog.Info("validate the database")
-				if hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"unable to create collection: bad resource path"`))
-				} else {
-					owlDB.PutDatabaseIntoServer(owlDB, w, r, parse.Name)
-				}
-			case "database":
-				// this puts doc into db
-				slog.Info("case db")
-				if hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"unable to create document: bad resource path"`))
-				} else {
-					parse.Database.PutDocIntoDatabase(w, r, desc, parse.Name, schema, username, false)
-				}
-			case "document":
-				if !hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"unable to create collection: bad resource path"`))
-				} else {
-					parse.Document.PutColIntoDocument(w, r, parse.Name)
-				}
-
-			case "collection":
-				slog.Info("case coll")
-				if hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"unable to create document: bad resource path"`))
-				} else {
-					parse.Collection.PutDocIntoCollection(w, r, desc, parse.Name, schema, username, false)
-				}
+// Takes in the method of a request, the kind of resource its path was meant to name and what is wrong with
+// the path, and returns the message of the error, e.g. unable to create collection: bad resource path
+func pathMessage(method string, kind string, problem string) string {
+	switch {
+	case kind == "":
+		return problem
+	case method == http.MethodPut && kind == "document" && problem == "not found":
+		// like a put of a document whose parent is not found
+		return "unable to create/replace document: " + problem
+	case method == http.MethodPut:
+		return "unable to create " + kind + ": " + problem
+	case method == http.MethodDelete:
+		return "unable to delete " + kind + ": " + problem
+	}
+	return problem
+}
 
-			}
-		} else {
-			slog.Error("url given does not exist in system")
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(`"` + parse.ObjType + `"`))
-		}
-	case http.MethodPost:
-		slog.Info("IN POST")
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-
-		// read the body
-		desc, err := io.ReadAll(r.Body)
-		//desc1, err1 := io.ReadAll(r.URL.Path)
-
-		defer r.Body.Close()
-		if err != nil {
-			slog.Error("PUT database: error reading database request", "error", err)
-			http.Error(w, `"invalid database format"`, http.StatusBadRequest)
-			return
-		}
+// Takes in a GET request and writes the database, document or collection its path names
+func handleGet(w http.ResponseWriter, r *http.Request, path parser.Path, owlDB *database_host.Database_host, schema *jsonschema.Schema) {
+	w.Header().Set("Content-Type", "application/json")
 
-		// IF POST IS USED FOT AUTHENTIFICATION
-		if r.URL.Path == "/auth" {
-			slog.Info("POST auth")
-			authorize.Authenticate(w, r, desc, tokenmap)
-			return
-		}
+	// a subscription stops holding off transactions once it is set up, the rest once they are written
+	unlock := sync.OnceFunc(lockReads(r, owlDB, path))
+	defer unlock()
 
-		// IF POST IS USED FOT NORMAL OPS --> add logic
-		// Changing to Put because I want the parent. This differentiates between whether the post is happening on a database or a collection
-		slog.Info("POST before parse")
-		segments, stopPoint := parser.ParseURL(r.URL.Path, false)
-		parse := GetValid(segments, owlDB, stopPoint)
-		slog.Info("POST after parse")
-		// is setting the header necessary?
-		w.Header().Set("Content-Type", "application/json")
-
-		// generate random string for post name
-		const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
-		seed := rand.NewSource(time.Now().UnixNano()) // TODO: should i use a random integer as a seed instead of the current time
-		random := rand.New(seed)
-		randString := make([]byte, 14)
-		for i := range randString {
-			randString[i] = charset[random.Intn(len(charset))]
-		}
-		slog.Info("POST exist, ", parse.Exist)
-		// finding obj in system to return
-		if parse.Exist {
-			slog.Info("POST objtype, ", parse.ObjType)
-			// doc has two POST's. One for posting into a database and one for posting into a collection
-			switch parse.ObjType {
-			case "database":
-				// post is essentially a put without a name, NEED TO GENERATE A RANDOM UNIQUE STRING
-				parse.Database.PutDocIntoDatabase(w, r, desc, string(randString), schema, username, false)
-			case "collection":
-				parse.Collection.PutDocIntoCollection(w, r, desc, string(randString), schema, username, false)
-			default:
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(`"document cannot be posted: bad resource path"`))
-			}
+	// every read of the request sees the same consistent state, optionally an older one given by asOf
+	snap, ok := openSnapshot(w, r)
+	if !ok {
+		return
+	}
+	defer snap.Release()
+	w.Header().Set("X-Owldb-Sequence", strconv.FormatUint(snap.Seq(), 10))
 
+	// CHECK IF MODE IS SUBSCRIBE
+	queryParams := r.URL.Query()
+	mode := queryParams.Get("mode")
+
+	if _, ok := path.(parser.ServerPath); ok {
+		// the deleted databases
+		if mode == "trash" {
+			owlDB.Trash.TrashFormat(w)
 		} else {
-			slog.Error("url given does not exist in system")
-
-			if parse.ObjType == "" {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(`"bad resource path"`))
-			} else {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(`"` + parse.ObjType + `"`))
-			}
+			docAndColl.WriteError(w, r, http.StatusBadRequest, "bad resource path")
 		}
+		return
+	}
 
-	case http.MethodDelete:
-		slog.Info("IN DELETE")
-
-		// IF DELETE IS USED FOR DELETING AUTHENTIFICATION
-		if r.URL.Path == "/auth" {
-			authorize.Delete(w, r, tokenmap)
-			return
-		}
+	parse := Resolve(path, owlDB, snap)
+	if !parse.Exist {
+		slog.DebugContext(r.Context(), "url given does not exist in system")
+		docAndColl.WriteError(w, r, http.StatusNotFound, parse.Missing)
+		return
+	}
 
-		// IF DELETE IS USED FOR DELETING MAP DOC COL
-
-		// call parser to get fields
-		segments, stopPoint := parser.ParseURL(r.URL.Path, true)
-		parse := PutValid(segments, owlDB, stopPoint)
-
-		// finding obj in system to Delete and Delete it
-		if parse.Exist {
-			switch parse.ObjType {
-			case "server":
-				// delete the database from the server
-				if hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"unable to delete database: bad resource path"`))
-				} else {
-					slog.Info("Starting delete database from server")
-					owlDB.DeleteDatabase(w, parse.Name)
-				}
-			case "database":
-				// delete the document from the database
-				// check if the docuemnt has a subs
-				if hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"unable to delete document: bad resource path"`))
-				} else {
-					slog.Info("Starting delete document from database")
-					parse.Database.DeleteDocument(w, parse.Name)
-				}
-			case "document":
-				// delete collection from the document
-				// check if the collection has a subs
-				if !hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"unable to delete collection: bad resource path"`))
-				} else {
-					slog.Info("Starting delete collection from doc")
-					parse.Document.DeleteCollection(w, parse.Name)
-				}
-			case "collection":
-				slog.Info("Starting delete doc from collection")
-				// delete document from the collection
-				if hasEndSlash(r.URL.Path) {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte(`"unable to delete document: bad resource path"`))
-				} else {
-					doc := parse.Collection.DeleteDocument(w, parse.Name)
-					// check if the docuemnt has a subs
-					slog.Info("updating collection subscribers about delete event")
-					docAndColl.Update_subscribers(r.URL.Path, &parse.Collection.Subscribers, "delete", doc)
-					slog.Info("updating docuemnt subscribers about delete event")
-					docAndColl.Update_subscribers(r.URL.Path, doc.Subscribers, "delete", doc)
-				}
-			}
+	// the schema documents at the path are validated against
+	if mode == "schema" {
+		schemaFormat(w, path, owlDB, schema)
+		return
+	}
 
+	switch path := path.(type) {
+	case parser.DatabasePath:
+		if !path.Listing {
+			docAndColl.WriteError(w, r, http.StatusBadRequest, "bad resource path")
+		} else if mode == "trash" {
+			parse.Database.Trash.TrashFormat(w)
+		} else if mode == "retention" {
+			docAndColl.RetentionFormat(w, parse.Database.Retention.Load())
 		} else {
-			slog.Error("url given does not exist in system")
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(`"` + parse.ObjType + `"`))
+			parse.Database.DatabaseFormat(w, r, snap)
 		}
-	case http.MethodPatch:
-		// call parser to get fields
-		slog.Info("patch")
-		segments, stopPoint := parser.ParseURL(r.URL.Path, false)
-		parse := GetValid(segments, owlDB, stopPoint)
-		desc, _ := io.ReadAll(r.Body)
-
-		if parse.Exist {
-			if parse.ObjType == "document" {
-				patched_document, _ := parse.Document.Patch(w, r, desc, schema)
-				// call parser for putting
-				segments, stopPoint := parser.ParseURL(r.URL.Path, true)
-				parse := PutValid(segments, owlDB, stopPoint)
-				if parse.Exist {
-					switch parse.ObjType {
-
-					case "database":
-						// this puts doc into db
-						parse.Database.PutDocIntoDatabase(w, r, patched_document, parse.Name, schema, username, true)
-					// updating happens when its put
-					// docAndColl.Update_subscribers(r.URL.Path, parse.Document.Subscribers, "update", parse.Document)
-
-					case "collection":
-						slog.Info("case coll")
-						parse.Collection.PutDocIntoCollection(w, r, patched_document, parse.Name, schema, username, true)
-						// updating happens when its put
-						// docAndColl.Update_subscribers(r.URL.Path, &parse.Collection.Subscribers, "update", parse.Document)
-
-					}
-				} else {
-					slog.Error("url given does not exist in system")
-					w.WriteHeader(http.StatusNotFound)
-					w.Write([]byte(`""document not found:` + parse.ObjType + `"`))
-				}
-
-			} else {
-				slog.Error("url given does not exist in system")
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(`""document not found:` + parse.ObjType + `"`))
-			}
-
+	case parser.DocumentPath:
+		if mode == "subscribe" {
+			// a subscription streams for as long as the client stays, don't hold old versions for it
+			snap.Release()
+			unlock()
+			docAndColl.CreateSubscriber(r.URL.Path, routePath(path), w, r, parse.Document.Subscribers)
+		} else if mode == "history" {
+			parse.Document.HistoryFormat(w, r)
+		} else if version := queryParams.Get("version"); version != "" {
+			parse.Document.VersionFormat(w, r, version)
+		} else if docAndColl.NotModified(r, parse.Version) {
+			w.Header().Set("ETag", docAndColl.ETag(parse.Version))
+			w.WriteHeader(http.StatusNotModified)
 		} else {
-			slog.Error("url given does not exist in system")
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(`"document not found:` + parse.ObjType + `"`))
+			w.Header().Set("ETag", docAndColl.ETag(parse.Version))
+			parse.Document.DocumentFormat(w, r)
+		}
+	case parser.CollectionPath:
+		if mode == "subscribe" {
+			snap.Release()
+			unlock()
+			docAndColl.CreateSubscriber(r.URL.Path, routePath(path), w, r, &parse.Collection.Subscribers)
+		} else if mode == "retention" {
+			docAndColl.RetentionFormat(w, parse.Collection.Retention.Load())
+		} else {
+			parse.Collection.CollectionFormat(w, r, snap)
 		}
-
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("unable to parse url"))
 	}
 }
 
-// helper function that helps with some general error handeling of the path
-func hasEndSlash(path string) bool {
-	r := []rune(path)
-	lastRune := r[len(r)-1]
-	b := false
-	if lastRune == '/' {
-		b = true
+// Takes in a PUT request and creates or replaces the database, document or collection its path names
+func handlePut(w http.ResponseWriter, r *http.Request, path parser.Path, owlDB *database_host.Database_host, schema *jsonschema.Schema, username string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// read the body
+	desc, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	// a schema update locks the database itself, it checks the documents below it
+	if r.URL.Query().Get("mode") == "schema" {
+		handleSchema(w, r, path, desc, owlDB, schema)
+		return
+	}
+
+	defer lockWrites(r, owlDB, path)()
+	if r.URL.Query().Get("mode") == "retention" {
+		handleRetention(w, r, path, desc, owlDB)
+		return
+	}
+
+	switch path := path.(type) {
+	case parser.ServerPath:
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "bad resource path")
+	case parser.DatabasePath:
+		if path.Listing {
+			docAndColl.WriteError(w, r, http.StatusBadRequest, "unable to create collection: bad resource path")
+		} else if dbSchema, ok := creationSchema(w, r, parser.DatabasePath{DB: path.DB, Listing: true}.String(), desc); ok {
+			owlDB.PutDatabaseIntoServer(owlDB, w, r, path.DB, dbSchema)
+		}
+	case parser.DocumentPath:
+		parent := Resolve(path.Parent(), owlDB, nil)
+		if !parent.Exist {
+			slog.DebugContext(r.Context(), "url given does not exist in system")
+			docAndColl.WriteError(w, r, http.StatusNotFound, "unable to create/replace document: "+parent.Missing)
+			return
+		}
+		putDocument(w, r, parent, desc, path.Name(), documentSchema(path, owlDB, schema), username, false)
+	case parser.CollectionPath:
+		parent := Resolve(path.Parent(), owlDB, nil)
+		if !parent.Exist {
+			slog.DebugContext(r.Context(), "url given does not exist in system")
+			docAndColl.WriteError(w, r, http.StatusNotFound, "unable to create collection: "+parent.Missing)
+			return
+		}
+		if colSchema, ok := creationSchema(w, r, path.String(), desc); ok {
+			parent.Document.PutColIntoDocument(w, r, path.Name(), colSchema)
+		}
 	}
-	return b
 }
 
-// Called to see if the parsed URL is valid for a get the database, collection or document
-// this is called when we want to create a get request or generally need an object and want to use the entire get path
-func GetValid(segments []string, server *database_host.Database_host, stopPoint int) *Parsed {
+// Takes in a database or collection and puts a document with the given name and body into it
+func putDocument(w http.ResponseWriter, r *http.Request, parent *Parsed, desc []byte, name string, schema *docAndColl.Schema, username string, patch bool) {
+	switch parent.ObjType {
+	case "database":
+		parent.Database.PutDocIntoDatabase(w, r, desc, name, schema, username, patch)
+	case "collection":
+		parent.Collection.PutDocIntoCollection(w, r, desc, name, schema, username, patch)
+	default:
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "documents can only be put into databases and collections")
+	}
+}
 
-	var prev string
-	var database *database.Database
-	var document *docAndColl.Document
-	var collection *docAndColl.Collection
+// Takes in a POST request and runs the mode it asks for on its path, or posts a document with a random name
+// into the database or collection of the path
+func handlePost(w http.ResponseWriter, r *http.Request, path parser.Path, owlDB *database_host.Database_host, tokenmap *sync.Map, schema *jsonschema.Schema, username string) {
+	w.Header().Set("Content-Type", "application/json")
 
-	//checking to see if there is a slash at the end
+	// read the body
+	desc, ok := readBody(w, r)
+	if !ok {
+		return
+	}
 
-	expecting := "not found"
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "batch", "transaction":
+		// a batch or transaction of writes into the database
+		parse := Resolve(path, owlDB, nil)
+		if !parse.Exist {
+			docAndColl.WriteError(w, r, http.StatusNotFound, parse.Missing)
+		} else if parse.ObjType != "database" {
+			docAndColl.WriteError(w, r, http.StatusBadRequest, mode+" must be posted to a database")
+		} else if mode == "batch" {
+			handleBatch(w, r, desc, parse.Database.Name, owlDB, tokenmap, schema)
+		} else {
+			handleTransaction(w, r, desc, parse.Database, owlDB, tokenmap, schema)
+		}
+		return
+	case "move", "copy":
+		// relocating a document or collection
+		handleMove(w, r, mode, path, owlDB, schema)
+		return
+	}
+	defer lockWrites(r, owlDB, path)()
 
-	for i, word := range segments {
-		slog.Info("word ", word)
-		if i >= stopPoint {
-			break
+	// restoring a deleted database, or a deleted document or collection of a database
+	if mode == "undelete" {
+		if db, ok := path.(parser.DatabasePath); ok {
+			handleUndelete(w, r, db.DB, owlDB)
+		} else {
+			docAndColl.WriteError(w, r, http.StatusBadRequest, "undelete must be posted to a database")
 		}
-		slog.Info(word)
-		if i == 0 || i == 1 {
-			continue
-		} else if i == 2 {
-
-			db, exist := server.GetDatabase(word)
-			database = db
-			prev = "database"
-			if !exist {
-				slog.Info("returning, ", expecting)
-				parse := NewParsed(false, expecting, "", nil, nil, nil)
-				return &parse
-			}
-		} else if word == "" {
-			parse := NewParsed(false, "", "", nil, nil, nil)
-			return &parse
-
-		} else if prev == "database" {
-
-			// following function maybe has error because its a map of ID->doc not Name->doc ??
-			doc, exist := database.GetDocumentFromDatabase(word)
-			document = doc
-			prev = "document"
-			if !exist {
-				expecting = "unable to retrieve document " + word + ": not found"
-				parse := NewParsed(false, expecting, "", nil, nil, nil)
-				return &parse
-			}
-		} else if prev == "document" {
-			col, exist := document.GetCollection(word)
-			collection = col
-			prev = "collection"
-			if !exist {
-				expecting = "unable to retrieve collection " + word + ": not found"
-				parse := NewParsed(false, expecting, "", nil, nil, nil)
-				return &parse
+		return
+	}
 
-			}
-		} else if prev == "collection" {
-			doc, exist := collection.GetDocumentFromCollection(word)
-			document = doc
-			prev = "document"
-			if !exist {
-				expecting = "unable to retrieve document " + word + ": not found"
-				parse := NewParsed(false, expecting, "", nil, nil, nil)
-				return &parse
+	parse := Resolve(path, owlDB, nil)
+	if !parse.Exist {
+		slog.DebugContext(r.Context(), "url given does not exist in system")
+		docAndColl.WriteError(w, r, http.StatusNotFound, parse.Missing)
+		return
+	}
+	docSchema := documentSchema(path, owlDB, schema)
 
-			}
+	// doc has two POST's. One for posting into a database and one for posting into a collection
+	switch path := path.(type) {
+	case parser.DatabasePath, parser.CollectionPath:
+		if db, ok := path.(parser.DatabasePath); ok && !db.Listing {
+			docAndColl.WriteError(w, r, http.StatusBadRequest, "document cannot be posted: bad resource path")
+			return
+		}
+		// post is essentially a put without a name
+		putDocument(w, r, parse, desc, randomName(), docSchema, username, false)
+	case parser.DocumentPath:
+		if mode != "restore" {
+			docAndColl.WriteError(w, r, http.StatusBadRequest, "document cannot be posted: bad resource path")
 		} else {
-			parse := NewParsed(false, expecting, "", nil, nil, nil)
-			return &parse
+			restoreDocument(w, r, path, parse.Document, owlDB, docSchema, username)
 		}
+	default:
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "document cannot be posted: bad resource path")
 	}
-	if prev == "database" {
-		parse := NewParsed(true, "database", "", database, nil, nil)
-		return &parse
-	}
-	if prev == "document" {
-		parse := NewParsed(true, "document", "", nil, document, nil)
-		return &parse
+}
+
+// generates the random name of a posted document
+func randomName() string {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+	seed := rand.NewSource(time.Now().UnixNano()) // TODO: should i use a random integer as a seed instead of the current time
+	random := rand.New(seed)
+	randString := make([]byte, 14)
+	for i := range randString {
+		randString[i] = charset[random.Intn(len(charset))]
 	}
-	if prev == "collection" {
-		parse := NewParsed(true, "collection", "", nil, nil, collection)
-		return &parse
+	return string(randString)
+}
+
+// Takes in a DELETE request and moves the database, document or collection its path names to the trash
+func handleDelete(w http.ResponseWriter, r *http.Request, path parser.Path, owlDB *database_host.Database_host, username string) {
+	defer lockWrites(r, owlDB, path)()
+
+	var parent *Parsed
+	switch path.(type) {
+	case parser.DocumentPath, parser.CollectionPath:
+		parent = Resolve(path.Parent(), owlDB, nil)
+		if !parent.Exist {
+			slog.DebugContext(r.Context(), "url given does not exist in system")
+			docAndColl.WriteError(w, r, http.StatusNotFound, "unable to delete "+path.Kind()+": "+parent.Missing)
+			return
+		}
 	}
-	parse := NewParsed(false, "", "", nil, nil, nil)
-	return &parse
 
+	switch path := path.(type) {
+	case parser.ServerPath:
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "bad resource path")
+	case parser.DatabasePath:
+		// delete the database from the server
+		if path.Listing {
+			docAndColl.WriteError(w, r, http.StatusBadRequest, "unable to delete database: bad resource path")
+		} else {
+			owlDB.DeleteDatabase(w, r, path.DB, username)
+		}
+	case parser.CollectionPath:
+		// delete collection from the document
+		parent.Document.DeleteCollection(w, r, path.Name(), trashOf(owlDB, path.DB), username)
+	case parser.DocumentPath:
+		if parent.ObjType == "database" {
+			parent.Database.DeleteDocument(w, r, path.Name(), username)
+			return
+		}
+		doc := parent.Collection.DeleteDocument(w, r, path.Name(), trashOf(owlDB, path.DB), username)
+		if doc != nil {
+			docAndColl.Notify(r, r.URL.Path, &parent.Collection.Subscribers, "delete", doc)
+			doc.Removed(r)
+		}
+	}
 }
 
-// Checks if the parsed URL is valid when you want to insert a document, collection or database
-// called when you want to get an object to put a request in, there are different error messages seperate from get and
-// process the path in a differnet way such that it returns the pointer to the value that needs to be returned
-func PutValid(segments []string, owlsDB *database_host.Database_host, stopPoint int) *Parsed {
+// Takes in a PATCH request and applies the patches in its body to the document its path names
+func handlePatch(w http.ResponseWriter, r *http.Request, path parser.Path, owlDB *database_host.Database_host, schema *jsonschema.Schema, username string) {
+	desc, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	defer lockWrites(r, owlDB, path)()
 
-	var prev string
-	var database *database.Database
-	var document *docAndColl.Document
-	var collection *docAndColl.Collection
+	parse := Resolve(path, owlDB, nil)
+	if !parse.Exist {
+		slog.DebugContext(r.Context(), "url given does not exist in system")
+		docAndColl.WriteError(w, r, http.StatusNotFound, "document not found: "+parse.Missing)
+		return
+	}
+	if path.Kind() != "document" {
+		slog.DebugContext(r.Context(), "only documents can be patched")
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "unable to patch "+path.Kind()+": only documents can be patched")
+		return
+	}
+	if msg, ok := docAndColl.CheckPreconditions(r, true, parse.Version); !ok {
+		docAndColl.PreconditionFailed(w, r, msg)
+		return
+	}
 
-	if stopPoint == 2 {
-		parse := NewParsed(true, "server", segments[stopPoint], nil, nil, nil)
-		return &parse
+	// the patch response is held back until the patched document is stored, so it can carry the new ETag
+	patchRec := &responseRecorder{header: w.Header()}
+	docSchema := documentSchema(path, owlDB, schema)
+	patched_document, err := parse.Document.Patch(patchRec, r, desc, docSchema.Compiled)
+	if err != nil {
+		patchRec.copyTo(w)
+		return
 	}
-	expecting := ""
-	if stopPoint%2 == 0 {
-		expecting = "unable to create collection: "
 
+	// the put only writes a response if storing the patched document fails
+	putRec := &responseRecorder{header: w.Header()}
+	parent := Resolve(path.Parent(), owlDB, nil)
+	if !parent.Exist {
+		slog.DebugContext(r.Context(), "url given does not exist in system")
+		docAndColl.WriteError(w, r, http.StatusNotFound, "document not found: "+parent.Missing)
+		return
+	}
+	// updating subscribers happens when its put
+	putDocument(putRec, r, parent, patched_document, path.Name(), docSchema, username, true)
+	if putRec.status != 0 {
+		putRec.copyTo(w)
 	} else {
-		expecting = "unable to create/replace document: "
+		patchRec.copyTo(w)
 	}
+}
 
-	for i, word := range segments {
-		if i >= stopPoint {
-			break
-		}
-		if i == 0 || i == 1 {
-			continue
-		} else if i == 2 {
-			tempdb, exist := owlsDB.GetDatabase(word)
-			//database = *tempdb
-			database = tempdb
-			prev = "database"
-			if !exist {
-				slog.Info("database DNE")
-				expecting += "not found"
-				parse := NewParsed(false, expecting, "", nil, nil, nil)
-				return &parse
-			}
-		} else if prev == "database" {
-			doc, exist := database.GetDocumentFromDatabase(word)
-			//document = *doc
-			document = doc
-			prev = "document"
-			if !exist {
-				expecting += "unable to retrieve document " + word + ": not found"
-				parse := NewParsed(false, expecting, "", nil, nil, nil)
-				return &parse
-			}
-		} else if prev == "document" {
-			col, exist := document.GetCollection(word)
-			//collection = *col
-			collection = col
-			prev = "collection"
-			if !exist {
-				expecting += "unable to retrieve collection " + word + ": not found"
-				parse := NewParsed(false, expecting, "", nil, nil, nil)
-				return &parse
-			}
-		} else if prev == "collection" {
-			doc, exist := collection.GetDocumentFromCollection(word)
-			//document = *doc
-			document = doc
-			prev = "document"
-			if !exist {
-				expecting += "unable to retrieve document " + word + ": not found"
-				parse := NewParsed(false, expecting, "", nil, nil, nil)
-				return &parse
-			}
-		} else {
-			parse := NewParsed(false, "", "", nil, nil, nil)
-			return &parse
-		}
-	}
-	if prev == "database" {
-		slog.Info("returning a database from parseURLPut")
-		parse := NewParsed(true, "database", segments[stopPoint], database, nil, nil)
-		//parse := NewParsed(true, "database", segments[b], &database, nil, nil)
-		return &parse
+// Takes in a POST ...?mode=restore&version=N request on a document and writes version N back as a new version
+// The restore is a PUT of the old body, so it is validated, conditional and notified like any other write
+func restoreDocument(w http.ResponseWriter, r *http.Request, path parser.DocumentPath, doc *docAndColl.Document, owlDB *database_host.Database_host, schema *docAndColl.Schema, username string) {
+	version := r.URL.Query().Get("version")
+	number, err := strconv.Atoi(version)
+	if err != nil {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "invalid version "+version)
+		return
 	}
-	if prev == "document" {
-		slog.Info("returning a document from parseURLPut")
-		parse := NewParsed(true, "document", segments[stopPoint], nil, document, nil)
-		//parse := NewParsed(true, "document", segments[b], nil, &document, nil)
-		return &parse
+	rev, ok := doc.GetRevision(number)
+	if !ok {
+		docAndColl.WriteError(w, r, http.StatusNotFound, "version "+version+" of document "+doc.Name+" is not retained")
+		return
 	}
-	if prev == "collection" {
-		slog.Info("returning a collection from parseURLPut")
-		parse := NewParsed(true, "collection", segments[stopPoint], nil, nil, collection)
-		//parse := NewParsed(true, "collection", segments[b], nil, nil, &collection)
-		return &parse
+
+	put := r.Clone(r.Context())
+	put.Method = http.MethodPut
+	query := put.URL.Query()
+	query.Del("mode")
+	query.Del("version")
+	put.URL.RawQuery = query.Encode()
+
+	parent := Resolve(path.Parent(), owlDB, nil)
+	if !parent.Exist {
+		docAndColl.WriteError(w, r, http.StatusNotFound, parent.Missing)
+		return
 	}
-	parse := NewParsed(false, "", "", nil, nil, nil)
-	return &parse
+	putDocument(w, put, parent, rev.Data, path.Name(), schema, username, false)
+}
 
+// Takes in a request and reads its body. Writes a 413 and returns false if the body is larger than the server
+// accepts, or a 400 if it could not be read otherwise
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	desc, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		docAndColl.WriteError(w, r, http.StatusRequestEntityTooLarge, "request body is larger than "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes")
+		return nil, false
+	case err != nil:
+		slog.DebugContext(r.Context(), "unable to read request body", "error", err)
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "unable to read request body")
+		return nil, false
+	}
+	return desc, true
 }
 
-// struct that contains all of the information the handler needs from the parse
-type Parsed struct {
-	Exist      bool
-	ObjType    string
-	Name       string
-	Database   *database.Database
-	Document   *docAndColl.Document
-	Collection *docAndColl.Collection
+// Takes in a write request and reports whether its body is declared as JSON, e.g. application/json or
+// application/json-patch+json. A body without a Content-Type is taken as JSON
+func jsonBody(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
 }
 
-// called when a Parsed struct needs to be created
-func NewParsed(
-	exist bool,
-	ObjType string,
-	Name string,
-	Db *database.Database,
-	Doc *docAndColl.Document,
-	Collection *docAndColl.Collection,
-
-) Parsed {
-	return Parsed{Exist: exist, ObjType: ObjType, Name: Name, Database: Db, Document: Doc, Collection: Collection}
+// Takes in the request and returns the snapshot its reads should use: the state as of the asOf query
+// parameter if one is given, or the current state otherwise. Writes an error and returns false if the
+// requested sequence is invalid or no longer retained. The caller must release the snapshot.
+func openSnapshot(w http.ResponseWriter, r *http.Request) (*skiplist.Snapshot, bool) {
+	asOf := r.URL.Query().Get("asOf")
+	if asOf == "" {
+		return skiplist.NewSnapshot(), true
+	}
+
+	seq, err := strconv.ParseUint(asOf, 10, 64)
+	if err != nil {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "invalid asOf sequence")
+		return nil, false
+	}
+	snap, err := skiplist.SnapshotAt(seq)
+	if errors.Is(err, skiplist.ErrSnapshotTooOld) {
+		docAndColl.WriteError(w, r, http.StatusGone, "sequence "+asOf+" is no longer available")
+		return nil, false
+	} else if err != nil {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "sequence "+asOf+" has not been written yet")
+		return nil, false
+	}
+	return snap, true
 }
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/metrics"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
+)
+
+// the path the metrics are served at, without a token like the OpenAPI description
+const metricsRoute = "/metrics"
+
+// ServeMetrics is whether HndlRequest serves the metrics at /metrics. The server turns it off when the metrics
+// are served on an address of their own, see Metrics
+var ServeMetrics = true
+
+// observed is the response writer of a request, recording its status for the metrics
+type observed struct {
+	http.ResponseWriter
+	status int
+}
+
+func (o *observed) WriteHeader(status int) {
+	if o.status == 0 {
+		o.status = status
+	}
+	o.ResponseWriter.WriteHeader(status)
+}
+
+func (o *observed) Write(data []byte) (int, error) {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	return o.ResponseWriter.Write(data)
+}
+
+// Flush passes the flushes of event streams on to the connection
+func (o *observed) Flush() {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	if flusher, ok := o.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the writer of the connection, for http.ResponseController
+func (o *observed) Unwrap() http.ResponseWriter {
+	return o.ResponseWriter
+}
+
+// Takes in a request and returns the route it is counted under in the metrics, the path template of its
+// resource, e.g. /v1/{db}/{document}, or "unmatched" for a path that names no resource
+func requestRoute(r *http.Request) string {
+	switch r.URL.Path {
+	case authRoute, openAPIRoute, metricsRoute:
+		return r.URL.Path
+	}
+	path, err := parser.Parse(r.URL.EscapedPath())
+	if err != nil {
+		return "unmatched"
+	}
+	return routePath(path)
+}
+
+// Metrics writes the metrics of the server, with the number of databases, documents and collections it holds
+func Metrics(w http.ResponseWriter, r *http.Request, owlDB *database_host.Database_host) {
+	snap := skiplist.NewSnapshot()
+	databases, documents, collections := owlDB.Count(snap)
+	snap.Release()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	metrics.Write(w,
+		metrics.Gauge{Name: "owldb_databases", Help: "Databases on the server.", Value: float64(databases)},
+		metrics.Gauge{Name: "owldb_documents", Help: "Documents in every database, nested ones included.", Value: float64(documents)},
+		metrics.Gauge{Name: "owldb_collections", Help: "Collections in every database, nested ones included.", Value: float64(collections)},
+		metrics.Gauge{Name: "owldb_snapshots_active", Help: "Snapshots held open by reads in flight.", Value: float64(skiplist.ActiveSnapshots())},
+		metrics.Gauge{Name: "owldb_write_sequence", Help: "Sequence number of the latest write.", Value: float64(skiplist.CurrentSequence())},
+		metrics.Gauge{Name: "owldb_skiplist_write_retries_total", Help: "Writes that started over because a concurrent write changed the list under them.", Value: float64(skiplist.Retries()), Counter: true},
+	)
+}
+
+// code returns the status of the response
+func (o *observed) code() int {
+	if o.status == 0 {
+		// nothing was written, net/http answers 200
+		return http.StatusOK
+	}
+	return o.status
+}
+
+// Takes in a request, the time it started and the writer that observed its response, and records it
+func observe(r *http.Request, start time.Time, w *observed) {
+	metrics.Request(r.Method, requestRoute(r), w.code(), time.Since(start))
+}
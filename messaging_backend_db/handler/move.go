@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/validator"
+	"github.com/santhosh-tekuri/jsonschema"
+)
+
+// Takes in a POST ...?mode=move&to=<path> or POST ...?mode=copy&to=<path> request on a document or collection
+// and relocates it, with everything below it, to the path given by to, e.g. to=/v1/db/doc2/col/. The destination
+// must not exist yet, and is written as escaped as the path of a request. Metadata is kept and the uris of the
+// whole subtree are rewritten. Every document of the subtree must conform to the schema that governs it at its
+// new path, or the response is 400 and nothing is relocated
+// Subscribers of a moved document or collection, and of everything below it, get a delete event for its old path
+// and their streams are closed. Subscribers of the collection a document lands in get an update event for it,
+// and subscribers of the document a collection lands under get one for that document
+// The response is 201 with the new uri
+func handleMove(w http.ResponseWriter, r *http.Request, mode string, src parser.Path, owlDB *database_host.Database_host, global *jsonschema.Schema) {
+	dst, err := parser.Parse(rawQuery(r, "to"))
+	if err != nil || dst.Kind() == "server" || dst.Kind() == "database" {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, mode+" needs a destination path, e.g. to=/v1/db/doc")
+		return
+	}
+	if src.Kind() != "document" && src.Kind() != "collection" {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "only documents and collections can be relocated")
+		return
+	}
+	if src.Kind() != dst.Kind() {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "a document can only be moved to a document path, and a collection to a collection path")
+		return
+	}
+	if dst.String() == src.String() || strings.HasPrefix(dst.String(), strings.TrimSuffix(src.String(), "/")+"/") {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "unable to "+mode+" "+src.String()+" into itself")
+		return
+	}
+
+	defer lockDatabases(r, owlDB, src, dst)()
+
+	from := Resolve(src.Parent(), owlDB, nil)
+	dest := Resolve(dst.Parent(), owlDB, nil)
+	if !from.Exist {
+		docAndColl.WriteError(w, r, http.StatusNotFound, from.Missing)
+		return
+	}
+	if !dest.Exist {
+		docAndColl.WriteError(w, r, http.StatusNotFound, dest.Missing)
+		return
+	}
+
+	move := mode == "move"
+	schema := documentSchema(dst, owlDB, global)
+	if src.Kind() == "collection" {
+		moveCollection(w, r, move, src, dst, from, dest, schema)
+	} else {
+		moveDocument(w, r, move, src, dst, from, dest, schema)
+	}
+}
+
+// returns the value of the query parameter as it was sent, still escaped, so a path in it is only decoded by the parser
+func rawQuery(r *http.Request, key string) string {
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		if name, value, _ := strings.Cut(param, "="); name == key {
+			return value
+		}
+	}
+	return ""
+}
+
+// Takes in a relocated copy of a document and the schema that governs it at its new path, and checks the document
+// and every document below it against the schema that governs each of them there: the given one, or the schema
+// of a collection below it that has its own. Records the schema version in the metadata of the conforming documents
+func conformDocument(doc *docAndColl.Document, schema *docAndColl.Schema) error {
+	if valid, err := validator.Validate(schema.Compiled, doc.Data); !valid {
+		return err
+	}
+	doc.Metadata.SchemaVersion, doc.Metadata.SchemaInvalid = schema.Version, false
+	for _, col := range doc.ColSkipList.All() {
+		if err := conformCollection(col, schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Same as conformDocument, for every document of a relocated copy of a collection
+func conformCollection(col *docAndColl.Collection, schema *docAndColl.Schema) error {
+	if own := col.Schema.Load(); own != nil {
+		schema = own
+	}
+	for _, doc := range col.DocSkipList.All() {
+		if err := conformDocument(doc, schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moves or copies the document at src, in the database or collection from, to dst, in the database or collection dest
+// whose documents are validated against schema
+func moveDocument(w http.ResponseWriter, r *http.Request, move bool, src, dst parser.Path, from *Parsed, dest *Parsed, schema *docAndColl.Schema) {
+	srcList, dstList := documentList(from), documentList(dest)
+	if srcList == nil || dstList == nil {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "bad resource path")
+		return
+	}
+	doc, exist := srcList.Find(src.Name())
+	if !exist || doc.Expired(time.Now()) {
+		docAndColl.WriteError(w, r, http.StatusNotFound, "unable to retrieve document "+src.Name()+": not found")
+		return
+	}
+
+	copied := doc.CopyTo(dst.String(), dst.Name())
+	if err := conformDocument(copied, schema); err != nil {
+		docAndColl.WriteValidationError(w, r, err)
+		return
+	}
+	if move {
+		// only the version that was copied is moved
+		if _, removed := srcList.RemoveIf(src.Name(), func(curr *docAndColl.Document) bool { return curr == doc }); !removed {
+			docAndColl.WriteError(w, r, http.StatusConflict, "unable to move document "+src.Name()+": changed concurrently")
+			return
+		}
+	}
+	if !reinsert(dstList, dst.Name(), copied) {
+		if move && !reinsert(srcList, src.Name(), doc) {
+			slog.ErrorContext(r.Context(), "move: unable to put back document", "path", src.String())
+		}
+		docAndColl.WriteError(w, r, http.StatusConflict, "unable to create/replace document "+dst.Name()+": exists")
+		return
+	}
+	slog.InfoContext(r.Context(), "relocated document", "from", src.String(), "to", dst.String(), "move", move)
+
+	if move {
+		doc.Removed(r)
+		if from.ObjType == "collection" {
+			docAndColl.Notify(r, src.String(), &from.Collection.Subscribers, "delete", doc)
+		}
+	}
+	if dest.ObjType == "collection" {
+		copied.Added(r, &dest.Collection.Subscribers)
+		dest.Collection.EnforceRetention(r, time.Now())
+	} else {
+		dest.Database.EnforceRetention(r, time.Now())
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(copied.URI)
+}
+
+// moves or copies the collection at src, in the document from, to dst, in the document dest
+// whose documents are validated against schema, unless the collection has a schema of its own
+func moveCollection(w http.ResponseWriter, r *http.Request, move bool, src, dst parser.Path, from *Parsed, dest *Parsed, schema *docAndColl.Schema) {
+	srcList, dstList := &from.Document.ColSkipList, &dest.Document.ColSkipList
+	col, exist := srcList.Find(src.Name())
+	if !exist {
+		docAndColl.WriteError(w, r, http.StatusNotFound, "unable to retrieve collection "+src.Name()+": not found")
+		return
+	}
+
+	copied := col.CopyTo(dst.String(), dst.Name())
+	if err := conformCollection(copied, schema); err != nil {
+		docAndColl.WriteValidationError(w, r, err)
+		return
+	}
+	if move {
+		if _, removed := srcList.RemoveIf(src.Name(), func(curr *docAndColl.Collection) bool { return curr == col }); !removed {
+			docAndColl.WriteError(w, r, http.StatusConflict, "unable to move collection "+src.Name()+": changed concurrently")
+			return
+		}
+	}
+	if !reinsert(dstList, dst.Name(), copied) {
+		if move && !reinsert(srcList, src.Name(), col) {
+			slog.ErrorContext(r.Context(), "move: unable to put back collection", "path", src.String())
+		}
+		docAndColl.WriteError(w, r, http.StatusConflict, "unable to create collection "+dst.Name()+": exists")
+		return
+	}
+	slog.InfoContext(r.Context(), "relocated collection", "from", src.String(), "to", dst.String(), "move", move)
+
+	if move {
+		col.Removed(r)
+	}
+	dest.Document.CollectionAdded(r)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(copied.URI)
+}
+
+// returns the list of documents of a parsed database or collection, or nil if it names neither
+func documentList(parse *Parsed) *skiplist.List[string, *docAndColl.Document] {
+	switch parse.ObjType {
+	case "database":
+		return &parse.Database.DocSkipList
+	case "collection":
+		return &parse.Collection.DocSkipList
+	}
+	return nil
+}
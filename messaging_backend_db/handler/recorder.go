@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// responseRecorder is a response writer that keeps a response in memory, e.g. the response of one operation of a batch
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(data)
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	// like a real response writer, only the first status counts
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+// result converts the recorded response into a batch result. Bodies that are not JSON are returned as a JSON string
+func (rec *responseRecorder) result() BatchResult {
+	result := BatchResult{Status: rec.status}
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	body := bytes.TrimSpace(rec.body.Bytes())
+	if len(body) == 0 {
+		return result
+	}
+	if json.Valid(body) {
+		result.Body = body
+	} else {
+		result.Body, _ = json.Marshal(string(body))
+	}
+	return result
+}
+
+// copyTo writes the recorded status and body to w. Headers are not copied
+func (rec *responseRecorder) copyTo(w http.ResponseWriter) {
+	if rec.status == 0 {
+		return
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
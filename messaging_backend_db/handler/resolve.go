@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
+)
+
+// struct that contains all of the information the handler needs about what a path names
+type Parsed struct {
+	Exist bool
+	// server, database, document or collection, the kind of the path
+	ObjType string
+	// the last name of the path
+	Name string
+	// the database, and the last document and collection on the path, e.g. the collection a document is in
+	Database   *database.Database
+	Document   *docAndColl.Document
+	Collection *docAndColl.Collection
+	// the version of Document, set when the path names a document
+	Version uint64
+	// why the path does not exist, e.g. unable to retrieve document doc: not found
+	Missing string
+}
+
+// Resolve looks up the database, document or collection a path names, every name of it as of the given snapshot
+// a nil snapshot resolves the path against the latest state. The server always exists
+// A write resolves the parent of its path, the database, document or collection it writes into
+func Resolve(path parser.Path, owlDB *database_host.Database_host, snap *skiplist.Snapshot) *Parsed {
+	parse := &Parsed{ObjType: path.Kind(), Name: path.Name()}
+	var names []string
+	switch p := path.(type) {
+	case parser.ServerPath:
+		parse.Exist = true
+		return parse
+	case parser.DocumentPath:
+		names = p.Names
+	case parser.CollectionPath:
+		names = p.Names
+	}
+
+	db, exist := owlDB.GetDatabaseAt(snap, path.DatabaseName())
+	if !exist {
+		parse.Missing = "not found"
+		return parse
+	}
+	parse.Database = db
+
+	for i, name := range names {
+		if i%2 == 1 {
+			col, exist := parse.Document.GetCollectionAt(snap, name)
+			if !exist {
+				parse.Missing = "unable to retrieve collection " + name + ": not found"
+				return parse
+			}
+			parse.Collection = col
+			continue
+		}
+		var doc *docAndColl.Document
+		if parse.Collection == nil {
+			doc, parse.Version, exist = db.GetDocumentFromDatabaseAt(snap, name)
+		} else {
+			doc, parse.Version, exist = parse.Collection.GetDocumentFromCollectionAt(snap, name)
+		}
+		if !exist {
+			parse.Missing = "unable to retrieve document " + name + ": not found"
+			return parse
+		}
+		parse.Document = doc
+	}
+	parse.Exist = true
+	return parse
+}
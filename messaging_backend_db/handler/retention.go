@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+)
+
+// Takes in a PUT ...?mode=retention request on a database or collection and sets its retention policy to the body
+// The policy is enforced right away, and the response is the policy that is now in place
+func handleRetention(w http.ResponseWriter, r *http.Request, path parser.Path, desc []byte, owlDB *database_host.Database_host) {
+	policy, err := docAndColl.ParseRetentionPolicy(desc)
+	if err != nil {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	parse := Resolve(path, owlDB, nil)
+	if !parse.Exist {
+		docAndColl.WriteError(w, r, http.StatusNotFound, parse.Missing)
+		return
+	}
+	switch path.(type) {
+	case parser.DatabasePath:
+		parse.Database.Retention.Store(policy)
+		slog.InfoContext(r.Context(), "set retention policy", "path", r.URL.Path, "pruned", parse.Database.EnforceRetention(r, time.Now()))
+	case parser.CollectionPath:
+		parse.Collection.Retention.Store(policy)
+		slog.InfoContext(r.Context(), "set retention policy", "path", r.URL.Path, "pruned", parse.Collection.EnforceRetention(r, time.Now()))
+	default:
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "retention policies apply to databases and collections")
+		return
+	}
+	docAndColl.RetentionFormat(w, policy)
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+)
+
+// Route is one thing HndlRequest does: a method on a path, with the mode query parameter it is selected by
+// Path is written like the paths of openapi.json, e.g. /v1/{db}/{collection}/. Mode is "" for the plain method
+type Route struct {
+	Method string
+	Path   string
+	Mode   string
+}
+
+// the path templates of the resources, see parser.Path
+const (
+	serverRoute     = "/v1/"
+	databaseRoute   = "/v1/{db}"
+	listingRoute    = "/v1/{db}/"
+	documentRoute   = "/v1/{db}/{document}"
+	collectionRoute = "/v1/{db}/{collection}/"
+	authRoute       = "/auth"
+	openAPIRoute    = "/v1/openapi.json"
+)
+
+// Routes lists everything HndlRequest serves. A request with a mode that is not listed for its method and path
+// is refused, so a new mode has to be added here, and to openapi.json, before it can be used
+var Routes = []Route{
+	{http.MethodGet, openAPIRoute, ""},
+	{http.MethodGet, metricsRoute, ""},
+	{http.MethodPost, authRoute, ""},
+	{http.MethodDelete, authRoute, ""},
+
+	{http.MethodGet, serverRoute, "trash"},
+	{http.MethodGet, databaseRoute, "schema"},
+	{http.MethodGet, listingRoute, ""},
+	{http.MethodGet, listingRoute, "trash"},
+	{http.MethodGet, listingRoute, "retention"},
+	{http.MethodGet, listingRoute, "schema"},
+	{http.MethodGet, documentRoute, ""},
+	{http.MethodGet, documentRoute, "subscribe"},
+	{http.MethodGet, documentRoute, "history"},
+	{http.MethodGet, documentRoute, "schema"},
+	{http.MethodGet, collectionRoute, ""},
+	{http.MethodGet, collectionRoute, "subscribe"},
+	{http.MethodGet, collectionRoute, "retention"},
+	{http.MethodGet, collectionRoute, "schema"},
+
+	{http.MethodPut, databaseRoute, ""},
+	{http.MethodPut, databaseRoute, "schema"},
+	{http.MethodPut, databaseRoute, "retention"},
+	{http.MethodPut, listingRoute, "schema"},
+	{http.MethodPut, listingRoute, "retention"},
+	{http.MethodPut, documentRoute, ""},
+	{http.MethodPut, collectionRoute, ""},
+	{http.MethodPut, collectionRoute, "schema"},
+	{http.MethodPut, collectionRoute, "retention"},
+
+	{http.MethodPost, databaseRoute, "batch"},
+	{http.MethodPost, databaseRoute, "transaction"},
+	{http.MethodPost, databaseRoute, "undelete"},
+	{http.MethodPost, listingRoute, ""},
+	{http.MethodPost, listingRoute, "batch"},
+	{http.MethodPost, listingRoute, "transaction"},
+	{http.MethodPost, listingRoute, "undelete"},
+	{http.MethodPost, documentRoute, "restore"},
+	{http.MethodPost, documentRoute, "move"},
+	{http.MethodPost, documentRoute, "copy"},
+	{http.MethodPost, collectionRoute, ""},
+	{http.MethodPost, collectionRoute, "move"},
+	{http.MethodPost, collectionRoute, "copy"},
+
+	{http.MethodDelete, databaseRoute, ""},
+	{http.MethodDelete, documentRoute, ""},
+	{http.MethodDelete, collectionRoute, ""},
+
+	{http.MethodPatch, documentRoute, ""},
+}
+
+// OpenAPI is the OpenAPI 3 description of Routes, served at /v1/openapi.json
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// Takes in a parsed path and returns the path template of its routes
+func routePath(path parser.Path) string {
+	switch path := path.(type) {
+	case parser.DatabasePath:
+		if path.Listing {
+			return listingRoute
+		}
+		return databaseRoute
+	case parser.DocumentPath:
+		return documentRoute
+	case parser.CollectionPath:
+		return collectionRoute
+	}
+	return serverRoute
+}
+
+// Takes in a request with a mode and its parsed path, and reports whether the mode is one of the routes
+// Requests without a mode are left to the handler of their method, which knows what is wrong with them
+func routed(r *http.Request, path parser.Path) bool {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		return true
+	}
+	route := Route{r.Method, routePath(path), mode}
+	for _, known := range Routes {
+		if known == route {
+			return true
+		}
+	}
+	return false
+}
+
+// writes the OpenAPI description of the server
+func openAPIFormat(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(OpenAPI)
+}
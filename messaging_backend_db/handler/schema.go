@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+	"github.com/santhosh-tekuri/jsonschema"
+)
+
+// Takes in a path and returns the schema of the nearest database or collection on it that has one, the path
+// itself included. Returns nil if none has a schema, then the global schema applies
+func nearestSchema(path parser.Path, owlDB *database_host.Database_host) *docAndColl.Schema {
+	db, exist := owlDB.GetDatabase(path.DatabaseName())
+	if !exist {
+		return nil
+	}
+	nearest := db.Schema.Load()
+
+	var names []string
+	switch p := path.(type) {
+	case parser.DocumentPath:
+		names = p.Names
+	case parser.CollectionPath:
+		names = p.Names
+	}
+	var doc *docAndColl.Document
+	var col *docAndColl.Collection
+	for i, name := range names {
+		if i%2 == 0 {
+			// a document, in the database or in the collection before it
+			if col == nil {
+				doc, exist = db.GetDocumentFromDatabase(name)
+			} else {
+				doc, exist = col.GetDocumentFromCollection(name)
+			}
+		} else {
+			col, exist = doc.GetCollection(name)
+			if exist && col.Schema.Load() != nil {
+				nearest = col.Schema.Load()
+			}
+		}
+		if !exist {
+			break
+		}
+	}
+	return nearest
+}
+
+// Takes in the path of a write and returns the schema the documents it writes are validated against
+func documentSchema(path parser.Path, owlDB *database_host.Database_host, global *jsonschema.Schema) *docAndColl.Schema {
+	if nearest := nearestSchema(path, owlDB); nearest != nil {
+		return nearest
+	}
+	return &docAndColl.Schema{Path: "global", Compiled: global}
+}
+
+// Takes in a PUT creating a database or collection at path and its body and compiles the schema it attaches, if any
+// Writes a 400 and returns false if the schema is invalid
+func creationSchema(w http.ResponseWriter, r *http.Request, path string, desc []byte) (*docAndColl.Schema, bool) {
+	if len(bytes.TrimSpace(desc)) == 0 {
+		return nil, true
+	}
+	schema, err := docAndColl.CompileSchema(path, desc, 1)
+	if err != nil {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return schema, true
+}
+
+// Takes in a PUT ...?mode=schema request on a database or collection and attaches the schema in the body to it
+// A body of null removes the schema. The response is a report of the documents the schema applies to that do not
+// conform to it. With dryRun=true nothing changes. Otherwise onInvalid decides: refuse, the default, leaves the
+// old schema in place if any document does not conform and responds 409; flag attaches the schema anyway and
+// flags the documents that do not conform in their metadata. Conforming documents record the new version
+// Other writers on the database wait until the documents are checked and stamped
+func handleSchema(w http.ResponseWriter, r *http.Request, path parser.Path, desc []byte, owlDB *database_host.Database_host, global *jsonschema.Schema) {
+	query := r.URL.Query()
+	dryRun := query.Get("dryRun") == "true"
+	onInvalid := query.Get("onInvalid")
+	if onInvalid != "" && onInvalid != "refuse" && onInvalid != "flag" {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "onInvalid must be refuse or flag")
+		return
+	}
+
+	if db, exist := owlDB.GetDatabase(path.DatabaseName()); exist && r.Context().Value(txContextKey{}) != db {
+		db.TxMu.Lock()
+		defer db.TxMu.Unlock()
+	}
+	parse := Resolve(path, owlDB, nil)
+	if !parse.Exist {
+		docAndColl.WriteError(w, r, http.StatusNotFound, parse.Missing)
+		return
+	}
+
+	// where the schema is attached, with the trailing slash of the listing of its documents
+	var at string
+	var target *atomic.Pointer[docAndColl.Schema]
+	switch p := path.(type) {
+	case parser.DatabasePath:
+		at = parser.DatabasePath{DB: p.DB, Listing: true}.String()
+		target = &parse.Database.Schema
+	case parser.CollectionPath:
+		at = p.String()
+		target = &parse.Collection.Schema
+	default:
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "schemas apply to databases and collections")
+		return
+	}
+	list := documentList(parse)
+
+	if string(desc) == "null" {
+		// the documents fall back to the schema above, they are not checked again
+		if !dryRun {
+			target.Store(nil)
+		}
+		schemaFormat(w, path, owlDB, global)
+		return
+	}
+	version := 1
+	if prev := target.Load(); prev != nil {
+		version = prev.Version + 1
+	}
+	schema, err := docAndColl.CompileSchema(at, desc, version)
+	if err != nil {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report := docAndColl.CheckDocuments(list, schema)
+	if dryRun {
+		docAndColl.ReportFormat(w, http.StatusOK, report)
+		return
+	}
+	if len(report.Violations) > 0 && onInvalid != "flag" {
+		slog.DebugContext(r.Context(), "schema update refused", "path", at, "violations", len(report.Violations))
+		docAndColl.ReportFormat(w, http.StatusConflict, report)
+		return
+	}
+	target.Store(schema)
+	docAndColl.StampDocuments(r, list, schema)
+	report.Applied = true
+	slog.InfoContext(r.Context(), "schema updated", "path", at, "version", version, "flagged", len(report.Violations))
+	docAndColl.ReportFormat(w, http.StatusOK, report)
+}
+
+// writes the schema that applies at the path
+func schemaFormat(w http.ResponseWriter, path parser.Path, owlDB *database_host.Database_host, global *jsonschema.Schema) {
+	schema := nearestSchema(path, owlDB)
+	if schema == nil {
+		schema = docAndColl.GlobalSchema(global)
+	}
+	schema.SchemaFormat(w)
+}
@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
+	"github.com/santhosh-tekuri/jsonschema"
+)
+
+// Precondition is a condition on the current state of the resource an operation writes to
+// Timestamp must match the lastModifiedAt of the document, like the timestamp query parameter of a PUT
+// Exists requires the resource to exist (true) or to not exist (false)
+type Precondition struct {
+	Timestamp *int64 `json:"timestamp,omitempty"`
+	Exists    *bool  `json:"exists,omitempty"`
+}
+
+// Takes in the escaped path of a resource and returns an error if the precondition does not hold for it
+// A nil precondition always holds
+func (pre *Precondition) check(escaped string, owlDB *database_host.Database_host) error {
+	if pre == nil {
+		return nil
+	}
+	path, err := parser.Parse(escaped)
+	if err != nil {
+		return err
+	}
+	parse := Resolve(path, owlDB, nil)
+
+	if pre.Exists != nil && *pre.Exists != parse.Exist {
+		if parse.Exist {
+			return fmt.Errorf("precondition failed: %s exists", path)
+		}
+		return fmt.Errorf("precondition failed: %s does not exist", path)
+	}
+	if pre.Timestamp != nil {
+		if !parse.Exist || parse.ObjType != "document" {
+			return fmt.Errorf("precondition failed: document %s does not exist", path)
+		}
+		if current := parse.Document.Metadata.LastModifiedAt; current != *pre.Timestamp {
+			return fmt.Errorf("precondition failed: timestamp %d doesn't match current timestamp %d", *pre.Timestamp, current)
+		}
+	}
+	return nil
+}
+
+// txContextKey is the context key under which the database a transaction is running in is stored
+type txContextKey struct{}
+
+// Takes in a write request and the path it writes to, and holds off transactions on the database of the path
+// until the returned function is called
+// Requests that are themselves part of a transaction on that database run under the transaction's lock instead
+func lockWrites(r *http.Request, owlDB *database_host.Database_host, path parser.Path) func() {
+	return lockDatabases(r, owlDB, path)
+}
+
+// Takes in a read request and the path it reads, and waits until a transaction on the database of the path is
+// done, holding off new ones until the returned function is called, so the read never sees half a transaction
+func lockReads(r *http.Request, owlDB *database_host.Database_host, path parser.Path) func() {
+	return lockDatabases(r, owlDB, path)
+}
+
+// Same as lockWrites, for a request that writes to the databases of all the given paths
+// The databases are locked in order of their names, so two such requests never wait on each other
+func lockDatabases(r *http.Request, owlDB *database_host.Database_host, paths ...parser.Path) func() {
+	var names []string
+	for _, path := range paths {
+		if name := path.DatabaseName(); name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var locked []*database.Database
+	for _, name := range names {
+		db, exist := owlDB.GetDatabase(name)
+		if !exist || r.Context().Value(txContextKey{}) == db {
+			continue
+		}
+		db.TxMu.RLock()
+		locked = append(locked, db)
+	}
+	return func() {
+		for _, db := range locked {
+			db.TxMu.RUnlock()
+		}
+	}
+}
+
+// Takes in the body of a POST /v1/<db>?mode=transaction request and applies all of its operations, or none of them
+// Every precondition is checked before anything is written. If one fails, the response is 412 and nothing changes
+// If an operation fails, the operations before it are rolled back and the response is 409 with the results so far
+// Other readers and writers of the database wait until the transaction is done, and so do the reaper and the
+// retention sweeper: nothing sees the writes of a transaction before it commits, or the ones it rolls back, and
+// subscribers only hear about committed writes. A read as of an older sequence (asOf) sees the state at that
+// sequence, which can be in the middle of a transaction that was committed since
+func handleTransaction(w http.ResponseWriter, r *http.Request, desc []byte, db *database.Database, owlDB *database_host.Database_host, tokenmap *sync.Map, schema *jsonschema.Schema) {
+	var ops []BatchOp
+	if err := json.Unmarshal(desc, &ops); err != nil {
+		slog.DebugContext(r.Context(), "transaction: unable to parse operations", "error", err)
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "invalid transaction: body must be an array of operations")
+		return
+	}
+
+	db.TxMu.Lock()
+	defer db.TxMu.Unlock()
+
+	ctx, batch := docAndColl.WithBatch(r.Context())
+	ctx, retention := docAndColl.WithPendingRetention(ctx)
+	ctx = context.WithValue(ctx, txContextKey{}, db)
+	r = r.WithContext(ctx)
+
+	// check every operation before anything is written
+	subs := make([]*http.Request, len(ops))
+	for i, op := range ops {
+		sub, err := newBatchRequest(r, op, db.Name)
+		if err != nil {
+			docAndColl.WriteError(w, r, http.StatusBadRequest, fmt.Sprintf("operation %d: %s", i, err.Error()))
+			return
+		}
+		if err := op.Precondition.check(sub.URL.EscapedPath(), owlDB); err != nil {
+			slog.DebugContext(r.Context(), "transaction: precondition failed", "operation", i, "error", err)
+			docAndColl.PreconditionFailed(w, sub, fmt.Sprintf("operation %d: %s", i, err.Error()))
+			return
+		}
+		subs[i] = sub
+	}
+
+	// the state before the transaction, to roll back to
+	snap := skiplist.NewSnapshot()
+	defer snap.Release()
+
+	results := make([]BatchResult, 0, len(ops))
+	status := http.StatusOK
+	for i, sub := range subs {
+		rec := &responseRecorder{header: make(http.Header)}
+		serve(rec, sub, owlDB, tokenmap, schema)
+		results = append(results, rec.result())
+
+		if failed(results[i]) {
+			slog.DebugContext(r.Context(), "transaction: operation failed, rolling back", "operation", i, "status", results[i].Status)
+			for j := i - 1; j >= 0; j-- {
+				rollback(r, subs[j].URL.EscapedPath(), owlDB, snap)
+				if subs[j].Method == http.MethodDelete {
+					// the deleted item is back in place, so it is no longer in the trash
+					db.Trash.Take(docAndColl.TrashPath(subs[j]))
+				}
+			}
+			batch.Discard()
+			status = http.StatusConflict
+			break
+		}
+	}
+	if status == http.StatusOK {
+		// documents are only pruned once the transaction commits, their subscribers hear about it with the rest
+		retention.Enforce(r, time.Now())
+	}
+	batch.Flush(r)
+
+	jsonData, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		docAndColl.WriteError(w, r, http.StatusInternalServerError, "unable to marshal transaction results")
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
+
+// failed reports whether an operation did not apply
+func failed(result BatchResult) bool {
+	return result.Status >= 400
+}
+
+// Takes in the escaped path of a resource written by the transaction r and restores it to its state at the snapshot
+func rollback(r *http.Request, escaped string, owlDB *database_host.Database_host, snap *skiplist.Snapshot) {
+	path, err := parser.Parse(escaped)
+	if err != nil {
+		return
+	}
+	parent := Resolve(path.Parent(), owlDB, nil)
+	if !parent.Exist {
+		slog.ErrorContext(r.Context(), "transaction: unable to roll back, parent is gone", "path", path.String())
+		return
+	}
+	switch path.(type) {
+	case parser.DocumentPath:
+		if parent.ObjType == "database" {
+			restore(&parent.Database.DocSkipList, snap, path.Name())
+		} else {
+			restore(&parent.Collection.DocSkipList, snap, path.Name())
+		}
+	case parser.CollectionPath:
+		restore(&parent.Document.ColSkipList, snap, path.Name())
+	}
+}
+
+// restore sets the value of key in the list back to what it was at the snapshot, removing it if it did not exist
+func restore[V any](list *skiplist.List[string, V], snap *skiplist.Snapshot, key string) {
+	old, existed := list.At(snap).Find(key)
+	if !existed {
+		list.Remove(key)
+		return
+	}
+	list.Upsert(key, func(string, V, bool) (V, error) { return old, nil })
+}
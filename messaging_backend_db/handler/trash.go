@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/parser"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
+)
+
+// Takes in the name of a database and returns its trash
+// A database deleted in the meantime gets a throwaway trash, so the delete still succeeds
+func trashOf(owlDB *database_host.Database_host, dbName string) *docAndColl.Trash {
+	db, exist := owlDB.GetDatabase(dbName)
+	if !exist {
+		return new(docAndColl.Trash)
+	}
+	return &db.Trash
+}
+
+// Takes in a POST /v1/<db>?mode=undelete request and restores an item from the trash
+// With a path query parameter, e.g. path=/doc/col/, the document or collection at that path of the database is restored
+// Without one, the deleted database itself is restored
+// The item comes back as it was deleted, and the response is 201 with its uri, or 409 if something took its place
+// The subscribers of the collection a document comes back into get an update event for it, like for a write, and
+// so do the subscribers of the document a collection comes back under. Databases have no subscribers
+func handleUndelete(w http.ResponseWriter, r *http.Request, dbName string, owlDB *database_host.Database_host) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		entry, ok := owlDB.Trash.Take(dbName)
+		if !ok {
+			docAndColl.WriteError(w, r, http.StatusNotFound, "database "+dbName+" is not in the trash")
+			return
+		}
+		db := entry.Item.(*database.Database)
+		if !reinsert(&owlDB.DBSkipList, dbName, db) {
+			owlDB.Trash.Put(entry)
+			docAndColl.WriteError(w, r, http.StatusConflict, "unable to restore database "+dbName+": exists")
+			return
+		}
+		slog.InfoContext(r.Context(), "restored database from trash", "name", dbName)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(db.URI)
+		return
+	}
+
+	db, exist := owlDB.GetDatabase(dbName)
+	if !exist {
+		docAndColl.WriteError(w, r, http.StatusNotFound, "not found")
+		return
+	}
+	// the path is relative to the database, and escaped like the path of a request
+	target, err := parser.Parse(parser.DatabasePath{DB: dbName}.Escaped() + path)
+	if err != nil || (target.Kind() != "document" && target.Kind() != "collection") {
+		docAndColl.WriteError(w, r, http.StatusBadRequest, "invalid undelete path "+path)
+		return
+	}
+	path = strings.TrimPrefix(target.String(), parser.DatabasePath{DB: dbName}.String())
+	entry, ok := db.Trash.Take(path)
+	if !ok {
+		docAndColl.WriteError(w, r, http.StatusNotFound, path+" is not in the trash")
+		return
+	}
+
+	parse := Resolve(target.Parent(), owlDB, nil)
+	if !parse.Exist {
+		db.Trash.Put(entry)
+		docAndColl.WriteError(w, r, http.StatusNotFound, "unable to restore "+path+": parent not found")
+		return
+	}
+
+	var restored bool
+	var uri []byte
+	switch item := entry.Item.(type) {
+	case *docAndColl.Document:
+		uri = item.URI
+		switch parse.ObjType {
+		case "database":
+			restored = reinsert(&parse.Database.DocSkipList, target.Name(), item)
+		case "collection":
+			if restored = reinsert(&parse.Collection.DocSkipList, target.Name(), item); restored {
+				item.Added(r, &parse.Collection.Subscribers)
+			}
+		}
+	case *docAndColl.Collection:
+		uri = item.URI
+		if parse.ObjType == "document" {
+			if restored = reinsert(&parse.Document.ColSkipList, target.Name(), item); restored {
+				parse.Document.CollectionAdded(r)
+			}
+		}
+	}
+	if !restored {
+		db.Trash.Put(entry)
+		docAndColl.WriteError(w, r, http.StatusConflict, "unable to restore "+path+": exists")
+		return
+	}
+	slog.InfoContext(r.Context(), "restored from trash", "database", dbName, "path", path)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(uri)
+}
+
+// reinsert puts a value back into the list under key, unless the key is taken. Reports whether it was put back
+func reinsert[V any](list *skiplist.List[string, V], key string, value V) bool {
+	_, err := list.Upsert(key, func(key string, _ V, exists bool) (V, error) {
+		if exists {
+			return value, fmt.Errorf("%s exists", key)
+		}
+		return value, nil
+	})
+	return err == nil
+}
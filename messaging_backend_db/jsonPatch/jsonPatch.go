@@ -3,7 +3,6 @@ package jsonPatch
 
 import (
 	"errors"
-	"log/slog"
 	"reflect"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/jsonvisit"
@@ -45,10 +44,8 @@ func (v JsonPatchVisitor) Map(m map[string]interface{}) (interface{}, error) {
 	// if op is object add --> will be added to the following map where the path was found
 	if v.op == "ObjectAdd" {
 		if v.addval {
-			slog.Info("adding value")
 			result[v.newkey] = v.value
 			v.addval = false
-			slog.Info("added val")
 			addedobj = true
 		}
 	}
@@ -56,59 +53,39 @@ func (v JsonPatchVisitor) Map(m map[string]interface{}) (interface{}, error) {
 	found_key := false
 
 	// looking for key
-	if v.idx < v.len {
-		slog.Info("looking for key:", v.path[v.idx])
-	} else {
-		slog.Info("past the path?")
+	if v.idx >= v.len {
 		found_key = true
 	}
 
 	for key, val := range m {
 		if !found_key {
 			// checking path
-			slog.Info("loop key:", key)
 			if v.idx < v.len {
 				if key == v.path[v.idx] {
 					found_key = true
 					v.curpath = append(v.curpath, key)
-					slog.Info("path", v.path[v.idx])
 					v.idx = v.idx + 1
 					if v.op == "ObjectAdd" {
 						if v.idx == v.len {
 							if reflect.DeepEqual(v.curpath, v.path) {
 								v.addval = true
-								slog.Info("path was found w object add")
 							}
 						}
 					}
-
-				} else {
-					slog.Info("not on the path")
 				}
-
-			} else {
-				slog.Info("past the path")
 			}
 		}
 
 		res, err := jsonvisit.Accept(val, v)
 		if v.addval {
 			v.curpath = nil
-			slog.Info("nill curr path as we found what we need to add")
-
 		}
 		if err != nil {
 			return nil, err
 		}
 		result[key] = res
 	}
-	if found_key {
-		slog.Info("found the key")
-	} else if addedobj {
-		slog.Info("found the key --> added obj")
-	} else {
-
-		slog.Info("didnt find key on this level should return that the path doesnt exists?")
+	if !found_key && !addedobj {
 		return nil, errors.New("given path coudlnt be found in the document")
 	}
 	return result, nil
@@ -117,19 +94,10 @@ func (v JsonPatchVisitor) Map(m map[string]interface{}) (interface{}, error) {
 // Slice proceses JSON slice by iterating through slice and calling Accept, if path is found the patch is applied at path.
 func (v JsonPatchVisitor) Slice(s []interface{}) (interface{}, error) {
 	var apval bool
-	slog.Info("in slice")
 	var result []interface{}
 
-	for _, val := range v.curpath {
-		slog.Info("cur val", val)
-	}
-	for _, vals := range v.path {
-		slog.Info("path val", vals)
-	}
-
 	if reflect.DeepEqual(v.curpath, v.path) {
 		apval = true
-		slog.Info("path was found", apval)
 	}
 
 	for _, val := range s {
@@ -152,11 +120,8 @@ func (v JsonPatchVisitor) Slice(s []interface{}) (interface{}, error) {
 
 				// If the value doesn't exist, add it to the array
 				if !exists {
-					slog.Info("adding value to array")
 					result = append(result, v.value)
 					v.valadded = true
-				} else {
-					slog.Info("value already exists in the array, skipping addition")
 				}
 
 			} else if v.op == "ArrayRemove" {
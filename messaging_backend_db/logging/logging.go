@@ -0,0 +1,106 @@
+// Package logging builds the logger of the server, and carries the ID and user of a request through its
+// context, so every line logged while serving the request names it
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// Request is what is known about the request being served, for its log lines
+type Request struct {
+	ID string
+
+	mu   sync.Mutex
+	user string
+}
+
+// requestContextKey is the context key under which the Request of a request is stored
+type requestContextKey struct{}
+
+// WithRequest returns a context for the request with the given ID, and the Request it carries
+func WithRequest(ctx context.Context, id string) (context.Context, *Request) {
+	req := &Request{ID: id}
+	return context.WithValue(ctx, requestContextKey{}, req), req
+}
+
+// FromContext returns the Request of the context, nil if it is not serving a request
+func FromContext(ctx context.Context) *Request {
+	req, _ := ctx.Value(requestContextKey{}).(*Request)
+	return req
+}
+
+// SetUser records the user the request was authenticated as
+func (req *Request) SetUser(user string) {
+	if req == nil {
+		return
+	}
+	req.mu.Lock()
+	req.user = user
+	req.mu.Unlock()
+}
+
+// User returns the user the request was authenticated as, "" if it was not
+func (req *Request) User() string {
+	req.mu.Lock()
+	defer req.mu.Unlock()
+	return req.user
+}
+
+// NewID returns a random request ID
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidID reports whether a request ID given by a client is fit to be logged and echoed back: at most 128
+// printable ASCII characters
+func ValidID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// New returns a logger writing lines of the given format, json or text, at level and above to w
+// Lines logged with the context of a request carry its request_id
+func New(w io.Writer, level slog.Leveler, format string) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if format == "text" {
+		handler = slog.NewTextHandler(w, options)
+	} else {
+		handler = slog.NewJSONHandler(w, options)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the request ID of the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if req := FromContext(ctx); req != nil {
+		record.AddAttrs(slog.String("request_id", req.ID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -2,19 +2,29 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/authorize"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/certs"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/config"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/cors"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/database_host"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/docAndColl"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/handler"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group07/logging"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group07/skiplist"
 	"github.com/santhosh-tekuri/jsonschema"
 )
@@ -23,35 +33,50 @@ import (
 func main() {
 	//varaibles for server
 	var server http.Server
-	var port int // used as the port num
 	var err error
 
-	// varaibles for flags
-	var docSchema string
-	var tokenFile string
+	// varaibles for flags, every other setting comes from the config file, the environment or its own flag
+	var configFile string
+	var checkConfig bool
 
 	//defining flags
-	// Specify the port your server should listen on with defualt value as 3318
-	flag.IntVar(&port, "p", 3318, "port number")
-	flag.StringVar(&docSchema, "s", "error", "JSON schema file name")
-	flag.StringVar(&tokenFile, "t", "", "file name for token")
-
+	flag.StringVar(&configFile, "config", os.Getenv("OWLDB_CONFIG"), "JSON config file (env OWLDB_CONFIG)")
+	flag.BoolVar(&checkConfig, "check-config", false, "validate the configuration, print it and exit")
+	given := config.Flags(flag.CommandLine)
 	flag.Parse()
 
-	// Create a JSON Schema compiler
-	compiler := jsonschema.NewCompiler()
+	cfg, err := config.Load(configFile, os.LookupEnv, given)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:\n"+err.Error())
+		os.Exit(1)
+	}
 
 	// Compile JSON schema
-	schema, err := compiler.Compile(docSchema)
+	schema, err := compileSchema(cfg.Schema)
 	if err != nil {
-		slog.Error("schema compilation error", "error", err)
+		fmt.Fprintln(os.Stderr, "schema compilation error:", err)
+		os.Exit(1)
+	}
+
+	if checkConfig {
+		out, _ := json.MarshalIndent(cfg, "", "  ")
+		fmt.Println(string(out))
 		return
 	}
+	apply(cfg)
 
 	// initialize the owlDB database and token map
 	owlDB := database_host.Database_host{Name: "db_host", DBSkipList: skiplist.NewList[string, *database.Database]("", "zzz")}
 	tokenMap := new(sync.Map)
-	authorize.Initialize(tokenFile, tokenMap)
+	if cfg.Tokens.File != "" {
+		authorize.Initialize(cfg.Tokens.File, tokenMap)
+	}
+
+	// remove documents whose time to live is over, documents retention policies don't keep,
+	// and deleted items whose retention in the trash is over
+	go every(time.Duration(cfg.Limits.ReapInterval), "reaped expired documents", owlDB.ReapExpired)
+	go every(time.Duration(cfg.Limits.RetentionInterval), "pruned documents by retention policy", owlDB.SweepRetention)
+	go every(time.Duration(cfg.Limits.TrashPurgeInterval), "purged trash", owlDB.PurgeTrash)
 
 	// The following code should go last and remain unchanged.
 	// Note that you must actually initialize 'server' and 'port'
@@ -59,30 +84,136 @@ func main() {
 
 	handler := http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			slog.Info("handler function is called")
+			if cfg.Limits.MaxBodyBytes > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxBodyBytes)
+			}
 			handler.HndlRequest(w, r, &owlDB, tokenMap, schema)
 		})
 
 	server = http.Server{
-		Addr:    ":" + fmt.Sprintf("%d", port),
-		Handler: handler,
+		Addr:              cfg.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(cfg.Limits.ReadHeaderTimeout),
 	}
 
+	// the metrics on an address of their own, e.g. one only the monitoring network reaches
+	if cfg.MetricsListen != "" {
+		go serveMetrics(cfg.MetricsListen, &owlDB)
+	}
+
+	// event streams are ended with a shutdown event, as the server would wait for them forever
+	drain := docAndColl.NewDrain()
+	server.BaseContext = func(net.Listener) context.Context {
+		return docAndColl.WithDrain(context.Background(), drain)
+	}
+	server.RegisterOnShutdown(drain.Shutdown)
+
 	// signal.Notify requires the channel to be buffered
 	ctrlc := make(chan os.Signal, 1)
 	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM)
+	drained := make(chan struct{})
 	go func() {
-		// Wait for Ctrl-C signal
+		// Wait for Ctrl-C signal, then stop accepting requests and let the ones in flight finish
 		<-ctrlc
-		server.Close()
+		defer close(drained)
+		timeout := time.Duration(cfg.Limits.ShutdownTimeout)
+		slog.Info("Shutting down", "timeout", timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("requests still running at the shutdown timeout, closing them", "error", err)
+			server.Close()
+		}
 	}()
 
 	// Start server
-	slog.Info("Listening", "port", port)
-	err = server.ListenAndServe()
+	if cfg.TLS.Cert != "" {
+		var reloader *certs.Reloader
+		reloader, err = certs.New(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.ClientCA)
+		if err != nil {
+			slog.Error("unable to load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = reloader.Config()
+		go reloadOnHangup(reloader)
+
+		slog.Info("Listening", "address", cfg.Listen, "tls", true, "clientCA", cfg.TLS.ClientCA != "")
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		slog.Info("Listening", "address", cfg.Listen)
+		err = server.ListenAndServe()
+	}
 	if err != nil && err != http.ErrServerClosed {
 		slog.Error("Server closed", "error", err)
-	} else {
-		slog.Info("Server closed", "error", err)
+		os.Exit(1)
+	}
+	// the server stops listening as soon as the shutdown begins, wait for it to finish
+	<-drained
+	slog.Info("Server closed")
+}
+
+// compileSchema compiles the JSON schema documents are validated against. Without a schema file every JSON
+// document is accepted
+func compileSchema(file string) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	if file == "" {
+		file = "owldb:///any.json"
+		if err := compiler.AddResource(file, strings.NewReader("{}")); err != nil {
+			return nil, err
+		}
+	}
+	return compiler.Compile(file)
+}
+
+// apply sets the packages that are configured through variables to the configuration
+func apply(cfg *config.Config) {
+	level, _ := cfg.Level()
+	slog.SetDefault(logging.New(os.Stderr, level, cfg.LogFormat))
+	authorize.TokenTTL = time.Duration(cfg.Tokens.TTL)
+	docAndColl.HistoryLimit = cfg.Limits.History
+	docAndColl.TrashRetention = time.Duration(cfg.Limits.TrashRetention)
+	handler.ServeMetrics = cfg.MetricsListen == ""
+	handler.CORS = &cors.Policy{
+		Origins:     cfg.CORS.Origins,
+		Methods:     cfg.CORS.Methods,
+		Headers:     cfg.CORS.Headers,
+		Credentials: cfg.CORS.Credentials,
+		MaxAge:      time.Duration(cfg.CORS.MaxAge),
+	}
+}
+
+// serveMetrics serves /metrics on address instead of on the address of the server
+func serveMetrics(address string, owlDB *database_host.Database_host) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		handler.Metrics(w, r, owlDB)
+	})
+	slog.Info("Serving metrics", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		slog.Error("unable to serve metrics", "error", err)
+	}
+}
+
+// reloadOnHangup reads the certificate files again whenever the server gets SIGHUP, e.g. after they were renewed
+func reloadOnHangup(reloader *certs.Reloader) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := reloader.Reload(); err != nil {
+			slog.Error("unable to reload TLS certificate, keeping the current one", "error", err)
+			continue
+		}
+		slog.Info("reloaded TLS certificate")
+	}
+}
+
+// every calls task with the current time at every interval, logging msg when it removed anything
+func every(interval time.Duration, msg string, task func(now time.Time) int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if removed := task(now); removed > 0 {
+			slog.Info(msg, "count", removed)
+		}
 	}
 }
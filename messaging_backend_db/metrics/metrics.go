@@ -0,0 +1,243 @@
+// Package metrics keeps the counters and histograms of the server, and writes them in the Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DurationBuckets are the upper bounds, in seconds, of the buckets of the duration histograms
+var DurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// the metrics of the server
+var (
+	requests = newCounter("owldb_http_requests_total", "HTTP requests served, by method, route and status.",
+		"method", "route", "status")
+	requestDuration = newHistogram("owldb_http_request_duration_seconds", "Time to serve HTTP requests, by method, route and status. Event streams are observed when they end.",
+		"method", "route", "status")
+	subscribers = newGauge("owldb_subscribers", "Open event streams, by the route of the subscribed path.",
+		"route")
+	events = newCounter("owldb_events_total", "Events fanned out to subscribers, by event.",
+		"event")
+	deliveries = newCounter("owldb_event_deliveries_total", "Events written to event streams, by event.",
+		"event")
+	fanoutDuration = newHistogram("owldb_event_fanout_duration_seconds", "Time to write an event to every subscriber of a path, by event.",
+		"event")
+	auth = newCounter("owldb_auth_total", "Authentication attempts, by result: success or failure.",
+		"result")
+)
+
+// Request records a served HTTP request. route is the path template it matched, e.g. /v1/{db}/{document}
+func Request(method, route string, status int, elapsed time.Duration) {
+	labels := []string{method, route, strconv.Itoa(status)}
+	requests.add(labels, 1)
+	requestDuration.observe(labels, elapsed.Seconds())
+}
+
+// Subscribed records an event stream being opened, delta 1, or ended, delta -1. route is the path template of
+// the subscribed path, e.g. /v1/{db}/{document}, so the series stay few whatever is subscribed to
+func Subscribed(route string, delta int) {
+	subscribers.add([]string{route}, float64(delta))
+}
+
+// Fanout records an event written to recipients subscribers in elapsed
+func Fanout(event string, recipients int, elapsed time.Duration) {
+	events.add([]string{event}, 1)
+	deliveries.add([]string{event}, float64(recipients))
+	fanoutDuration.observe([]string{event}, elapsed.Seconds())
+}
+
+// Auth records a request authenticated, or refused, by a bearer token or a client certificate
+func Auth(success bool) {
+	if success {
+		auth.add([]string{"success"}, 1)
+	} else {
+		auth.add([]string{"failure"}, 1)
+	}
+}
+
+// Gauge is a value read when the metrics are written, e.g. the number of databases
+type Gauge struct {
+	Name  string
+	Help  string
+	Value float64
+	// reported as a counter, for a value that only goes up
+	Counter bool
+}
+
+// Write writes every metric, followed by the gauges read for this scrape, in the Prometheus text format
+func Write(w io.Writer, gauges ...Gauge) {
+	for _, m := range []interface{ write(io.Writer) }{requests, requestDuration, subscribers, events, deliveries, fanoutDuration, auth} {
+		m.write(w)
+	}
+	for _, g := range gauges {
+		kind := "gauge"
+		if g.Counter {
+			kind = "counter"
+		}
+		family{name: g.Name, help: g.Help}.header(w, kind)
+		fmt.Fprintf(w, "%s %s\n", g.Name, formatFloat(g.Value))
+	}
+}
+
+// family is the name, help and label names shared by the series of a metric
+type family struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// the label values of a series, joined into a map key
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// writes the HELP and TYPE lines of the family
+func (f family) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, kind)
+}
+
+// formats the labels of a series, with extra appended, e.g. {method="GET",le="0.5"}
+func (f family) format(values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escape(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapes a label value, see the Prometheus text format
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// series is one labelled value of a counter or gauge
+type series struct {
+	values []string
+	value  float64
+}
+
+// counter is a metric whose series only go up, or for a gauge, up and down
+type counter struct {
+	family
+	kind   string
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{family: family{name, help, labels}, kind: "counter", series: make(map[string]*series)}
+}
+
+func newGauge(name, help string, labels ...string) *counter {
+	c := newCounter(name, help, labels...)
+	c.kind = "gauge"
+	return c
+}
+
+func (c *counter) add(values []string, delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := key(values)
+	s, ok := c.series[k]
+	if !ok {
+		s = &series{values: values}
+		c.series[k] = s
+	}
+	s.value += delta
+	// a gauge back at zero is dropped, so routes nobody subscribes to any more are forgotten
+	if c.kind == "gauge" && s.value == 0 {
+		delete(c.series, k)
+	}
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, c.kind)
+	for _, k := range sortedKeys(c.series) {
+		s := c.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(s.values), formatFloat(s.value))
+	}
+}
+
+// distribution is one labelled series of a histogram
+type distribution struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogram counts observations into DurationBuckets
+type histogram struct {
+	family
+	mu     sync.Mutex
+	series map[string]*distribution
+}
+
+func newHistogram(name, help string, labels ...string) *histogram {
+	return &histogram{family: family{name, help, labels}, series: make(map[string]*distribution)}
+}
+
+func (h *histogram) observe(values []string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := key(values)
+	d, ok := h.series[k]
+	if !ok {
+		d = &distribution{values: values, counts: make([]uint64, len(DurationBuckets))}
+		h.series[k] = d
+	}
+	for i, bound := range DurationBuckets {
+		if v <= bound {
+			d.counts[i]++
+		}
+	}
+	d.count++
+	d.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, k := range sortedKeys(h.series) {
+		d := h.series[k]
+		for i, bound := range DurationBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(d.values, "le", formatFloat(bound)), d.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(d.values, "le", "+Inf"), d.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.format(d.values), formatFloat(d.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.format(d.values), d.count)
+	}
+}
+
+// the keys of a series map in order, so scrapes list the series the same way every time
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,80 +2,156 @@
 package parser
 
 import (
-	"encoding/hex" // new import for hexadecimals
-	"fmt"
-	"log/slog"
+	"net/url"
 	"strings"
 )
 
-// parses the path and decodes strings when needs for slashes
-func hexCheck(path string) []string {
-
-	// Test path:
-	// path := "database1/document1/collection1/doc2/coll2/"
-
-	// Split the word based on /'
-	words := strings.Split(path, "/")
-
-	// Initialize slice to be filled with parsed words
-	parsed := make([]string, len(words))
-
-	// for each word in words
-	for parsedidx, word := range words {
-		// initialize empty current word
-		curr := ""
-		// for each index (character) in the word
-		for idx := 0; idx < len(word); idx++ {
-			// check if there is a hexadecimal
-			if word[idx] == '%' {
-
-				// hexval that needs to be decoded
-				hexval := string(word[idx+1]) + string(word[idx+2])
-				// slog.Info("this is the hexvalue")
-				// slog.Info(hexval)
-				// Imported decode function
-				let, err := hex.DecodeString(hexval)
-				// slog.Info("this is the letter decoded")
-				// slog.Info(string(let))
-				if err != nil {
-					fmt.Print("error")
-				}
-				// After converting hex -> letter, add the letter to curr
-				curr = curr + string(let)
-			} else {
-				// if it was not hex, add the letter to curr
-				curr = curr + string(word[idx])
-			}
+// the prefix of every resource path
+const prefix = "/v1/"
 
+// Path is a resource path parsed from a request: the server, a database, a document or a collection
+// Paths are parsed once, and the names in them are decoded
+type Path interface {
+	// Kind returns what the path names: server, database, document or collection
+	Kind() string
+	// Name returns the last name of the path, "" for the server
+	Name() string
+	// DatabaseName returns the name of the database the path is in, "" for the server
+	DatabaseName() string
+	// Parent returns the path of what the path is in. The server is its own parent
+	Parent() Path
+	// String returns the path with its names decoded, e.g. /v1/db/doc/col/
+	String() string
+	// Escaped returns the path with its names escaped, so it parses back to the same path
+	Escaped() string
+}
+
+// ServerPath is /v1/, the server holding the databases
+type ServerPath struct{}
+
+// DatabasePath is /v1/<db>, or /v1/<db>/ for the documents of the database
+type DatabasePath struct {
+	DB string
+	// true for the path with a trailing slash, which lists the documents of the database
+	Listing bool
+}
+
+// DocumentPath is /v1/<db>/<doc>, or a document in a collection, e.g. /v1/<db>/<doc>/<col>/<doc>
+type DocumentPath struct {
+	DB string
+	// the names below the database, alternating between documents and collections and ending with a document
+	Names []string
+}
+
+// CollectionPath is /v1/<db>/<doc>/<col>/, always with a trailing slash
+type CollectionPath struct {
+	DB string
+	// the names below the database, alternating between documents and collections and ending with a collection
+	Names []string
+}
+
+// PathError is a path that does not name a resource, e.g. one with an empty name or an invalid escape
+type PathError struct {
+	Path string
+	// the database the path is in, "" if the path does not get that far
+	DB string
+	// what the path would name if it were well formed, document or collection, "" if it is not known
+	Kind   string
+	Reason string
+}
+
+func (err *PathError) Error() string {
+	return "bad resource path " + err.Path + ": " + err.Reason
+}
+
+// Parse takes in an escaped path, like the one returned by URL.EscapedPath, and returns the resource it names
+// The path is decoded before it is split, so an escaped slash separates names like a plain one
+// A document path must not end with a slash and a collection path must, other malformed paths are a *PathError
+func Parse(escaped string) (Path, error) {
+	decoded, err := url.PathUnescape(escaped)
+	if err != nil {
+		return nil, &PathError{Path: escaped, Reason: "invalid escape"}
+	}
+	if !strings.HasPrefix(decoded, prefix) {
+		return nil, &PathError{Path: escaped, Reason: "paths start with " + prefix}
+	}
+	rest := strings.TrimPrefix(decoded, prefix)
+	if rest == "" {
+		return ServerPath{}, nil
+	}
+	slash := strings.HasSuffix(rest, "/")
+	names := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	for _, name := range names {
+		if name == "" {
+			return nil, &PathError{Path: escaped, Reason: "empty name"}
 		}
-		// Add the parsed word to the slice
-		parsed[parsedidx] = curr
 	}
 
-	// parsed should now be a slice of each word in the url
-	return parsed
+	db, names := names[0], names[1:]
+	switch {
+	case len(names) == 0:
+		return DatabasePath{DB: db, Listing: slash}, nil
+	case len(names)%2 == 1:
+		if slash {
+			return nil, &PathError{Path: escaped, DB: db, Kind: "document", Reason: "document paths do not end with /"}
+		}
+		return DocumentPath{DB: db, Names: names}, nil
+	default:
+		if !slash {
+			return nil, &PathError{Path: escaped, DB: db, Kind: "collection", Reason: "collection paths end with /"}
+		}
+		return CollectionPath{DB: db, Names: names}, nil
+	}
 }
 
-// this is called when we want to create a get request or generally need an object and want to use the entire get path
-// an integer is returned called stopPoint which is the point at which the validator should stop check and is
-// dependent on a put or get request
-func ParseURL(url string, isPut bool) ([]string, int) {
-	slog.Info("IN PARSEURLGET")
-	// Split the path into segments, and check for hex values
-	// this works if hexcheck is wrong: segments := strings.Split(url, "/")
-	segments := hexCheck(url)
-
-	// Extract information from the URL reading through values
-	length := len(segments)
-	var b = length
-	if isPut {
-		b = length - 1
-	}
-	//checking to see if there is a slash at the end
-	if segments[length-1] == "" {
-		slog.Info("taking away the extra slash")
-		b = b - 1
+func (ServerPath) Kind() string         { return "server" }
+func (ServerPath) Name() string         { return "" }
+func (ServerPath) DatabaseName() string { return "" }
+func (p ServerPath) Parent() Path       { return p }
+func (ServerPath) String() string       { return prefix }
+func (ServerPath) Escaped() string      { return prefix }
+
+func (DatabasePath) Kind() string           { return "database" }
+func (p DatabasePath) Name() string         { return p.DB }
+func (p DatabasePath) DatabaseName() string { return p.DB }
+func (DatabasePath) Parent() Path           { return ServerPath{} }
+func (p DatabasePath) String() string       { return join(p.DB, nil, p.Listing, noEscape) }
+func (p DatabasePath) Escaped() string      { return join(p.DB, nil, p.Listing, url.PathEscape) }
+
+func (DocumentPath) Kind() string           { return "document" }
+func (p DocumentPath) Name() string         { return p.Names[len(p.Names)-1] }
+func (p DocumentPath) DatabaseName() string { return p.DB }
+func (p DocumentPath) String() string       { return join(p.DB, p.Names, false, noEscape) }
+func (p DocumentPath) Escaped() string      { return join(p.DB, p.Names, false, url.PathEscape) }
+
+// Parent returns the listing of the database for a document of the database, or the collection it is in
+func (p DocumentPath) Parent() Path {
+	if len(p.Names) == 1 {
+		return DatabasePath{DB: p.DB, Listing: true}
 	}
-	return segments, b
+	return CollectionPath{DB: p.DB, Names: p.Names[:len(p.Names)-1]}
+}
+
+func (CollectionPath) Kind() string           { return "collection" }
+func (p CollectionPath) Name() string         { return p.Names[len(p.Names)-1] }
+func (p CollectionPath) DatabaseName() string { return p.DB }
+func (p CollectionPath) Parent() Path         { return DocumentPath{DB: p.DB, Names: p.Names[:len(p.Names)-1]} }
+func (p CollectionPath) String() string       { return join(p.DB, p.Names, true, noEscape) }
+func (p CollectionPath) Escaped() string      { return join(p.DB, p.Names, true, url.PathEscape) }
 
+func noEscape(name string) string { return name }
+
+// joins the names of a path below the prefix, escaping each of them
+func join(db string, names []string, slash bool, escape func(string) string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(escape(db))
+	for _, name := range names {
+		b.WriteByte('/')
+		b.WriteString(escape(name))
+	}
+	if slash {
+		b.WriteByte('/')
+	}
+	return b.String()
 }
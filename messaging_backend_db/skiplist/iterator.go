@@ -0,0 +1,243 @@
+package skiplist
+
+import (
+	"cmp"
+	"iter"
+)
+
+// Cursor walks the nodes of a List in key order without materializing them.
+//
+// A cursor over the latest state of the list is weakly consistent: it never blocks
+// writers and never returns a node that was removed before the cursor reached it.
+// Every key that is present for the whole lifetime of the cursor is visited exactly
+// once, in strictly increasing (or, when moving backwards, decreasing) order. Keys
+// inserted or removed while the cursor is moving may or may not be observed.
+//
+// A cursor over a snapshot (see View) sees exactly the keys and values of that snapshot.
+//
+// A Cursor is not safe for use by multiple goroutines at once.
+type Cursor[K cmp.Ordered, V any] struct {
+	view View[K, V]
+	curr *node[K, V]
+	val  V
+}
+
+// Cursor returns a new cursor over the latest state of the list that is positioned before the first key.
+func (s *List[K, V]) Cursor() *Cursor[K, V] {
+	return s.At(nil).Cursor()
+}
+
+// Cursor returns a new cursor over the view that is positioned before the first key.
+func (v View[K, V]) Cursor() *Cursor[K, V] {
+	return &Cursor[K, V]{view: v, curr: v.list.head}
+}
+
+// Valid reports whether the cursor is positioned on a key.
+func (c *Cursor[K, V]) Valid() bool {
+	return c.curr != nil && c.curr != c.view.list.head && c.curr != c.view.list.tail
+}
+
+// Key returns the key the cursor is positioned on. It must only be called when Valid is true.
+func (c *Cursor[K, V]) Key() K {
+	return c.curr.key
+}
+
+// Value returns the value the cursor is positioned on. It must only be called when Valid is true.
+func (c *Cursor[K, V]) Value() V {
+	return c.val
+}
+
+// Seek positions the cursor on the smallest visible key that is greater than or equal to key.
+// Returns false if there is no such key.
+func (c *Cursor[K, V]) Seek(key K) bool {
+	c.curr = c.view.list.seekGE(key)
+	c.skipForward()
+	return c.Valid()
+}
+
+// SeekLast positions the cursor on the largest visible key of the list.
+// Returns false if the list is empty.
+func (c *Cursor[K, V]) SeekLast() bool {
+	c.curr = c.view.list.last()
+	c.skipBackward()
+	return c.Valid()
+}
+
+// SeekBefore positions the cursor on the largest visible key that is less than or equal to key.
+// Returns false if there is no such key.
+func (c *Cursor[K, V]) SeekBefore(key K) bool {
+	c.curr = c.view.list.seekGE(key)
+	if c.curr != c.view.list.tail && cmp.Compare(c.curr.key, key) == 0 && c.load() {
+		return true
+	}
+	c.curr = c.view.list.seekLT(key)
+	c.skipBackward()
+	return c.Valid()
+}
+
+// Next moves the cursor to the next visible key. A cursor that was just created
+// moves to the first key. Returns false once the end of the list is reached.
+func (c *Cursor[K, V]) Next() bool {
+	if c.curr == c.view.list.tail {
+		return false
+	}
+	c.curr = c.curr.next[0].Load()
+	c.skipForward()
+	return c.Valid()
+}
+
+// Prev moves the cursor to the previous visible key. Returns false once the start of the list is reached.
+func (c *Cursor[K, V]) Prev() bool {
+	if c.curr == c.view.list.head {
+		return false
+	}
+	if c.curr == c.view.list.tail {
+		c.curr = c.view.list.last()
+	} else {
+		c.curr = c.view.list.seekLT(c.curr.key)
+	}
+	c.skipBackward()
+	return c.Valid()
+}
+
+// load reads the value of the current node as seen by the view. Returns false if the node is not visible.
+func (c *Cursor[K, V]) load() bool {
+	ver, ok := c.view.visible(c.curr)
+	if ok {
+		c.val = ver.value
+	}
+	return ok
+}
+
+// skipForward advances the cursor past nodes that are not (or no longer) visible.
+func (c *Cursor[K, V]) skipForward() {
+	for c.curr != c.view.list.tail && !c.load() {
+		c.curr = c.curr.next[0].Load()
+	}
+}
+
+// skipBackward moves the cursor back past nodes that are not (or no longer) visible.
+func (c *Cursor[K, V]) skipBackward() {
+	for c.curr != c.view.list.head && !c.load() {
+		c.curr = c.view.list.seekLT(c.curr.key)
+	}
+}
+
+// All returns an iterator over every key-value pair of the list in ascending key order.
+// The iterator has the same weak consistency guarantees as a Cursor.
+func (s *List[K, V]) All() iter.Seq2[K, V] {
+	return s.At(nil).All()
+}
+
+// Backward returns an iterator over every key-value pair of the list in descending key order.
+// The iterator has the same weak consistency guarantees as a Cursor.
+func (s *List[K, V]) Backward() iter.Seq2[K, V] {
+	return s.At(nil).Backward()
+}
+
+// Ascend returns an iterator over the pairs whose key is greater than or equal to from, in
+// ascending order. At most limit pairs are yielded; a limit of zero or less means no limit.
+func (s *List[K, V]) Ascend(from K, limit int) iter.Seq2[K, V] {
+	return s.At(nil).Ascend(from, limit)
+}
+
+// Descend returns an iterator over the pairs whose key is less than or equal to from, in
+// descending order. At most limit pairs are yielded; a limit of zero or less means no limit.
+func (s *List[K, V]) Descend(from K, limit int) iter.Seq2[K, V] {
+	return s.At(nil).Descend(from, limit)
+}
+
+// Range returns an iterator over the pairs whose key lies in the closed interval [start, end],
+// in ascending order. At most limit pairs are yielded; a limit of zero or less means no limit.
+func (s *List[K, V]) Range(start K, end K, limit int) iter.Seq2[K, V] {
+	return s.At(nil).Range(start, end, limit)
+}
+
+// All returns an iterator over every key-value pair of the view in ascending key order.
+func (v View[K, V]) All() iter.Seq2[K, V] {
+	return v.Ascend(v.list.head.key, 0)
+}
+
+// Backward returns an iterator over every key-value pair of the view in descending key order.
+func (v View[K, V]) Backward() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c := v.Cursor()
+		for ok := c.SeekLast(); ok; ok = c.Prev() {
+			if !yield(c.Key(), c.Value()) {
+				return
+			}
+		}
+	}
+}
+
+// Ascend returns an iterator over the pairs of the view whose key is greater than or equal to from.
+func (v View[K, V]) Ascend(from K, limit int) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c := v.Cursor()
+		for ok, n := c.Seek(from), 0; ok && (limit <= 0 || n < limit); ok, n = c.Next(), n+1 {
+			if !yield(c.Key(), c.Value()) {
+				return
+			}
+		}
+	}
+}
+
+// Descend returns an iterator over the pairs of the view whose key is less than or equal to from.
+func (v View[K, V]) Descend(from K, limit int) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c := v.Cursor()
+		for ok, n := c.SeekBefore(from), 0; ok && (limit <= 0 || n < limit); ok, n = c.Prev(), n+1 {
+			if !yield(c.Key(), c.Value()) {
+				return
+			}
+		}
+	}
+}
+
+// Range returns an iterator over the pairs of the view whose key lies in the closed interval [start, end].
+func (v View[K, V]) Range(start K, end K, limit int) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for k, val := range v.Ascend(start, limit) {
+			if cmp.Compare(k, end) > 0 || !yield(k, val) {
+				return
+			}
+		}
+	}
+}
+
+// live reports whether the node is fully inserted and has not been removed.
+func (n *node[K, V]) live() bool {
+	return n.fullyLinked.Load() && !n.marked.Load()
+}
+
+// seekGE returns the first node whose key is greater than or equal to key, or the tail.
+// The returned node may be concurrently removed; callers check visibility themselves.
+func (s *List[K, V]) seekGE(key K) *node[K, V] {
+	return s.seekLT(key).next[0].Load()
+}
+
+// seekLT returns the last node whose key is strictly less than key, or the head.
+func (s *List[K, V]) seekLT(key K) *node[K, V] {
+	pred := s.head
+	for level := s.maxlevel; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr != s.tail && cmp.Less(curr.key, key) {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+	}
+	return pred
+}
+
+// last returns the last node before the tail, or the head if the list is empty.
+func (s *List[K, V]) last() *node[K, V] {
+	pred := s.head
+	for level := s.maxlevel; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr != s.tail {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+	}
+	return pred
+}
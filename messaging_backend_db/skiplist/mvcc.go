@@ -0,0 +1,328 @@
+package skiplist
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSnapshotTooOld is returned when the versions needed for a requested sequence number were
+// already garbage collected because no reader held them.
+var ErrSnapshotTooOld = errors.New("versions for the requested sequence are no longer retained")
+
+var (
+	// sequence is the global write sequence shared by every list. Each write is stamped with the
+	// next value, so a sequence number names one consistent state of all lists at once.
+	// It only counts published writes: a write takes its number from allocated, makes its version
+	// visible, and then waits for the writes before it to advance sequence to its number. Every write
+	// at or below sequence is visible, so a snapshot never sees half a write.
+	sequence  atomic.Uint64
+	allocated atomic.Uint64
+
+	// horizon is the oldest sequence whose versions are still guaranteed to be retained.
+	horizon atomic.Uint64
+
+	// snapshotMu guards active, the registered snapshot sequences with their reference counts.
+	snapshotMu sync.Mutex
+	active     = make(map[uint64]int)
+	// oldest is one more than the smallest registered snapshot sequence, or zero if there is none.
+	oldest atomic.Uint64
+
+	// pending holds the lists that keep old versions or removed nodes around for a snapshot.
+	// They are compacted in the background once the snapshots holding those versions are released.
+	pending sync.Map
+	// compactions wakes the background compaction when the oldest snapshot moved
+	compactions      = make(chan struct{}, 1)
+	startCompactions sync.Once
+)
+
+// compactor is implemented by every List, whatever its key and value types.
+type compactor interface {
+	compact() bool
+}
+
+// A version is one value of a node, stamped with the sequence of the write that created it.
+// A deleted version is a tombstone: the key does not exist as of that sequence.
+type version[V any] struct {
+	seq     uint64
+	value   V
+	deleted bool
+	prev    atomic.Pointer[version[V]]
+}
+
+// Snapshot pins a sequence number so that the state of every list as of that sequence stays
+// readable. A snapshot must be released once the reader is done with it.
+type Snapshot struct {
+	seq  uint64
+	once sync.Once
+}
+
+// CurrentSequence returns the sequence number of the latest write.
+func CurrentSequence() uint64 {
+	return sequence.Load()
+}
+
+// NewSnapshot returns a snapshot of the current state of all lists.
+func NewSnapshot() *Snapshot {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	for {
+		// a write that raised the horizon past seq before seeing the snapshot may drop its versions,
+		// so the snapshot is taken again at the newer state
+		if snap, ok := register(sequence.Load()); ok {
+			return snap
+		}
+	}
+}
+
+// SnapshotAt returns a snapshot of the state of all lists as of the given sequence number.
+// Returns ErrSnapshotTooOld if the versions of that sequence were already garbage collected.
+func SnapshotAt(seq uint64) (*Snapshot, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	if seq > sequence.Load() {
+		return nil, fmt.Errorf("sequence %d has not been written yet", seq)
+	}
+	snap, ok := register(seq)
+	if !ok {
+		return nil, ErrSnapshotTooOld
+	}
+	return snap, nil
+}
+
+// ActiveSnapshots returns how many snapshots are registered and not yet released.
+func ActiveSnapshots() int {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	n := 0
+	for _, count := range active {
+		n += count
+	}
+	return n
+}
+
+// Seq returns the sequence number the snapshot reads at.
+func (snap *Snapshot) Seq() uint64 {
+	return snap.seq
+}
+
+// Release unpins the snapshot. Old versions that no other snapshot needs are then garbage collected.
+// Calling Release more than once has no effect.
+func (snap *Snapshot) Release() {
+	snap.once.Do(func() {
+		snapshotMu.Lock()
+		before := oldest.Load()
+		unregister(snap.seq)
+		after := oldest.Load()
+		snapshotMu.Unlock()
+
+		if after != before {
+			startCompactions.Do(func() { go compactPending() })
+			select {
+			case compactions <- struct{}{}:
+			default:
+				// a compaction is already due, it sees this release too
+			}
+		}
+	})
+}
+
+// compactPending compacts the pending lists each time the oldest snapshot moves, off the goroutines of readers
+func compactPending() {
+	for range compactions {
+		pending.Range(func(key, _ any) bool {
+			if !key.(compactor).compact() {
+				pending.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// register records a snapshot at seq, or returns false if versions of seq may already have been dropped.
+// Must be called with snapshotMu held.
+func register(seq uint64) (*Snapshot, bool) {
+	active[seq]++
+	updateOldest()
+	// writers raise the horizon before they look at oldest again, see cutoff, so either the snapshot
+	// sees the horizon of a write that would drop its versions, or that write sees the snapshot
+	if seq < horizon.Load() {
+		unregister(seq)
+		return nil, false
+	}
+	return &Snapshot{seq: seq}, true
+}
+
+// unregister forgets one snapshot at seq. Must be called with snapshotMu held.
+func unregister(seq uint64) {
+	active[seq]--
+	if active[seq] == 0 {
+		delete(active, seq)
+	}
+	updateOldest()
+}
+
+// updateOldest recomputes oldest from active. Must be called with snapshotMu held.
+func updateOldest() {
+	var min uint64
+	for seq := range active {
+		if min == 0 || seq+1 < min {
+			min = seq + 1
+		}
+	}
+	oldest.Store(min)
+}
+
+// cutoff returns the sequence below which no reader can ask for a version any more: the oldest
+// registered snapshot, or the latest write if there is none. The horizon is raised to match, so no
+// snapshot can be registered below it afterwards. A snapshot registered while the horizon is raised
+// is seen by the second look at oldest, see register.
+func cutoff() uint64 {
+	keep := sequence.Load()
+	if o := oldest.Load(); o != 0 {
+		keep = o - 1
+	}
+	for {
+		h := horizon.Load()
+		if h >= keep || horizon.CompareAndSwap(h, keep) {
+			break
+		}
+	}
+	if o := oldest.Load(); o != 0 && o-1 < keep {
+		keep = o - 1
+	}
+	return keep
+}
+
+// commit stamps a write with the next sequence number. publish must make the new version visible;
+// the sequence only advances past the write once it and every write before it are published.
+// Returns the sequence of the write and the cutoff below which versions may be dropped.
+func commit(publish func(seq uint64)) (seq uint64, keep uint64) {
+	seq = allocated.Add(1)
+	publish(seq)
+	// publishing is a single store, the writes before this one are about to finish theirs
+	for !sequence.CompareAndSwap(seq-1, seq) {
+		runtime.Gosched()
+	}
+	return seq, cutoff()
+}
+
+// prune drops the versions starting at v that no reader at or after keep can see. Returns whether
+// versions newer than keep are still chained to older ones, i.e. whether a snapshot holds history.
+func prune[V any](v *version[V], keep uint64) bool {
+	retained := false
+	for ; v != nil; v = v.prev.Load() {
+		if v.seq <= keep {
+			v.prev.Store(nil)
+			return retained
+		}
+		retained = v.prev.Load() != nil
+	}
+	return retained
+}
+
+// markPending registers the list for compaction once the current snapshots are released.
+func (s *List[K, V]) markPending() {
+	pending.Store(compactor(s), struct{}{})
+}
+
+// compact drops versions and removed nodes that no registered snapshot can see any more.
+// Returns whether the list still holds anything for a snapshot.
+func (s *List[K, V]) compact() bool {
+	keep := cutoff()
+
+	stillPending := false
+	for n := s.head.next[0].Load(); n != s.tail; n = n.next[0].Load() {
+		head := n.head.Load()
+		if head == nil || n.marked.Load() {
+			continue
+		}
+		if head.deleted {
+			if head.seq <= keep {
+				s.unlinkTombstone(n, keep)
+			} else {
+				stillPending = true
+			}
+			continue
+		}
+		if prune(head, keep) {
+			stillPending = true
+		}
+	}
+	return stillPending
+}
+
+// unlinkTombstone physically removes a node whose latest version is a tombstone that no snapshot needs.
+func (s *List[K, V]) unlinkTombstone(victim *node[K, V], keep uint64) {
+	victim.mtx.Lock()
+	defer victim.mtx.Unlock()
+
+	head := victim.head.Load()
+	if victim.marked.Load() || !victim.fullyLinked.Load() || !head.deleted || head.seq > keep {
+		// revived or already being removed in the meantime
+		return
+	}
+	victim.marked.Store(true)
+	s.unlinkMarked(victim)
+}
+
+// FindVersion returns the latest value stored under key together with the sequence number of the write that stored it.
+func (s *List[K, V]) FindVersion(key K) (V, uint64, bool) {
+	return s.At(nil).FindVersion(key)
+}
+
+// View is a read-only view of a List, either of its latest state or of its state as of a snapshot.
+type View[K cmp.Ordered, V any] struct {
+	list   *List[K, V]
+	seq    uint64
+	latest bool
+}
+
+// At returns a view of the list as of the given snapshot. A nil snapshot gives the latest state.
+// A view of the latest state is weakly consistent; a view at a snapshot never changes.
+func (s *List[K, V]) At(snap *Snapshot) View[K, V] {
+	if snap == nil {
+		return View[K, V]{list: s, latest: true}
+	}
+	return View[K, V]{list: s, seq: snap.seq}
+}
+
+// visible returns the version of the node that is visible in the view, if any.
+func (v View[K, V]) visible(n *node[K, V]) (*version[V], bool) {
+	if v.latest {
+		if !n.live() {
+			return nil, false
+		}
+		head := n.head.Load()
+		return head, head != nil && !head.deleted
+	}
+	for ver := n.head.Load(); ver != nil; ver = ver.prev.Load() {
+		if ver.seq <= v.seq {
+			return ver, !ver.deleted
+		}
+	}
+	return nil, false
+}
+
+// Find returns the value stored under key in the view.
+func (v View[K, V]) Find(key K) (V, bool) {
+	value, _, found := v.FindVersion(key)
+	return value, found
+}
+
+// FindVersion returns the value stored under key in the view together with the sequence number of
+// the write that stored it.
+func (v View[K, V]) FindVersion(key K) (V, uint64, bool) {
+	levelFound, _, succs := v.list.findHelp(key)
+	if levelFound == -1 {
+		return *new(V), 0, false
+	}
+	ver, ok := v.visible(succs[levelFound])
+	if !ok {
+		return *new(V), 0, false
+	}
+	return ver.value, ver.seq, true
+}
@@ -4,12 +4,20 @@ package skiplist
 import (
 	"cmp"
 	"fmt"
-	"log/slog"
 	"math/rand"
 	"sync"
 	"sync/atomic"
 )
 
+// retries counts the times a write found the list changed under it and started over, see Retries
+var retries atomic.Uint64
+
+// Retries returns how many times writes to any list had to start over because a concurrent write changed
+// the nodes they were about to lock. Reads never retry, they read from a snapshot
+func Retries() uint64 {
+	return retries.Load()
+}
+
 // UpdateCheck is a function used to determine what a specific object should do when it is trying to insert an existing node into a skiplist
 type UpdateCheck[K cmp.Ordered, V any] func(key K, currValue V, exists bool) (newValue V, err error)
 
@@ -29,12 +37,16 @@ type SkipList[K cmp.Ordered, V any] interface {
 
 // A node in the concurrent list. Stores a key and a corresponding item.
 type node[K cmp.Ordered, V any] struct {
+	// held while the node is a predecessor being relinked, while it is being removed,
+	// and while its value is being replaced. A new node is also locked until it is fully linked.
 	mtx sync.Mutex
 
 	key      K
-	value    V
 	topLevel int
 
+	// the latest version of the value, chained to the older versions that snapshots may still read
+	head atomic.Pointer[version[V]]
+
 	// whether the node has been removed from the list. defaults to false.
 	marked atomic.Bool
 
@@ -46,12 +58,13 @@ type node[K cmp.Ordered, V any] struct {
 
 // A list data structure that supports concurrent access. The list's nodes
 // contain key-value pairs. The list may contain at most one node with a given
-// key. Also keeps track of the maxlevel that any node can have, and an atomic timestamp counter for Query
+// key. Also keeps track of the maxlevel that any node can have.
+// Every write is stamped with a global sequence number and older values are kept
+// for as long as a Snapshot may read them (see mvcc.go).
 type List[K cmp.Ordered, V any] struct {
-	head      *node[K, V]
-	tail      *node[K, V]
-	maxlevel  int
-	timestamp atomic.Int32 // could be 64, arbitrary choice
+	head     *node[K, V]
+	tail     *node[K, V]
+	maxlevel int
 }
 
 // Constructs and returns a new list that supports concurrent access.
@@ -63,8 +76,6 @@ func NewList[K cmp.Ordered, V any](minKey K, maxKey K) List[K, V] {
 	// using maxlevel = 5 for placeholder:
 	maxlev := 5
 
-	slog.Info("in new list")
-
 	var dummyHead node[K, V] = node[K, V]{
 		key:  minKey,
 		next: make([]atomic.Pointer[node[K, V]], maxlev),
@@ -74,70 +85,51 @@ func NewList[K cmp.Ordered, V any](minKey K, maxKey K) List[K, V] {
 		next: make([]atomic.Pointer[node[K, V]], maxlev),
 	}
 
-	slog.Info("before assiging head and tail")
-
 	for i := 0; i < maxlev; i++ {
 		dummyHead.next[i].Store(&dummyTail)
 		dummyTail.next[i].Store(&dummyHead)
 	}
 
-	slog.Info("before return")
-
 	return List[K, V]{
-		head:      &dummyHead,
-		tail:      &dummyTail,
-		maxlevel:  maxlev - 1,
-		timestamp: atomic.Int32{},
+		head:     &dummyHead,
+		tail:     &dummyTail,
+		maxlevel: maxlev - 1,
 	}
 }
 
 // Helper function for Find. Takes in a key and returns the level at which the key was found and
 // a list of preceding and succeeding nodes. On failure, this returns -1, nil, nil
+// The tail is recognized by identity rather than by key, so keys past `maxKey` never change the list.
 func (s *List[K, V]) findHelp(key K) (int, []*node[K, V], []*node[K, V]) {
 
-	slog.Info("starting findhelp")
-	fmt.Println(key)
-	// before anything, make sure this key is larger than head and smaller than tail
+	// before anything, make sure this key is larger than head
 	// if key<=head.key, then that means key is empty. can't have empty stuff
 	if key <= s.head.key {
 		return -1, nil, nil
-	} else if key >= s.tail.key {
-		// hopefully this just always makes the tail's key larger than anything in else
-		s.tail.key = key + key
 	}
 
 	foundLevel := -1
-	level := s.maxlevel
-	// pred := s.head[level].Load()
 	pred := s.head
-	var curr *node[K, V]
 
 	// make a list of nodes of length level
-	preds := make([]*node[K, V], level+1)
-	succs := make([]*node[K, V], level+1)
+	preds := make([]*node[K, V], s.maxlevel+1)
+	succs := make([]*node[K, V], s.maxlevel+1)
 
-	slog.Info("before for loop of find help")
+	for level := s.maxlevel; level >= 0; level-- {
+		curr := pred.next[level].Load()
 
-	for level >= 0 {
-		curr = pred.next[level].Load()
-
-		for key > curr.key {
+		for curr != s.tail && key > curr.key {
 			pred = curr
 			curr = pred.next[level].Load()
 		}
 
-		//fmt.Println(key)
-		//fmt.Println(curr.key)
-
-		if foundLevel == -1 && key == curr.key {
+		if foundLevel == -1 && curr != s.tail && key == curr.key {
 			foundLevel = level
 		}
 
 		preds[level] = pred
 		succs[level] = curr
-		level = level - 1
 	}
-	slog.Info("returning from find help")
 
 	return foundLevel, preds, succs
 }
@@ -145,370 +137,264 @@ func (s *List[K, V]) findHelp(key K) (int, []*node[K, V], []*node[K, V]) {
 // Takes in a key and tries to find that node in the skiplist
 // Returns the node and true on success, nil and false on failure
 func (s *List[K, V]) Find(key K) (V, bool) {
+	return s.At(nil).Find(key)
+}
 
-	levelFound, _, succs := s.findHelp(key)
+// randomLevel picks the top level of a new node: .5 chance of being 0, .25 of being 1, e.t.c
+func (s *List[K, V]) randomLevel() int {
+	randnum := rand.Intn(100) // this is 0 to 99
 
-	if levelFound == -1 {
-		slog.Info("object not found")
-		return *new(V), false
+	if randnum >= 50 {
+		return 0
+	} else if randnum >= 25 {
+		return 1
+	} else if randnum >= 12 {
+		return 2
 	}
-	slog.Info("object found")
+	return 3
+}
 
-	found := succs[levelFound]
+// lockPreds locks the predecessors of levels 0 to topLevel, in that order, and checks that each
+// one is still unmarked and directly linked to succOf(level). Unless removing, the successor must
+// not be marked either. A node that is the predecessor on several consecutive levels is locked
+// only once. Returns the highest level that was locked and whether every level was valid.
+// Locks are always taken from the right of the list to the left, so two writers can never wait
+// on each other in a cycle.
+func (s *List[K, V]) lockPreds(preds []*node[K, V], topLevel int, succOf func(level int) *node[K, V], removing bool) (int, bool) {
+	highestLocked := -1
+	valid := true
+	for level := 0; valid && level <= topLevel; level++ {
+		pred := preds[level]
+		if level == 0 || pred != preds[level-1] {
+			pred.mtx.Lock()
+		}
+		highestLocked = level
 
-	return found.value, found.fullyLinked.Load() && !found.marked.Load()
+		succ := succOf(level)
+		valid = !pred.marked.Load() && (removing || !succ.marked.Load()) && pred.next[level].Load() == succ
+	}
+	return highestLocked, valid
 }
 
-// From slides, Insert algorithm (need to modify for updating too later)
+// unlockPreds releases the locks taken by lockPreds.
+func unlockPreds[K cmp.Ordered, V any](preds []*node[K, V], highestLocked int) {
+	for level := highestLocked; level >= 0; level-- {
+		if level == 0 || preds[level] != preds[level-1] {
+			preds[level].mtx.Unlock()
+		}
+	}
+}
+
+// Lazy insertion algorithm, extended to replace the value of an existing key.
 // Takes in the key and updatecheck function and tries to insert that node.
 // Returns true as its first value if the node was updated, and false otherwise. It returns an error if encountered as its second value
+// When check returns an error nothing is changed; updated still reports whether the key existed.
 func (s *List[K, V]) Upsert(key K, check UpdateCheck[K, V]) (updated bool, err error) {
+	updated, _, err = s.UpsertVersion(key, check)
+	return updated, err
+}
+
+// UpsertVersion is Upsert that also returns the sequence number the write was stamped with.
+// The sequence is zero when nothing was written.
+func (s *List[K, V]) UpsertVersion(key K, check UpdateCheck[K, V]) (updated bool, seq uint64, err error) {
 
 	// we don't want to insert an empty string:
 	if key <= s.head.key {
-		return false, fmt.Errorf("trying to insert an empty string")
+		return false, 0, fmt.Errorf("trying to insert an empty string")
 	}
 
-	// Pick random top level, .5 chance of being 0, .25 of being 1, e.t.c
-	randnum := rand.Intn(100) // this is 0 to 99
-
-	// topLevel has 50% change of being 0, 25% chance of being 1, e.t.c.
-	var topLevel int
-	if randnum >= 50 {
-		topLevel = 0
-	} else if randnum >= 25 {
-		topLevel = 1
-	} else if randnum >= 12 {
-		topLevel = 2
-	} else {
-		topLevel = 3
-	}
-
-	slog.Info("After toplevel")
+	topLevel := s.randomLevel()
 
 	// Keep trying to insert until success or failure
 	for {
-		slog.Info("line 224")
 		levelFound, preds, succs := s.findHelp(key)
-		var found *node[K, V]
 
 		if levelFound != -1 {
-			found = succs[levelFound]
-
-			if !found.marked.Load() {
-				// Node is being added, wait for that to finish
-				for !found.fullyLinked.Load() {
-					// do nothing
-				}
-				// this is the case of updating since you found the node
-				val, err := check(key, found.value, true)
-				if err != nil {
-					slog.Info("Error != nil in upsert")
-					found.value = val
-					return true, err
-				}
-				slog.Info("error == nil in upsert")
-				// is this enough to update the value?
-				found.value = val
-				return true, err
+			found := succs[levelFound]
+
+			// this is the case of updating since you found the node. A node that is still being
+			// linked is locked by its inserter, so this waits for the insertion instead of spinning.
+			found.mtx.Lock()
+			if found.marked.Load() {
+				// found node is currently being removed, try again once it is gone
+				found.mtx.Unlock()
+				retries.Add(1)
+				continue
 			}
-			// otherwise, found node is currently being removed, try again
-			continue
-		}
-		slog.Info("After first if")
-
-		// Moving to Slide 18
-		highestLocked := -1
-		valid := true
-		level := 0
-
-		// keep a map of node to level, then if its in the map you know you already locked it
-		lockednodes := make(map[*node[K, V]]bool)
 
-		// Lock all predecessors
-		for valid && level <= topLevel {
-			slog.Info("locking")
-			// gotta make sure you haven't locked this yet. also note that this node is locked
-			if preds[level].mtx.TryLock() {
-				lockednodes[preds[level]] = true
+			// a node whose latest version is a tombstone is kept for snapshots only; writing to it
+			// brings the key back to life
+			curr := found.head.Load()
+			exists := !curr.deleted
+			var currVal V
+			if exists {
+				currVal = curr.value
+			}
+			val, err := check(key, currVal, exists)
+			if err != nil {
+				found.mtx.Unlock()
+				return exists, 0, err
 			}
 
-			highestLocked = level
-			slog.Info("finished lock")
-
-			// Make sure pred and succ are still valid
-			unmarked := !preds[level].marked.Load() && !succs[level].marked.Load()
-			connected := preds[level].next[level].Load() == succs[level]
-			valid = unmarked && connected
-
-			// move to the next highest level
-			level = level + 1
+			newVersion := &version[V]{value: val}
+			newVersion.prev.Store(curr)
+			seq, keep := commit(func(seq uint64) {
+				newVersion.seq = seq
+				found.head.Store(newVersion)
+			})
+			if prune(newVersion, keep) {
+				s.markPending()
+			}
+			found.mtx.Unlock()
+			return exists, seq, nil
 		}
-		slog.Info("After lock all preds")
 
+		// Lock all predecessors
+		highestLocked, valid := s.lockPreds(preds, topLevel, func(level int) *node[K, V] { return succs[level] }, false)
 		if !valid {
 			// Preds or succs changed, unlock and try again
-			level = highestLocked
-			slog.Info("node was either marked for removal or not fully connected")
-			for level >= 0 {
-				if lockednodes[preds[level]] {
-					preds[level].mtx.Unlock()
-					lockednodes[preds[level]] = false
-				}
-				level = level - 1
-			}
+			unlockPreds(preds, highestLocked)
+			retries.Add(1)
 			continue
 		}
-		slog.Info("After !valid")
-
-		// this is the case of updating
-		if levelFound != -1 {
-			slog.Info("INSIDE if levelFound != -1")
-			val, err := check(key, found.value, true)
-			if err != nil {
-				slog.Info("Error != nil in upsert")
-				return false, err
-			}
-			slog.Info("error == nil in upsert")
-			// is this enough to update the value
-			found.value = val
-			return true, err
-		}
-		slog.Info("After case for updating")
 
 		// this is the case of inserting a new node
-
 		var currVal V
 		val, err := check(key, currVal, false)
 		if err != nil {
-			slog.Info("error: sending false to check function and this print says that it sent true")
+			unlockPreds(preds, highestLocked)
+			return false, 0, err
 		}
 
-		var newnode node[K, V] = node[K, V]{
-			next:     make([]atomic.Pointer[node[K, V]], s.maxlevel+1), // + 1 ??
+		newnode := &node[K, V]{
+			next:     make([]atomic.Pointer[node[K, V]], s.maxlevel+1),
 			key:      key,
-			value:    val,
 			topLevel: topLevel,
-			//marked: atomic.Bool{}, false
-			//fullyLinked: atomic.Bool{}, false
 		}
+		// nobody can reach the node yet, so this never blocks
+		newnode.mtx.Lock()
 
 		// Set next pointers
-		level = 0
-		for level <= topLevel {
+		for level := 0; level <= topLevel; level++ {
 			newnode.next[level].Store(succs[level])
-			level = level + 1
 		}
-		slog.Info("after setting pointers")
 
-		// Add to skip list from bottom
-		level = 0
-		for level <= topLevel {
-			preds[level].next[level].Store(&newnode)
-			level = level + 1
-		}
-		slog.Info("after adding to skip list")
+		seq, _ := commit(func(seq uint64) {
+			newnode.head.Store(&version[V]{seq: seq, value: val})
 
-		// Node has been added
-		newnode.fullyLinked.Store(true)
-
-		slog.Info("after storing node")
-
-		// Unlocking the keys of the map of lockednodes
-		for node := range lockednodes {
-			node.mtx.Unlock()
-		}
-
-		slog.Info("after unlocking")
-
-		// Increment timestamp for Query function
-		s.timestamp.Add(1)
+			// Add to skip list from bottom
+			for level := 0; level <= topLevel; level++ {
+				preds[level].next[level].Store(newnode)
+			}
 
-		slog.Info("end of upsert")
+			// Node has been added
+			newnode.fullyLinked.Store(true)
+		})
+		newnode.mtx.Unlock()
+		unlockPreds(preds, highestLocked)
 
-		return false, nil
+		return false, seq, nil
 	}
 }
 
 // Takes in a key and attempts to remove that node from the skiplist.
 // Returns the removed value and true on success, or an empty value and false on failure.
+// While a snapshot older than the removal is registered the node stays linked behind a tombstone,
+// invisible to everyone else; it is unlinked once those snapshots are released.
 func (s *List[K, V]) Remove(key K) (removedValue V, removed bool) {
-	var victim *node[K, V] // Victim node to remove
-	isMarked := false      // Have we already marked the victim?
-	topLevel := -1         // Top level of victim node
-
-	for {
-		slog.Info("line 412")
-		levelFound, preds, succs := s.findHelp(key)
-		if levelFound == -1 {
-			slog.Info("did not find it to be removed")
-		}
-		if levelFound != -1 {
-			slog.Info("found it in remove")
-			victim = succs[levelFound]
-		}
-		slog.Info("before !isMarked")
-		var emptyVal V
-		if !isMarked {
-			slog.Info("in !isMarked")
-			// First time through
-			if levelFound == -1 {
-				slog.Info("it is not found")
-				// No matching node found
-				// return <nothing>, false. nil does not work?
-				return emptyVal, false
-			}
-
-			if !victim.fullyLinked.Load() {
-				slog.Info("it is not fullyLinked")
-				// Victim not yet inserted
-				return emptyVal, false
-			}
-
-			if victim.marked.Load() {
-				slog.Info("it is marked")
-				// Victim already being removed
-				return emptyVal, false
-			}
+	return s.RemoveIf(key, nil)
+}
 
-			if victim.topLevel != levelFound {
-				slog.Info("the victim's toplevel is not the found level?")
-				// Wasn't fullyLinked when found
-				return emptyVal, false
-			}
+// RemoveIf is Remove that only removes the node if check approves its current value.
+// check runs while the node is locked, so the value cannot change between the check and the removal.
+// A nil check approves every value.
+func (s *List[K, V]) RemoveIf(key K, check func(value V) bool) (removedValue V, removed bool) {
+	var emptyVal V
 
-			topLevel = victim.topLevel
-			slog.Info("locking the victim")
-			victim.mtx.Lock()
-			if victim.marked.Load() {
-				slog.Info("unlocking the victim, it is marked")
-				// Another remove call beat us
-				victim.mtx.Unlock()
-				//return victim.value, false
-				return emptyVal, false
-			}
+	levelFound, _, succs := s.findHelp(key)
+	if levelFound == -1 {
+		// No matching node found
+		return emptyVal, false
+	}
+	victim := succs[levelFound]
 
-			slog.Info("marking the victim")
-			victim.marked.Store(true)
-			isMarked = true
+	// Victim not yet inserted, already being removed, or wasn't fullyLinked when found
+	if !victim.fullyLinked.Load() || victim.marked.Load() || victim.topLevel != levelFound {
+		return emptyVal, false
+	}
 
-		}
-		slog.Info("after !isMarked")
+	victim.mtx.Lock()
+	defer victim.mtx.Unlock()
 
-		// Victim is locked and marked
-		highestLocked := -1
-		level := 0
-		valid := true
+	curr := victim.head.Load()
+	if victim.marked.Load() || curr.deleted {
+		// Another remove call beat us
+		return emptyVal, false
+	}
+	if check != nil && !check(curr.value) {
+		return emptyVal, false
+	}
 
-		var pred *node[K, V]
-		var succCheck bool
+	tombstone := &version[V]{deleted: true}
+	tombstone.prev.Store(curr)
+	seq, keep := commit(func(seq uint64) {
+		tombstone.seq = seq
+		victim.head.Store(tombstone)
+	})
+
+	if seq > keep {
+		// a snapshot can still read the removed value
+		prune(tombstone, keep)
+		s.markPending()
+		return curr.value, true
+	}
 
-		// keep a map of node to level, if its in the map you know you already locked it
-		lockednodes := make(map[*node[K, V]]bool)
+	tombstone.prev.Store(nil)
+	victim.marked.Store(true)
+	s.unlinkMarked(victim)
 
-		for valid && (level <= topLevel) {
-			pred = preds[level]
-			if pred.mtx.TryLock() {
-				lockednodes[preds[level]] = true
-			}
-			highestLocked = level
-			succCheck = (pred.next[level].Load() == victim)
-			valid = !pred.marked.Load() && succCheck
-			level = level + 1
-		}
+	return curr.value, true
+}
 
-		slog.Info("before !valid")
+// unlinkMarked physically unlinks a node that is locked and marked by the caller.
+func (s *List[K, V]) unlinkMarked(victim *node[K, V]) {
+	for {
+		_, preds, _ := s.findHelp(victim.key)
 
+		// Victim is locked and marked, lock the predecessors
+		highestLocked, valid := s.lockPreds(preds, victim.topLevel, func(level int) *node[K, V] { return victim }, true)
 		if !valid {
-			// Unlock
-			level = highestLocked
-			for level >= 0 {
-				if lockednodes[preds[level]] {
-					preds[level].mtx.Unlock()
-					lockednodes[preds[level]] = false
-				}
-				level = level - 1
-			}
 			// Predecessors changed, try again
 			// victim remains locked and marked
+			unlockPreds(preds, highestLocked)
+			retries.Add(1)
 			continue
 		}
 
-		slog.Info("after !valid")
-
 		// All preds are locked and valid, unlink
-		level = topLevel
-		for level >= 0 {
-			// Not sure about this line
+		for level := victim.topLevel; level >= 0; level-- {
 			preds[level].next[level].Store(victim.next[level].Load())
-			level = level - 1
-		}
-		// Unlock
-		victim.mtx.Unlock()
-		level = highestLocked
-		for level >= 0 {
-			if lockednodes[preds[level]] {
-				preds[level].mtx.Unlock()
-				lockednodes[preds[level]] = false
-			}
-			level = level - 1
 		}
 
-		// Increment timestamp for Query function
-		s.timestamp.Add(1)
-
-		slog.Info("returning from Remove")
-
-		return victim.value, true
+		unlockPreds(preds, highestLocked)
+		return
 	}
 }
 
-// Takes in a start and end parameter that defines what range to query on.
-// Returns a slice of key value pairs that represent the nodes found.
+// Takes in a start and end parameter that defines what range to query on. A zero start or end
+// leaves that side of the range unbounded. Returns a slice of key value pairs that represent the
+// nodes found. The results are read from a snapshot, so they are a consistent view of the list;
+// use the iterators to stream large ranges instead.
 func (s *List[K, V]) Query(start K, end K) (results []Pair[K, V]) {
-	slog.Info("In Query")
-	startString := fmt.Sprint(start)
-	endString := fmt.Sprint(end)
-	if startString == "" {
-		startString = "a"
-	}
-	if endString == "" {
-		endString = fmt.Sprint(s.tail.key)
-		endString = endString[:len(endString)-1] + "y"
-	}
-	slog.Info("start string", startString)
-	slog.Info("end string", endString)
-	var curString string
-	for {
-		// Initialize a condition to tryAgain, and a timestamp of first check
-		curr := s.head
-		curString = fmt.Sprint(curr.key)
-
-		//savedList := make([]atomic.Pointer[node[K, V]],  what would length be?)
-		var savedList []Pair[K, V]
-		var p Pair[K, V]
-
-		stmp1 := s.timestamp.Load()
-
-		for curString <= endString {
-			// iterate through the list at level 0, saving each node in the list
+	snap := NewSnapshot()
+	defer snap.Release()
 
-			slog.Info("current docName ", curString)
-			if curString >= startString {
-				p = Pair[K, V]{Key: curr.key, Value: curr.value}
-				savedList = append(savedList, p)
-			}
-			curr = curr.next[0].Load()
-			curString = fmt.Sprint(curr.key)
-
-		}
-
-		// do a second check of the list, to see if it remained the same
-		stmp2 := s.timestamp.Load()
-
-		if stmp1 != stmp2 {
-			continue
+	var zero K
+	for k, v := range s.At(snap).Ascend(start, 0) {
+		if end != zero && cmp.Compare(k, end) > 0 {
+			break
 		}
-		return savedList
+		results = append(results, Pair[K, V]{Key: k, Value: v})
 	}
+	return results
 }
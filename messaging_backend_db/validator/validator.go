@@ -4,29 +4,72 @@ package validator
 import (
 	"bytes"
 	"errors"
-	"log/slog"
+	"strconv"
+	"strings"
 
 	"github.com/santhosh-tekuri/jsonschema"
 )
 
 // Validate validates the json file agains a json schema, returns true if document conforms to schema, else false.
 func Validate(schema *jsonschema.Schema, docJSON []byte) (bool, error) {
-	slog.Info("Validation: check that given schema is not nil")
 	if schema == nil {
-		slog.Error("schema is nil")
 		return false, errors.New("given schema is not valid")
 	}
 
 	jsonReader := bytes.NewReader(docJSON)
 
-	slog.Info("past NewReader docJSON")
-
 	// Validate the JSON data against the compiled schema
 	if err := schema.Validate(jsonReader); err != nil {
-		slog.Error("data does not conform to the schema:", err)
 		return false, err
 	}
 
-	slog.Info("data conforms to schema")
 	return true, nil
 }
+
+// Violation is one way a document does not conform to a schema
+type Violation struct {
+	// json pointer to the part of the document that is invalid, "" for the whole document
+	InstancePath string `json:"instancePath"`
+	// the schema keyword that failed, e.g. required or type
+	Keyword string `json:"keyword"`
+	// the url of the schema and the json pointer to the keyword in it
+	SchemaLocation string `json:"schemaLocation"`
+	Message        string `json:"message"`
+}
+
+// Violations takes in an error returned by Validate and lists the violations it reports, innermost first
+// An error that is not a validation error, e.g. a body that is not JSON, is one violation of the whole document
+func Violations(err error) []Violation {
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return []Violation{{Message: err.Error()}}
+	}
+	var violations []Violation
+	var collect func(*jsonschema.ValidationError)
+	collect = func(verr *jsonschema.ValidationError) {
+		if len(verr.Causes) == 0 {
+			violations = append(violations, Violation{
+				InstancePath:   strings.TrimPrefix(verr.InstancePtr, "#"),
+				Keyword:        keyword(verr.SchemaPtr),
+				SchemaLocation: verr.SchemaURL + verr.SchemaPtr,
+				Message:        verr.Message,
+			})
+		}
+		for _, cause := range verr.Causes {
+			collect(cause)
+		}
+	}
+	collect(verr)
+	return violations
+}
+
+// returns the keyword a schema pointer ends at, skipping array indexes like the 0 of allOf/0
+func keyword(schemaPtr string) string {
+	segments := strings.Split(strings.TrimPrefix(schemaPtr, "#"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if _, err := strconv.Atoi(segments[i]); err != nil && segments[i] != "" {
+			return segments[i]
+		}
+	}
+	return ""
+}